@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,7 +15,9 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/server"
+	"github.com/superfly/wormhole/session"
 )
 
 const (
@@ -32,25 +35,29 @@ const (
 var (
 	errWrongAuthHeader      = errorResponse{`Authorization header value should use "Token ..." format`}
 	errNotFound             = errorResponse{`Not Found`}
+	errTokenExpired         = errorResponse{`Token expired`}
+	errForbidden            = errorResponse{`Token not allowed to use the API`}
 	errGenericServerProblem = errorResponse{`Internal Server Error`}
 )
 
 // Handler handles the API HTTP server
 type Handler struct {
-	logger    *logrus.Entry
-	router    chi.Router
-	redisPool *redis.Pool
+	logger *logrus.Entry
+	router chi.Router
+	store  session.Store
+	tokens *auth.Verifier
 }
 
 // NewServer ...
-func NewServer(logger *logrus.Logger, redisPool *redis.Pool) *http.Server {
-	return &http.Server{Handler: NewHandler(logger, redisPool)}
+func NewServer(logger *logrus.Logger, store session.Store, tokens *auth.Verifier) *http.Server {
+	return &http.Server{Handler: NewHandler(logger, store, tokens)}
 }
 
 // NewHandler creates a new API handler
-func NewHandler(logger *logrus.Logger, redisPool *redis.Pool) *Handler {
+// Signed tokens are verified with tokens, if set
+func NewHandler(logger *logrus.Logger, store session.Store, tokens *auth.Verifier) *Handler {
 	r := chi.NewRouter()
-	h := &Handler{logger: logger.WithFields(logrus.Fields{"prefix": "api"}), router: r, redisPool: redisPool}
+	h := &Handler{logger: logger.WithFields(logrus.Fields{"prefix": "api"}), router: r, store: store, tokens: tokens}
 	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{
 		Logger: logger,
 	}))
@@ -79,39 +86,59 @@ func jsonMiddleware(next http.Handler) http.Handler {
 
 func (h *Handler) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		auth := req.Header.Get(authHeader)
+		authorization := req.Header.Get(authHeader)
 		w.Header().Set("content-type", "application/json")
 
-		if auth == "" || !strings.HasPrefix(auth, authHeaderPrefix) {
+		if authorization == "" || !strings.HasPrefix(authorization, authHeaderPrefix) {
 			jsonResponse(w, errWrongAuthHeader, http.StatusUnauthorized)
 			return
 		}
 
-		token := strings.TrimSpace(strings.TrimPrefix(auth, authHeaderPrefix))
+		token := strings.TrimSpace(strings.TrimPrefix(authorization, authHeaderPrefix))
 
 		if token == "" {
 			jsonResponse(w, errWrongAuthHeader, http.StatusUnauthorized)
 			return
 		}
 
-		redisConn := h.redisPool.Get()
-		defer redisConn.Close()
+		if h.tokens != nil && auth.IsSigned(token) {
+			h.signedTokenAuth(next, w, req, token)
+			return
+		}
 
-		backendID, err := redis.String(redisConn.Do("HGET", "backend_tokens", token))
-		if err != nil {
-			if err == redis.ErrNil {
-				jsonResponse(w, errNotFound, http.StatusUnauthorized)
-				return
-			}
+		backendID, err := h.store.BackendIDFromToken(token)
+		if err != nil && err != redis.ErrNil {
 			h.logger.Error(err)
 			jsonResponse(w, errGenericServerProblem, http.StatusInternalServerError)
 			return
 		}
+		if backendID == "" {
+			jsonResponse(w, errNotFound, http.StatusUnauthorized)
+			return
+		}
 
 		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), keyBackendID, backendID)))
 	})
 }
 
+// signedTokenAuth authenticates the request with a signed token, verified offline
+func (h *Handler) signedTokenAuth(next http.Handler, w http.ResponseWriter, req *http.Request, token string) {
+	claims, err := h.tokens.Verify(token)
+	if err == auth.ErrTokenExpired {
+		jsonResponse(w, errTokenExpired, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		jsonResponse(w, errNotFound, http.StatusUnauthorized)
+		return
+	}
+	if !claims.API {
+		jsonResponse(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), keyBackendID, claims.BackendID)))
+}
+
 func jsonResponse(w http.ResponseWriter, j interface{}, code int) {
 	w.WriteHeader(code)
 	b, _ := json.Marshal(j)
@@ -124,11 +151,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 func (h *Handler) servers(w http.ResponseWriter, req *http.Request) {
-	redisConn := h.redisPool.Get()
-	defer redisConn.Close()
-
-	t := time.Now().Unix()
-	rawServers, err := redis.ByteSlices(redisConn.Do("ZREVRANGEBYSCORE", "servers", "+inf", t-30))
+	rawServers, err := h.store.Servers(time.Now().Add(-30 * time.Second))
 	if err != nil {
 		if err == redis.ErrNil {
 			jsonResponse(w, []struct{}{}, http.StatusOK)
@@ -156,10 +179,7 @@ func (h *Handler) servers(w http.ResponseWriter, req *http.Request) {
 func (h *Handler) endpoints(w http.ResponseWriter, req *http.Request) {
 	backendID := req.Context().Value(keyBackendID).(string)
 
-	redisConn := h.redisPool.Get()
-	defer redisConn.Close()
-
-	endpoints, err := redis.Strings(redisConn.Do("SMEMBERS", "backend:"+backendID+":endpoints"))
+	endpoints, err := h.store.Endpoints(backendID)
 	if err != nil {
 		if err == redis.ErrNil {
 			jsonResponse(w, errNotFound, http.StatusNotFound)
@@ -170,24 +190,29 @@ func (h *Handler) endpoints(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	goodEndpoints := []map[string]string{}
+	addrs := make([]string, 0, len(endpoints))
+	for ep := range endpoints {
+		addrs = append(addrs, ep)
+	}
+	sort.Strings(addrs)
 
-	if len(endpoints) > 0 {
-		for _, ep := range endpoints {
-			if strings.HasPrefix(ep, tlsEndpointPrefix) {
-				m, err := redis.StringMap(redisConn.Do("HGETALL", "backend:"+backendID+":endpoint:"+ep))
-				if err == nil {
-					goodEndpoints = append(goodEndpoints, map[string]string{
-						"address":      strings.TrimPrefix(ep, tlsEndpointPrefix),
-						"cluster":      m["cluster"],
-						"region":       m["region"],
-						"connected_at": m["connected_at"],
-						"last_seen_at": m["last_seen_at"],
-					})
-				}
+	goodEndpoints := []map[string]string{}
+	for _, ep := range addrs {
+		if strings.HasPrefix(ep, tlsEndpointPrefix) {
+			m := endpoints[ep]
+			endpoint := map[string]string{
+				"address":      strings.TrimPrefix(ep, tlsEndpointPrefix),
+				"cluster":      m["cluster"],
+				"region":       m["region"],
+				"connected_at": m["connected_at"],
+				"last_seen_at": m["last_seen_at"],
 			}
+			// the round trip time is only measured by TCP and HTTP2 clients
+			if rtt, ok := m["rtt_ms"]; ok {
+				endpoint["rtt_ms"] = rtt
+			}
+			goodEndpoints = append(goodEndpoints, endpoint)
 		}
-
 	}
 	jsonResponse(w, goodEndpoints, http.StatusOK)
 }
@@ -13,12 +13,16 @@ import (
 	"github.com/rafaeljusto/redigomock"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/auth"
+	"github.com/superfly/wormhole/session"
 )
 
 var (
 	mockRedisConn *redigomock.Conn
 	mockRedisPool *redis.Pool
 	handler       *Handler
+
+	testSigningKeys = map[string][]byte{"test_key": []byte("test_secret")}
 )
 
 func TestAPIHandlerAuth(t *testing.T) {
@@ -52,6 +56,7 @@ func TestAPIHandlerAuth(t *testing.T) {
 	assert.Equal(t, "application/json", res.Header.Get("content-type"))
 
 	// wrong token
+	mockRedisConn.Command("HGET", "backend_token_hashes", auth.HashToken("blah")).ExpectError(redis.ErrNil)
 	cmd := mockRedisConn.Command("HGET", "backend_tokens", "blah").ExpectError(redis.ErrNil)
 
 	rr = httptest.NewRecorder()
@@ -68,7 +73,7 @@ func TestAPIHandlerAuth(t *testing.T) {
 	assert.Equal(t, "application/json", res.Header.Get("content-type"))
 
 	// right token
-	cmd = mockRedisConn.Command("HGET", "backend_tokens", "test").Expect("123")
+	cmd = mockRedisConn.Command("HGET", "backend_token_hashes", auth.HashToken("test")).Expect("123")
 
 	rr = httptest.NewRecorder()
 	req = httptest.NewRequest(http.MethodGet, "/api/v1", nil)
@@ -83,7 +88,7 @@ func TestAPIHandlerAuth(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, res.StatusCode)
 
 	// redis error
-	cmd = mockRedisConn.Command("HGET", "backend_tokens", "error").ExpectError(fmt.Errorf("error"))
+	cmd = mockRedisConn.Command("HGET", "backend_token_hashes", auth.HashToken("error")).ExpectError(fmt.Errorf("error"))
 
 	rr = httptest.NewRecorder()
 	req = httptest.NewRequest(http.MethodGet, "/api/v1", nil)
@@ -99,8 +104,41 @@ func TestAPIHandlerAuth(t *testing.T) {
 	assert.Equal(t, "application/json", res.Header.Get("content-type"))
 }
 
+func TestAPIHandlerSignedTokenAuth(t *testing.T) {
+	sign := func(claims *auth.Claims) string {
+		token, err := auth.Sign(claims, "test_key", testSigningKeys["test_key"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"Test_api_scope", sign(&auth.Claims{BackendID: "123", ExpiresAt: expiresAt, API: true}), http.StatusNotFound},
+		{"Test_missing_api_scope", sign(&auth.Claims{BackendID: "123", ExpiresAt: expiresAt}), http.StatusForbidden},
+		{"Test_expired", sign(&auth.Claims{BackendID: "123", ExpiresAt: time.Now().Add(-time.Hour).Unix(), API: true}), http.StatusUnauthorized},
+		{"Test_bad_signature", sign(&auth.Claims{BackendID: "123", ExpiresAt: expiresAt, API: true}) + "x", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1", nil)
+			req.Header.Set("authorization", "Token "+tt.token)
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.status, rr.Result().StatusCode)
+		})
+	}
+}
+
 func TestAPIHandlerEndpoints(t *testing.T) {
-	cmd := mockRedisConn.Command("HGET", "backend_tokens", "testendpoints").Expect("123")
+	cmd := mockRedisConn.Command("HGET", "backend_token_hashes", auth.HashToken("testendpoints")).Expect("123")
 	cmdEndpoints := mockRedisConn.Command("SMEMBERS", "backend:123:endpoints").ExpectStringSlice("tls:helloworld.wormhole.test:1234")
 
 	now := time.Now().String()
@@ -109,6 +147,7 @@ func TestAPIHandlerEndpoints(t *testing.T) {
 		"region":       "test region",
 		"connected_at": now,
 		"last_seen_at": now,
+		"rtt_ms":       "12.500",
 	})
 
 	rr := httptest.NewRecorder()
@@ -136,6 +175,7 @@ func TestAPIHandlerEndpoints(t *testing.T) {
 		"region":       "test region",
 		"connected_at": now,
 		"last_seen_at": now,
+		"rtt_ms":       "12.500",
 	}})
 	assert.JSONEq(t, string(expectedBody), string(body))
 }
@@ -145,5 +185,5 @@ func init() {
 	mockRedisPool = redis.NewPool(func() (redis.Conn, error) {
 		return mockRedisConn, nil
 	}, 10)
-	handler = NewHandler(logrus.New(), mockRedisPool)
+	handler = NewHandler(logrus.New(), session.NewRedisStore(mockRedisPool), auth.NewVerifier(testSigningKeys))
 }
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// signingAlgorithm is the only JWT algorithm accepted, tokens are signed with a shared key
+const signingAlgorithm = "HS256"
+
+var (
+	// ErrMalformedToken is returned when a signed token can't be decoded
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrUnknownKey is returned when a token is signed with a key that isn't (or no longer) configured
+	ErrUnknownKey = errors.New("token signed with unknown key")
+	// ErrInvalidSignature is returned when the signature of a token doesn't match its content
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned when a token is used after its expiry or before it's valid
+	ErrTokenExpired = errors.New("token expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Claims are the contents of a signed token
+type Claims struct {
+	// BackendID is the backend the token authenticates for
+	BackendID string `json:"sub"`
+	// ExpiresAt and NotBefore are unix timestamps, every token has to expire
+	ExpiresAt int64 `json:"exp"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+	// Protocols and Regions restrict where the token is accepted, any if empty
+	Protocols []string `json:"protocols,omitempty"`
+	Regions   []string `json:"regions,omitempty"`
+	// API allows using the token with the wormhole API
+	API bool `json:"api,omitempty"`
+}
+
+// AllowsProtocol returns true if the token can be used to open a session with proto (e.g. "tcp")
+func (c *Claims) AllowsProtocol(proto string) bool {
+	return len(c.Protocols) == 0 || contains(c.Protocols, proto)
+}
+
+// AllowsRegion returns true if the token can be used on servers in region
+func (c *Claims) AllowsRegion(region string) bool {
+	return len(c.Regions) == 0 || contains(c.Regions, region)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSigned returns true if the token is a signed token rather than an opaque one
+// looked up in the backend_tokens hash
+func IsSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Sign returns a token carrying claims, signed with key. keyID identifies key for the
+// servers verifying it, so that keys can be rotated
+func Sign(claims *Claims, keyID string, key []byte) (string, error) {
+	h, err := json.Marshal(&header{Algorithm: signingAlgorithm, Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	return signed + "." + encoding.EncodeToString(sign(signed, key)), nil
+}
+
+func sign(signed string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// Verifier verifies signed tokens offline with a set of keys indexed by key ID
+// Tokens signed with a key are revoked by removing the key
+type Verifier struct {
+	keys map[string][]byte
+	now  func() time.Time
+}
+
+// NewVerifier returns a Verifier accepting tokens signed with keys
+// It returns nil if there are no keys, as no signed token could be verified
+func NewVerifier(keys map[string][]byte) *Verifier {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &Verifier{keys: keys, now: time.Now}
+}
+
+// Verify checks the signature and validity period of token and returns its claims
+// The claims are returned along with ErrTokenExpired, for callers which only require a valid signature
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+	if h.Algorithm != signingAlgorithm {
+		return nil, ErrMalformedToken
+	}
+	key, ok := v.keys[h.KeyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(sig, sign(parts[0]+"."+parts[1], key)) {
+		return nil, ErrInvalidSignature
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.BackendID == "" || claims.ExpiresAt == 0 {
+		return nil, ErrMalformedToken
+	}
+
+	now := v.now().Unix()
+	if now >= claims.ExpiresAt || now < claims.NotBefore {
+		return claims, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := encoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	keys := map[string][]byte{"key_1": []byte("secret_1"), "key_2": []byte("secret_2")}
+	v := NewVerifier(keys)
+	now := time.Unix(1500000000, 0)
+	v.now = func() time.Time { return now }
+
+	claims := &Claims{
+		BackendID: "backend_1",
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		Protocols: []string{"tcp"},
+		Regions:   []string{"ord"},
+	}
+
+	token, err := Sign(claims, "key_2", keys["key_2"])
+	assert.NoError(t, err, "Should be no error signing token")
+	assert.True(t, IsSigned(token))
+	assert.False(t, IsSigned("opaque_token"))
+
+	t.Run("Test_valid_token", func(t *testing.T) {
+		verified, err := v.Verify(token)
+		assert.NoError(t, err, "Should accept token signed with a known key")
+		assert.Equal(t, claims, verified)
+		assert.True(t, verified.AllowsProtocol("tcp"))
+		assert.False(t, verified.AllowsProtocol("ssh"))
+		assert.True(t, verified.AllowsRegion("ord"))
+		assert.False(t, verified.AllowsRegion("iad"))
+		assert.False(t, verified.API)
+	})
+
+	t.Run("Test_tampered_token", func(t *testing.T) {
+		forged, _ := Sign(&Claims{BackendID: "backend_2", ExpiresAt: claims.ExpiresAt}, "key_2", []byte("other"))
+		_, err := v.Verify(forged)
+		assert.Equal(t, ErrInvalidSignature, err)
+
+		_, err = v.Verify(token[:len(token)-2])
+		assert.Error(t, err, "Should reject truncated signature")
+
+		_, err = v.Verify("a.b.c")
+		assert.Equal(t, ErrMalformedToken, err)
+	})
+
+	t.Run("Test_rotated_key", func(t *testing.T) {
+		_, err := NewVerifier(map[string][]byte{"key_1": keys["key_1"]}).Verify(token)
+		assert.Equal(t, ErrUnknownKey, err)
+	})
+
+	t.Run("Test_expired_token", func(t *testing.T) {
+		now = now.Add(2 * time.Hour)
+		defer func() { now = now.Add(-2 * time.Hour) }()
+
+		verified, err := v.Verify(token)
+		assert.Equal(t, ErrTokenExpired, err)
+		assert.Equal(t, "backend_1", verified.BackendID, "Should return claims of expired token")
+	})
+
+	t.Run("Test_token_without_expiry", func(t *testing.T) {
+		forever, _ := Sign(&Claims{BackendID: "backend_1"}, "key_1", keys["key_1"])
+		_, err := v.Verify(forever)
+		assert.Equal(t, ErrMalformedToken, err)
+	})
+}
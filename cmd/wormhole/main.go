@@ -13,6 +13,7 @@ import (
 
 func main() {
 	serverMode := flag.Bool("server", false, "Run the wormhole in server mode.")
+	migrateTokens := flag.Bool("migrate-tokens", false, "Hash the backend tokens stored in plaintext, with --server.")
 	versionFlag := flag.Bool("version", false, "Display wormhole version.")
 	helpFlag := flag.Bool("help", false, "Show help")
 	flag.BoolVar(helpFlag, "h", false, "Show help")
@@ -48,6 +49,7 @@ Environment Variables
     FLY_REMOTE_ENDPOINT: Wormhole server instance. Defaults to Fly.io's servers.
     FLY_RELEASE_ID_VAR: ENV var with current released version of your web server (inferred from git if available)
     FLY_RELEASE_DESC_VAR: ENV name with commit message of the current released version of your web server (inferred from git if available)
+    FLY_RESTART_PROGRAM: Restart the supervised program whenever it exits, even if it failed. (defaults to false)
 
 Modes
 =====
@@ -93,6 +95,8 @@ Other commands
   -v, --version: Prints the version for wormhole.
   -h, --help:    Prints this help information.
       --server:  Starts wormhole in server mode. You probably don't want this.
+      --server --migrate-tokens:
+                 Hashes the backend tokens stored in plaintext and exits. Run it once all servers are upgraded.
 
 `, config.Version())
 		return
@@ -109,6 +113,11 @@ Other commands
 			log.Fatalf("config error: %s", err.Error())
 		}
 
+		if *migrateTokens {
+			wormhole.MigrateTokens(config)
+			return
+		}
+
 		// Expose the registered metrics via HTTP.
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	bugsnag_hook "github.com/Shopify/logrus-bugsnag"
 	bugsnag "github.com/bugsnag/bugsnag-go"
@@ -88,6 +91,15 @@ type Config struct {
 	// LogLevel represents which level we should log eg: info, debug ...
 	LogLevel string
 
+	// GatewayErrorBody is sent instead of the status text with the 502, 503 and 504 responses
+	// to requests which couldn't be proxied to the local endpoint
+	GatewayErrorBody string
+
+	// FlushInterval is how long HTTP2 tunnels may buffer response bodies of known length before
+	// flushing them, -1 flushes every write and 0 only once done. Server-sent events and
+	// responses of unknown length are always flushed as they're read
+	FlushInterval time.Duration
+
 	// Logger instance
 	Logger *logrus.Logger
 }
@@ -96,6 +108,18 @@ type Config struct {
 type ServerConfig struct {
 	Config
 
+	// Protocols lists the transport layers accepted by the server
+	// FLY_PROTO takes a comma separated list e.g. "ssh,tcp,http2"
+	// Config.Protocol is set to the first one
+	Protocols []TunnelProto
+
+	// LegacyTLSProtocol serves TLS connections advertising no ALPN protocol, as sent by
+	// clients predating ALPN routing, instead of handing them to the API server
+	// FLY_LEGACY_TLS_PROTO takes "tcp" or "http2", it defaults to FLY_PROTO when that's
+	// a single one of them and UNSUPPORTED, disabling the fallback, otherwise
+	// API clients then have to advertise http/1.1 or h2 with ALPN to reach the API server
+	LegacyTLSProtocol TunnelProto
+
 	// ClusterURL identifies of wormhole servers
 	// used as metadata for session storage
 	ClusterURL string
@@ -104,6 +128,17 @@ type ServerConfig struct {
 	// Redis powers the session storage
 	RedisURL string
 
+	// Store selects the session storage: "redis" (default), "memory" or "bolt"
+	// memory and bolt only suit a single server, e.g. to try wormhole out or self-host it
+	Store string
+
+	// StorePath is the database file of the bolt store
+	StorePath string
+
+	// BackendTokens registers tokens in the memory and bolt stores, indexed by token
+	// FLY_BACKEND_TOKENS takes a comma separated list of backend_id:token pairs
+	BackendTokens map[string]string
+
 	// NodeID of the wormhole server
 	// used as metadata for session storage
 	NodeID string
@@ -124,6 +159,17 @@ type ServerConfig struct {
 	// the legacy 1-port per session only
 	UseSharedPortForwarding bool
 
+	// TLSClientCACert is the CA signing the client certificates of TCP and HTTP2 clients
+	// A client presenting a certificate is authenticated with it instead of its token
+	TLSClientCACert []byte
+
+	// RequireTLSClientCert rejects TCP and HTTP2 clients without a certificate signed by TLSClientCACert
+	RequireTLSClientCert bool
+
+	// TokenSigningKeys are the keys signed tokens are verified with, indexed by key ID
+	// Tokens signed with a key are revoked by removing it
+	TokenSigningKeys map[string][]byte
+
 	// SharedTLSForwardingPort is the port we should bind the shared tls forwarding to
 	SharedTLSForwardingPort string
 
@@ -142,6 +188,20 @@ type ServerConfig struct {
 
 	// Region represents the location of the wormhole server
 	Region string
+
+	// MaxIngressConns is the number of ingress connections a TCP session proxies at once
+	// Further connections wait to be accepted
+	MaxIngressConns int
+
+	// TunnelMinIdle is the number of idle tunnels TCP and HTTP2 sessions keep open
+	TunnelMinIdle int
+
+	// TunnelMaxTotal is the number of tunnels TCP and HTTP2 sessions may open
+	TunnelMaxTotal int
+
+	// TunnelIdleTimeout is how long tunnels beyond TunnelMinIdle are kept unused
+	// Backends may set their own tunnel_min_idle and tunnel_max_total in the store
+	TunnelIdleTimeout time.Duration
 }
 
 // NewServerConfig parses config values collected from Viper and validates them
@@ -154,6 +214,12 @@ func NewServerConfig() (*ServerConfig, error) {
 	viper.SetDefault("metrics_api_port", "9191")
 	viper.SetDefault("use_shared_port_forwarding", false)
 	viper.SetDefault("shared_tls_forwarding_port", "443")
+	viper.SetDefault("store", RedisStore)
+	viper.SetDefault("store_path", "wormhole.db")
+	viper.SetDefault("max_ingress_conns", 100)
+	viper.SetDefault("tunnel_min_idle", 1)
+	viper.SetDefault("tunnel_max_total", 100)
+	viper.SetDefault("tunnel_idle_timeout", time.Minute)
 	viper.BindEnv("bugsnag_api_key", "BUGSNAG_API_KEY")
 
 	viper.BindEnv("region")
@@ -178,38 +244,100 @@ func NewServerConfig() (*ServerConfig, error) {
 		logger.Hooks.Add(hook)
 	}
 
-	protocol := ParseTunnelProto(viper.GetString("proto"))
+	protocols := ParseTunnelProtos(viper.GetString("proto"))
 
 	shared := Config{
-		Protocol:  protocol,
+		Protocol:  protocols[0],
 		Port:      viper.GetString("port"),
 		Version:   version,
 		Localhost: viper.GetString("localhost"),
 		LogLevel:  viper.GetString("log_level"),
 		Logger:    logger,
 		Insecure:  viper.GetBool("insecure"),
+
+		GatewayErrorBody: viper.GetString("gateway_error_body"),
+		FlushInterval:    viper.GetDuration("flush_interval"),
 	}
 
 	cfg := &ServerConfig{
 		ClusterURL:              viper.GetString("cluster_url"),
 		RedisURL:                viper.GetString("redis_url"),
+		Store:                   viper.GetString("store"),
+		StorePath:               viper.GetString("store_path"),
 		NodeID:                  viper.GetString("node_id"),
 		MetricsAPIPort:          viper.GetString("metrics_api_port"),
 		UseSharedPortForwarding: viper.GetBool("use_shared_port_forwarding"),
 		SharedTLSForwardingPort: viper.GetString("shared_tls_forwarding_port"),
 		Region:                  viper.GetString("region"),
+		RequireTLSClientCert:    viper.GetBool("require_tls_client_cert"),
+		MaxIngressConns:         viper.GetInt("max_ingress_conns"),
+		TunnelMinIdle:           viper.GetInt("tunnel_min_idle"),
+		TunnelMaxTotal:          viper.GetInt("tunnel_max_total"),
+		TunnelIdleTimeout:       viper.GetDuration("tunnel_idle_timeout"),
+		Protocols:               protocols,
+		LegacyTLSProtocol:       UNSUPPORTED,
 		Config:                  shared,
 	}
 
-	switch protocol {
-	case SSH:
-		sshKey, err := ioutil.ReadFile(viper.GetString("ssh_private_key_file"))
+	if legacy := viper.GetString("legacy_tls_proto"); len(legacy) > 0 {
+		cfg.LegacyTLSProtocol = ParseTunnelProto(legacy)
+		if cfg.LegacyTLSProtocol == UNSUPPORTED {
+			return nil, cfgErr(invalidStr, "FLY_LEGACY_TLS_PROTO")
+		}
+	} else if len(protocols) == 1 && (protocols[0] == TCP || protocols[0] == HTTP2) {
+		cfg.LegacyTLSProtocol = protocols[0]
+	}
+
+	if keys := viper.GetString("token_signing_keys"); len(keys) > 0 {
+		signingKeys, err := parseTokenSigningKeys(keys)
 		if err != nil {
-			return nil, cfgErr(unsetEnvStr, "FLY_SSH_PRIVATE_KEY_FILE")
+			return nil, cfgErr(invalidStr, "FLY_TOKEN_SIGNING_KEYS")
 		}
-		cfg.SSHPrivateKey = sshKey
-	case TCP:
-		if !cfg.Insecure {
+		cfg.TokenSigningKeys = signingKeys
+	}
+
+	if tokens := viper.GetString("backend_tokens"); len(tokens) > 0 {
+		pairs, err := parsePairs(tokens)
+		if err != nil {
+			return nil, cfgErr(invalidStr, "FLY_BACKEND_TOKENS")
+		}
+		cfg.BackendTokens = make(map[string]string)
+		for _, pair := range pairs {
+			cfg.BackendTokens[pair[1]] = pair[0]
+		}
+	}
+
+	if caFile := viper.GetString("tls_client_ca_file"); len(caFile) > 0 {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, cfgErr(invalidStr, "FLY_TLS_CLIENT_CA_FILE")
+		}
+		cfg.TLSClientCACert = caCert
+	}
+
+	for _, protocol := range protocols {
+		switch protocol {
+		case SSH:
+			sshKey, err := ioutil.ReadFile(viper.GetString("ssh_private_key_file"))
+			if err != nil {
+				return nil, cfgErr(unsetEnvStr, "FLY_SSH_PRIVATE_KEY_FILE")
+			}
+			cfg.SSHPrivateKey = sshKey
+		case TCP, TCPMux:
+			if !cfg.Insecure {
+				tlsKey, err := ioutil.ReadFile(viper.GetString("tls_private_key_file"))
+				if err != nil {
+					return nil, cfgErr(unsetEnvStr, "FLY_TLS_PRIVATE_KEY_FILE")
+				}
+				cfg.TLSPrivateKey = tlsKey
+
+				tlsCert, err := ioutil.ReadFile(viper.GetString("tls_cert_file"))
+				if err != nil {
+					return nil, cfgErr(unsetEnvStr, "FLY_TLS_CERT_FILE")
+				}
+				cfg.TLSCert = tlsCert
+			}
+		case HTTP2:
 			tlsKey, err := ioutil.ReadFile(viper.GetString("tls_private_key_file"))
 			if err != nil {
 				return nil, cfgErr(unsetEnvStr, "FLY_TLS_PRIVATE_KEY_FILE")
@@ -222,18 +350,6 @@ func NewServerConfig() (*ServerConfig, error) {
 			}
 			cfg.TLSCert = tlsCert
 		}
-	case HTTP2:
-		tlsKey, err := ioutil.ReadFile(viper.GetString("tls_private_key_file"))
-		if err != nil {
-			return nil, cfgErr(unsetEnvStr, "FLY_TLS_PRIVATE_KEY_FILE")
-		}
-		cfg.TLSPrivateKey = tlsKey
-
-		tlsCert, err := ioutil.ReadFile(viper.GetString("tls_cert_file"))
-		if err != nil {
-			return nil, cfgErr(unsetEnvStr, "FLY_TLS_CERT_FILE")
-		}
-		cfg.TLSCert = tlsCert
 	}
 
 	if cfg.UseSharedPortForwarding {
@@ -257,31 +373,84 @@ func NewServerConfig() (*ServerConfig, error) {
 	return cfg, nil
 }
 
+// hasProtocol tells whether the server accepts tunnels of the given type
+// TCP is accepted by servers running tcp or tcpmux, which share a handler
+func (cfg *ServerConfig) hasProtocol(proto TunnelProto) bool {
+	for _, p := range cfg.Protocols {
+		if p == proto || (proto == TCP && p == TCPMux) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cfg *ServerConfig) validate() error {
-	switch cfg.Protocol {
-	case UNSUPPORTED:
-		return cfgErr(unsetEnvStr, "FLY_PROTO")
-	case TCP:
-		if !cfg.Insecure {
+	for _, protocol := range cfg.Protocols {
+		switch protocol {
+		case UNSUPPORTED:
+			return cfgErr(unsetEnvStr, "FLY_PROTO")
+		case TCP, TCPMux:
+			if !cfg.Insecure {
+				if len(cfg.TLSCert) == 0 {
+					return cfgErr(invalidStr, "FLY_TLS_CERT_FILE")
+				} else if len(cfg.TLSPrivateKey) == 0 {
+					return cfgErr(invalidStr, "FLY_TLS_PRIVATE_KEY_FILE")
+				}
+			}
+		case SSH:
+			if len(cfg.SSHPrivateKey) == 0 {
+				return cfgErr(invalidStr, "FLY_SSH_PRIVATE_KEY_FILE")
+			}
+		case HTTP2:
+			if cfg.Insecure {
+				return cfgErr(invalidStr, "insecure")
+			}
 			if len(cfg.TLSCert) == 0 {
 				return cfgErr(invalidStr, "FLY_TLS_CERT_FILE")
 			} else if len(cfg.TLSPrivateKey) == 0 {
 				return cfgErr(invalidStr, "FLY_TLS_PRIVATE_KEY_FILE")
 			}
 		}
-	case SSH:
-		if len(cfg.SSHPrivateKey) == 0 {
-			return cfgErr(invalidStr, "FLY_SSH_PRIVATE_KEY_FILE")
+	}
+
+	switch cfg.LegacyTLSProtocol {
+	case UNSUPPORTED:
+	case TCP, HTTP2:
+		if !cfg.hasProtocol(cfg.LegacyTLSProtocol) {
+			return cfgErr(invalidStr, "FLY_LEGACY_TLS_PROTO")
 		}
-	case HTTP2:
-		if cfg.Insecure {
-			return cfgErr(invalidStr, "insecure")
+	default:
+		return cfgErr(invalidStr, "FLY_LEGACY_TLS_PROTO")
+	}
+
+	if cfg.RequireTLSClientCert && len(cfg.TLSClientCACert) == 0 {
+		return cfgErr(unsetEnvStr, "FLY_TLS_CLIENT_CA_FILE")
+	}
+
+	if cfg.MaxIngressConns <= 0 {
+		return cfgErr(invalidStr, "FLY_MAX_INGRESS_CONNS")
+	}
+
+	if cfg.TunnelMinIdle <= 0 {
+		return cfgErr(invalidStr, "FLY_TUNNEL_MIN_IDLE")
+	} else if cfg.TunnelMaxTotal < cfg.TunnelMinIdle {
+		return cfgErr(invalidStr, "FLY_TUNNEL_MAX_TOTAL")
+	} else if cfg.TunnelIdleTimeout <= 0 {
+		return cfgErr(invalidStr, "FLY_TUNNEL_IDLE_TIMEOUT")
+	}
+
+	switch cfg.Store {
+	case RedisStore:
+		if len(cfg.RedisURL) == 0 {
+			return cfgErr(unsetEnvStr, "FLY_REDIS_URL")
 		}
-		if len(cfg.TLSCert) == 0 {
-			return cfgErr(invalidStr, "FLY_TLS_CERT_FILE")
-		} else if len(cfg.TLSPrivateKey) == 0 {
-			return cfgErr(invalidStr, "FLY_TLS_PRIVATE_KEY_FILE")
+	case MemoryStore:
+	case BoltStore:
+		if len(cfg.StorePath) == 0 {
+			return cfgErr(unsetEnvStr, "FLY_STORE_PATH")
 		}
+	default:
+		return cfgErr(invalidStr, "FLY_STORE")
 	}
 
 	if len(cfg.Port) == 0 {
@@ -292,8 +461,6 @@ func (cfg *ServerConfig) validate() error {
 		return cfgErr(unsetEnvStr, "FLY_LOG_LEVEL")
 	} else if len(cfg.ClusterURL) == 0 {
 		return cfgErr(unsetEnvStr, "FLY_CLUSTER_URL")
-	} else if len(cfg.RedisURL) == 0 {
-		return cfgErr(unsetEnvStr, "FLY_REDIS_URL")
 	} else if len(cfg.NodeID) == 0 {
 		return cfgErr(unsetEnvStr, "FLY_NODE_ID")
 	} else if len(cfg.MetricsAPIPort) == 0 {
@@ -321,12 +488,50 @@ type ClientConfig struct {
 	// Note: this is for wh-client <-> local-endpoint only
 	LocalEndpointCACert []byte
 
+	// LocalEndpointHTTP2 makes the HTTP2 client speak HTTP/2 to the local endpoint, over TLS
+	// or unencrypted (h2c) depending on LocalEndpointUseTLS, e.g. for gRPC servers
+	// Note: this is for wh-client <-> local-endpoint only
+	LocalEndpointHTTP2 bool
+
+	// HTTP2ControlStream makes the HTTP2 client exchange control messages over a stream of its
+	// first tunnel instead of a separate connection, which the server keeps alive with HTTP/2 PINGs
+	HTTP2ControlStream bool
+
+	// RestartProgram restarts the program run by wormhole whenever it exits, even if it failed,
+	// sending its release again. Otherwise wormhole exits along with a failed program
+	// and keeps running without one which exited successfully
+	RestartProgram bool
+
 	// RemoteEndpoint <HOST>:<PORT> of the wormhole server
 	RemoteEndpoint string
 
 	// Token for auth when connecting to wormhole server
 	Token string
 
+	// SSHHostKeyFingerprint pins the fingerprint of the wormhole server SSH host key
+	// (e.g. "SHA256:..." as published by /api/v1/servers). It takes precedence over SSHKnownHostsFile
+	SSHHostKeyFingerprint string
+
+	// SSHKnownHostsFile is the known_hosts file used to verify the wormhole server SSH host key
+	// defaults to ~/.wormhole/known_hosts
+	SSHKnownHostsFile string
+
+	// SSHStrictHostKeyChecking rejects servers missing from SSHKnownHostsFile
+	// instead of trusting and recording their host key on first use
+	SSHStrictHostKeyChecking bool
+
+	// SSHKey is the private key the client authenticates with when SSH tunneling is used
+	// The key, or its certificate's CA, has to be registered for the backend. Token isn't required then
+	SSHKey []byte
+
+	// SSHCert is an optional certificate for SSHKey, signed by the backend SSH CA
+	SSHCert []byte
+
+	// TLSClientCert and TLSClientKey are presented to the server by TCP and HTTP2 clients
+	// The certificate has to be registered for the backend. Token isn't required then
+	TLSClientCert []byte
+	TLSClientKey  []byte
+
 	// ReleaseID...
 	// when set this will override the default VCS ID (i.e. git commit SHA1)
 	// defaults to FLY_RELASE_ID (but can be overridden with FLY_RELEASE_ID_VAR to point ot a different ENV)
@@ -353,6 +558,7 @@ func NewClientConfig() (*ClientConfig, error) {
 	viper.SetDefault("release_id_var", "FLY_RELEASE_ID")
 	viper.SetDefault("release_desc_var", "FLY_RELEASE_DESC")
 	viper.SetDefault("release_branch_var", "FLY_RELEASE_BRANCH")
+	viper.SetDefault("ssh_known_hosts_file", filepath.Join(os.Getenv("HOME"), ".wormhole", "known_hosts"))
 
 	logger := logrus.New()
 	logger.Formatter = new(prefixed.TextFormatter)
@@ -368,10 +574,29 @@ func NewClientConfig() (*ClientConfig, error) {
 		LogLevel:  viper.GetString("log_level"),
 		Logger:    logger,
 		Insecure:  viper.GetBool("insecure"),
+
+		GatewayErrorBody: viper.GetString("gateway_error_body"),
+		FlushInterval:    viper.GetDuration("flush_interval"),
 	}
 
+	var sshKey, sshCert, tlsClientCert, tlsClientKey []byte
 	switch protocol {
-	case TCP:
+	case SSH:
+		if keyFile := viper.GetString("ssh_key_file"); len(keyFile) > 0 {
+			key, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				return nil, cfgErr(invalidStr, "FLY_SSH_KEY_FILE")
+			}
+			sshKey = key
+		}
+		if certFile := viper.GetString("ssh_cert_file"); len(certFile) > 0 {
+			cert, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				return nil, cfgErr(invalidStr, "FLY_SSH_CERT_FILE")
+			}
+			sshCert = cert
+		}
+	case TCP, TCPMux:
 		if !shared.Insecure {
 			tlsCert, err := ioutil.ReadFile(viper.GetString("tls_cert_file"))
 			if err != nil {
@@ -385,14 +610,51 @@ func NewClientConfig() (*ClientConfig, error) {
 			return nil, cfgErr(unsetEnvStr, "FLY_TLS_CERT_FILE")
 		}
 		shared.TLSCert = tlsCert
+	case WS:
+		// the server cert is verified with system root CAs unless a cert is provided
+		if certFile := viper.GetString("tls_cert_file"); len(certFile) > 0 {
+			tlsCert, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				return nil, cfgErr(invalidStr, "FLY_TLS_CERT_FILE")
+			}
+			shared.TLSCert = tlsCert
+		}
+	}
+
+	switch protocol {
+	case TCP, TCPMux, HTTP2:
+		if certFile := viper.GetString("tls_client_cert_file"); len(certFile) > 0 {
+			cert, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				return nil, cfgErr(invalidStr, "FLY_TLS_CLIENT_CERT_FILE")
+			}
+			tlsClientCert = cert
+		}
+		if keyFile := viper.GetString("tls_client_key_file"); len(keyFile) > 0 {
+			key, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				return nil, cfgErr(invalidStr, "FLY_TLS_CLIENT_KEY_FILE")
+			}
+			tlsClientKey = key
+		}
 	}
 
 	cfg := &ClientConfig{
 		LocalEndpoint:                   viper.GetString("local_endpoint"),
 		LocalEndpointUseTLS:             viper.GetBool("local_endpoint_use_tls"),
 		LocalEndpointInsecureSkipVerify: viper.GetBool("local_endpoint_insecure_skip_verify"),
+		LocalEndpointHTTP2:              viper.GetBool("local_endpoint_http2"),
+		HTTP2ControlStream:              viper.GetBool("http2_control_stream"),
+		RestartProgram:                  viper.GetBool("restart_program"),
 		RemoteEndpoint:                  viper.GetString("remote_endpoint"),
 		Token:                           viper.GetString("token"),
+		SSHHostKeyFingerprint:           viper.GetString("ssh_host_key_fingerprint"),
+		SSHKnownHostsFile:               viper.GetString("ssh_known_hosts_file"),
+		SSHStrictHostKeyChecking:        viper.GetBool("ssh_strict_host_key_checking"),
+		SSHKey:                          sshKey,
+		SSHCert:                         sshCert,
+		TLSClientCert:                   tlsClientCert,
+		TLSClientKey:                    tlsClientKey,
 		ReleaseID:                       os.Getenv(viper.GetString("release_id_var")),
 		ReleaseBranch:                   os.Getenv(viper.GetString("release_branch_var")),
 		ReleaseDesc:                     os.Getenv(viper.GetString("release_desc_var")),
@@ -420,7 +682,14 @@ func (cfg *ClientConfig) validate() error {
 	switch cfg.Protocol {
 	case UNSUPPORTED:
 		return cfgErr(unsetEnvStr, "FLY_PROTO")
-	case TCP:
+	case SSH:
+		if len(cfg.SSHHostKeyFingerprint) == 0 && len(cfg.SSHKnownHostsFile) == 0 {
+			return cfgErr(unsetEnvStr, "FLY_SSH_HOST_KEY_FINGERPRINT or FLY_SSH_KNOWN_HOSTS_FILE")
+		}
+		if len(cfg.SSHCert) > 0 && len(cfg.SSHKey) == 0 {
+			return cfgErr(unsetEnvStr, "FLY_SSH_KEY_FILE")
+		}
+	case TCP, TCPMux:
 		if !cfg.Insecure {
 			if len(cfg.TLSCert) == 0 {
 				return cfgErr(invalidStr, "FLY_TLS_CERT_KEY_FILE")
@@ -436,6 +705,12 @@ func (cfg *ClientConfig) validate() error {
 
 	}
 
+	if len(cfg.TLSClientCert) > 0 && len(cfg.TLSClientKey) == 0 {
+		return cfgErr(unsetEnvStr, "FLY_TLS_CLIENT_KEY_FILE")
+	} else if len(cfg.TLSClientKey) > 0 && len(cfg.TLSClientCert) == 0 {
+		return cfgErr(unsetEnvStr, "FLY_TLS_CLIENT_CERT_FILE")
+	}
+
 	if cfg.LocalEndpointUseTLS {
 		if !cfg.LocalEndpointInsecureSkipVerify && len(cfg.LocalEndpointCACert) == 0 {
 			return cfgErr(invalidStr, "FLY_LOCAL_ENDPOINT_CA_CERT")
@@ -452,7 +727,8 @@ func (cfg *ClientConfig) validate() error {
 		return cfgErr(unsetEnvStr, "FLY_LOCAL_ENDPOINT")
 	} else if len(cfg.RemoteEndpoint) == 0 {
 		return cfgErr(unsetEnvStr, "FLY_REMOTE_ENDPOINT")
-	} else if len(cfg.Token) == 0 {
+	} else if len(cfg.Token) == 0 && len(cfg.SSHKey) == 0 && len(cfg.TLSClientCert) == 0 {
+		// SSHKey and TLSClientCert are only set for the protocols using them
 		return cfgErr(unsetEnvStr, "FLY_TOKEN")
 	}
 	return nil
@@ -470,6 +746,40 @@ func cfgErr(template string, vars ...interface{}) error {
 	return fmt.Errorf(template, vars)
 }
 
+// parseTokenSigningKeys parses a comma separated list of key_id:key pairs
+func parseTokenSigningKeys(keys string) (map[string][]byte, error) {
+	pairs, err := parsePairs(keys)
+	if err != nil {
+		return nil, err
+	}
+	parsed := make(map[string][]byte)
+	for _, pair := range pairs {
+		parsed[pair[0]] = []byte(pair[1])
+	}
+	return parsed, nil
+}
+
+// parsePairs parses a comma separated list of name:value pairs
+// Values may contain colons, but not commas
+func parsePairs(pairs string) ([][]string, error) {
+	var parsed [][]string
+	for _, pair := range strings.Split(pairs, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid pair %q", pair)
+		}
+		parsed = append(parsed, kv)
+	}
+	return parsed, nil
+}
+
+// Session stores selectable with FLY_STORE
+const (
+	RedisStore  = "redis"
+	MemoryStore = "memory"
+	BoltStore   = "bolt"
+)
+
 // TunnelProto specifies the type of transport protocol used by wormhole instance
 type TunnelProto int
 
@@ -480,13 +790,25 @@ const (
 	TCP
 	// HTTP2 connection pool
 	HTTP2
-	_
+	// TCPMux multiplexes tunnels as streams over a single TCP connection
+	TCPMux
+	// WS multiplexes tunnels over a websocket (HTTP/1.1 Upgrade)
+	WS
 	_
 	_
 	// UNSUPPORTED is a catch all for unsupported protocol types
 	UNSUPPORTED
 )
 
+// ParseTunnelProtos converts a comma separated list of protocol names to TunnelProtos
+func ParseTunnelProtos(protos string) []TunnelProto {
+	var parsed []TunnelProto
+	for _, p := range strings.Split(protos, ",") {
+		parsed = append(parsed, ParseTunnelProto(strings.TrimSpace(p)))
+	}
+	return parsed
+}
+
 // ParseTunnelProto converts protocol string name to TunnelProto
 func ParseTunnelProto(proto string) TunnelProto {
 	switch proto {
@@ -496,6 +818,10 @@ func ParseTunnelProto(proto string) TunnelProto {
 		return TCP
 	case "http2":
 		return HTTP2
+	case "tcpmux":
+		return TCPMux
+	case "ws":
+		return WS
 	default:
 		return UNSUPPORTED
 	}
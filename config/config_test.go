@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	. "github.com/superfly/wormhole/testing"
 )
@@ -12,6 +13,45 @@ func TestParseTunnelProto(t *testing.T) {
 	Equals(t, ParseTunnelProto("bla"), UNSUPPORTED)
 	Equals(t, ParseTunnelProto("ssh"), SSH)
 	Equals(t, ParseTunnelProto("tcp"), TCP)
+	Equals(t, ParseTunnelProto("tcpmux"), TCPMux)
+	Equals(t, ParseTunnelProto("ws"), WS)
+}
+
+func TestParseTunnelProtos(t *testing.T) {
+	Equals(t, ParseTunnelProtos("ssh"), []TunnelProto{SSH})
+	Equals(t, ParseTunnelProtos("ssh, tcp,http2"), []TunnelProto{SSH, TCP, HTTP2})
+	Equals(t, ParseTunnelProtos("ssh,bla"), []TunnelProto{SSH, UNSUPPORTED})
+}
+
+func TestParseTokenSigningKeys(t *testing.T) {
+	keys, err := parseTokenSigningKeys("key_1:secret, key_2:with:colon")
+	Ok(t, err)
+	Equals(t, keys, map[string][]byte{"key_1": []byte("secret"), "key_2": []byte("with:colon")})
+
+	_, err = parseTokenSigningKeys("key_1")
+	Assert(t, err != nil, "key without secret should be rejected")
+}
+
+func TestMemoryStoreServerConfig(t *testing.T) {
+	os.Setenv("FLY_LOCALHOST", "localhost")
+	os.Setenv("FLY_CLUSTER_URL", "127.0.0.1")
+	os.Setenv("FLY_SSH_PRIVATE_KEY_FILE", "testdata/id_rsa")
+	os.Setenv("FLY_STORE", "memory")
+	os.Setenv("FLY_BACKEND_TOKENS", "backend_1:token_1,backend_1:token_2")
+	defer func() {
+		os.Unsetenv("FLY_LOCALHOST")
+		os.Unsetenv("FLY_CLUSTER_URL")
+		os.Unsetenv("FLY_SSH_PRIVATE_KEY_FILE")
+		os.Unsetenv("FLY_STORE")
+		os.Unsetenv("FLY_BACKEND_TOKENS")
+	}()
+
+	cfg, err := NewServerConfig()
+
+	Ok(t, err)
+	Equals(t, cfg.Store, MemoryStore)
+	Equals(t, cfg.RedisURL, "")
+	Equals(t, cfg.BackendTokens, map[string]string{"token_1": "backend_1", "token_2": "backend_1"})
 }
 
 func TestDefaultServerConfig(t *testing.T) {
@@ -30,10 +70,17 @@ func TestDefaultServerConfig(t *testing.T) {
 
 	Ok(t, err)
 	Equals(t, cfg.Protocol, SSH)
+	Equals(t, cfg.Protocols, []TunnelProto{SSH})
+	Equals(t, cfg.LegacyTLSProtocol, UNSUPPORTED)
 	Equals(t, cfg.Port, "10000")
 	Equals(t, cfg.Localhost, "localhost")
 	Equals(t, cfg.ClusterURL, "127.0.0.1")
 	Equals(t, cfg.RedisURL, "redis://localhost:6379")
+	Equals(t, cfg.Store, RedisStore)
+	Equals(t, cfg.MaxIngressConns, 100)
+	Equals(t, cfg.TunnelMinIdle, 1)
+	Equals(t, cfg.TunnelMaxTotal, 100)
+	Equals(t, cfg.TunnelIdleTimeout, time.Minute)
 	Equals(t, cfg.LogLevel, "info")
 
 	bytes, err := ioutil.ReadFile("testdata/id_rsa")
@@ -46,6 +93,44 @@ func TestDefaultServerConfig(t *testing.T) {
 	Equals(t, cfg.NodeID, nodeID)
 }
 
+func TestLegacyTLSProtoServerConfig(t *testing.T) {
+	os.Setenv("FLY_LOCALHOST", "localhost")
+	os.Setenv("FLY_CLUSTER_URL", "127.0.0.1")
+	os.Setenv("FLY_STORE", "memory")
+	os.Setenv("FLY_INSECURE", "true")
+	defer func() {
+		os.Unsetenv("FLY_LOCALHOST")
+		os.Unsetenv("FLY_CLUSTER_URL")
+		os.Unsetenv("FLY_STORE")
+		os.Unsetenv("FLY_INSECURE")
+		os.Unsetenv("FLY_PROTO")
+		os.Unsetenv("FLY_LEGACY_TLS_PROTO")
+	}()
+
+	os.Setenv("FLY_PROTO", "tcp")
+	cfg, err := NewServerConfig()
+	Ok(t, err)
+	Equals(t, cfg.LegacyTLSProtocol, TCP)
+
+	os.Setenv("FLY_PROTO", "tcpmux,ws")
+	cfg, err = NewServerConfig()
+	Ok(t, err)
+	Equals(t, cfg.LegacyTLSProtocol, UNSUPPORTED)
+
+	os.Setenv("FLY_LEGACY_TLS_PROTO", "tcp")
+	cfg, err = NewServerConfig()
+	Ok(t, err)
+	Equals(t, cfg.LegacyTLSProtocol, TCP)
+
+	os.Setenv("FLY_LEGACY_TLS_PROTO", "http2")
+	_, err = NewServerConfig()
+	Assert(t, err != nil, "legacy protocol not accepted by the server should be rejected")
+
+	os.Setenv("FLY_LEGACY_TLS_PROTO", "ws")
+	_, err = NewServerConfig()
+	Assert(t, err != nil, "legacy protocol other than tcp or http2 should be rejected")
+}
+
 func TestDefaultClientConfig(t *testing.T) {
 	os.Setenv("FLY_TOKEN", "bla")
 	defer func() {
@@ -11,6 +11,7 @@ import (
 
 	"github.com/superfly/wormhole/config"
 	"github.com/superfly/wormhole/local"
+	"github.com/superfly/wormhole/messages"
 )
 
 const (
@@ -37,7 +38,7 @@ func StartLocal(cfg *config.ClientConfig) {
 		if err != nil {
 			log.Fatal(err)
 		}
-	case config.TCP:
+	case config.TCP, config.TCPMux:
 		handler, err = local.NewTCPHandler(cfg, release)
 		if err != nil {
 			log.Fatal(err)
@@ -47,6 +48,11 @@ func StartLocal(cfg *config.ClientConfig) {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case config.WS:
+		handler, err = local.NewWebSocketHandler(cfg, release)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 	default:
 		log.Fatal("Unknown wormhole transport layer protocol selected.")
@@ -56,6 +62,10 @@ func StartLocal(cfg *config.ClientConfig) {
 	if len(args) > 0 {
 		cmd := strings.Join(args, " ")
 		process := NewProcess(cfg.Logger, cmd, handler)
+		process.Restart = cfg.RestartProgram
+		if updater, ok := handler.(local.ReleaseUpdater); ok {
+			process.OnRestart = func() { updateRelease(cfg, updater, log) }
+		}
 		err := process.Run()
 		if err != nil {
 			log.Fatalf("Error running program: %s", err.Error())
@@ -85,6 +95,10 @@ func StartLocal(cfg *config.ClientConfig) {
 	log.Infoln("Attempting to connect to wormhole server on:", cfg.RemoteEndpoint)
 	for {
 		err := handler.ListenAndServe()
+		if authErr, ok := err.(*messages.AuthError); ok && !authErr.Temporary() {
+			// retrying won't help, e.g. the token is wrong
+			log.Fatalf("Wormhole server rejected the client: %s", err.Error())
+		}
 		if err != nil {
 			d := b.Duration()
 			log.Errorf("Failed to connect to wormhole server: %s. Will try again in %s", err.Error(), d.String())
@@ -95,3 +109,16 @@ func StartLocal(cfg *config.ClientConfig) {
 		b.Reset()
 	}
 }
+
+// updateRelease sends the release of the restarted program, its checkout may have changed
+func updateRelease(cfg *config.ClientConfig, updater local.ReleaseUpdater, log *logrus.Entry) {
+	release, err := computeRelease(cfg.ReleaseID, cfg.ReleaseDesc, cfg.ReleaseBranch)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	log.Debugln("Computed release:", release)
+	if err := updater.UpdateRelease(release); err != nil {
+		log.Warnf("Couldn't send release: %s", err.Error())
+	}
+}
@@ -1,7 +1,47 @@
 package local
 
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+)
+
 // ConnectionHandler specifies interface for handler connecting to wormhole server
 type ConnectionHandler interface {
 	ListenAndServe() error
 	Close() error
 }
+
+// ReleaseUpdater is implemented by handlers which can send a new release of the local
+// program to the server while connected
+type ReleaseUpdater interface {
+	UpdateRelease(release *messages.Release) error
+}
+
+// readAuthResult reads the response of the server to an AuthControl or AuthTunnel message
+// It returns the error reported by the server if the client was rejected
+func readAuthResult(r *messages.Reader) (*messages.AuthResult, error) {
+	msg, err := r.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	result, ok := msg.(*messages.AuthResult)
+	if !ok {
+		return nil, fmt.Errorf("expected an auth result, got %T", msg)
+	}
+	return result, result.Err()
+}
+
+// clientCertificates returns the certificate authenticating the client to the server, if configured
+func clientCertificates(cfg *config.ClientConfig) ([]tls.Certificate, error) {
+	if len(cfg.TLSClientCert) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load TLS client certificate: %s", err.Error())
+	}
+	return []tls.Certificate{cert}, nil
+}
@@ -1,13 +1,18 @@
 package local
 
 import (
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +23,12 @@ import (
 	"golang.org/x/net/http2"
 )
 
+// localDialTimeout bounds connecting to the local endpoint, like http.DefaultTransport does
+const localDialTimeout = 30 * time.Second
+
+// controlStreamTimeout is how long the server has to open the control stream after the auth message
+const controlStreamTimeout = 10 * time.Second
+
 // HTTP2Handler type represents the handler that opens a TCP conn to wormhole server and serves
 // incoming requests
 type HTTP2Handler struct {
@@ -27,15 +38,23 @@ type HTTP2Handler struct {
 	Release                *messages.Release
 	Version                string
 	ln                     net.Listener
-	control                net.Conn
+	control                io.ReadWriteCloser
+	writer                 *messages.Writer
 	conns                  []net.Conn
 	server                 *http2.Server
 	fClient                *http.Client
 	remoteTLSConfig        *tls.Config
 	localEndpointTLSConfig *tls.Config
 	lastPongAt             int64
+	resumeToken            string
+	tunnelAuth             bool
+	releaseMu              sync.Mutex
+	releaseWriter          *messages.Writer
 	logger                 *logrus.Entry
 	localEndpointTLS       bool
+	gatewayErrorBody       string
+	flushInterval          time.Duration
+	controlStream          bool
 }
 
 // NewHTTP2Handler returns a HTTP2Handler struct with TLS encryption
@@ -51,6 +70,11 @@ func NewHTTP2Handler(cfg *config.ClientConfig, release *messages.Release) (*HTTP
 		return nil, err
 	}
 
+	certs, err := clientCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	t := http.DefaultTransport.(*http.Transport)
 
 	if cfg.LocalEndpointUseTLS {
@@ -72,6 +96,17 @@ func NewHTTP2Handler(cfg *config.ClientConfig, release *messages.Release) (*HTTP
 	}
 
 	client := &http.Client{Transport: t}
+	if cfg.LocalEndpointHTTP2 {
+		client.Transport = localHTTP2Transport(t.TLSClientConfig, cfg.LocalEndpointUseTLS)
+	}
+
+	server := &http2.Server{}
+	if cfg.HTTP2ControlStream {
+		// the server pings the tunnel carrying the control stream, tunnels going quiet are
+		// pinged back and closed if the server doesn't answer
+		server.ReadIdleTimeout = maxPongLatency
+		server.PingTimeout = maxPongLatency
+	}
 
 	h := &HTTP2Handler{
 		FlyToken:         cfg.Token,
@@ -79,16 +114,34 @@ func NewHTTP2Handler(cfg *config.ClientConfig, release *messages.Release) (*HTTP
 		LocalEndpoint:    cfg.LocalEndpoint,
 		Release:          release,
 		Version:          cfg.Version,
-		remoteTLSConfig:  &tls.Config{RootCAs: rootCAs, ServerName: tlsHost},
-		server:           &http2.Server{},
+		remoteTLSConfig:  &tls.Config{RootCAs: rootCAs, ServerName: tlsHost, Certificates: certs},
+		server:           server,
 		fClient:          client,
 		logger:           cfg.Logger.WithFields(logrus.Fields{"prefix": "HTTP2Handler"}),
 		localEndpointTLS: cfg.LocalEndpointUseTLS,
+		gatewayErrorBody: cfg.GatewayErrorBody,
+		flushInterval:    cfg.FlushInterval,
+		controlStream:    cfg.HTTP2ControlStream,
+
+		localEndpointTLSConfig: t.TLSClientConfig,
 	}
 
 	return h, nil
 }
 
+// localHTTP2Transport speaks HTTP/2 to the local endpoint, unencrypted (h2c) unless useTLS
+func localHTTP2Transport(tlsConfig *tls.Config, useTLS bool) *http2.Transport {
+	if useTLS {
+		return &http2.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, localDialTimeout)
+		},
+	}
+}
+
 // ListenAndServe accepts requests coming from wormhole server
 // and forwards them to the local server
 func (s *HTTP2Handler) ListenAndServe() error {
@@ -97,68 +150,42 @@ func (s *HTTP2Handler) ListenAndServe() error {
 		return err
 	}
 	defer control.Close()
+	defer s.setReleaseWriter(nil)
 
 	s.control = control
+	s.tunnelAuth = false
 	ctlAuthMsg := &messages.AuthControl{
-		Token: s.FlyToken,
+		Token:       s.FlyToken,
+		ResumeToken: s.resumeToken,
 	}
-	buf, err := messages.Pack(ctlAuthMsg)
-	if err != nil {
-		return fmt.Errorf("error packing message to control: " + err.Error())
-	}
-
-	_, err = s.control.Write(buf)
-	if err != nil {
+	if err := messages.NewWriter(s.control).WriteMessage(ctlAuthMsg); err != nil {
 		return fmt.Errorf("error writing to control: " + err.Error())
 	}
 
-	s.lastPongAt = time.Now().UnixNano()
-	go s.heartbeat()
-
-	b := make([]byte, 1024)
-	for {
-		nr, err := s.control.Read(b)
-		if err == io.EOF {
-			continue
-		}
+	// servers which don't negotiate h2 keep a separate control conn
+	if control.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		stream, err := s.acceptControlStream(control)
 		if err != nil {
-			return fmt.Errorf("error reading from control: " + err.Error())
+			return err
 		}
-		msg, err := messages.Unpack(b[:nr])
+		s.control = stream
+		s.writer = messages.NewWriter(s.control)
+	} else {
+		s.writer = messages.NewWriter(s.control)
+		s.lastPongAt = time.Now().UnixNano()
+		go s.heartbeat()
+	}
+
+	r := messages.NewReader(s.control)
+	for {
+		msg, err := r.ReadMessage()
 		if err != nil {
-			return fmt.Errorf("error parsing message from stream: " + err.Error())
+			return fmt.Errorf("error reading message from control: " + err.Error())
 		}
 		switch m := msg.(type) {
 		case *messages.OpenTunnel:
 			s.logger.Debug("Received Open Tunnel message.")
-			tcpConn, err := s.dial()
-			if err != nil {
-				return err
-			}
-			genericTLSConn, err := s.genericTLSWrap(tcpConn)
-			if err != nil {
-				return err
-			}
-			authMsg := &messages.AuthTunnel{ClientID: m.ClientID, Token: s.FlyToken}
-			b, _ := messages.Pack(authMsg)
-			_, err = genericTLSConn.Write(b)
-			if err != nil {
-				return fmt.Errorf("Failed to auth tunnel: %s", err.Error())
-			}
-			if err := genericTLSConn.CloseWrite(); err != nil {
-				return fmt.Errorf("Failed to close tls: %s", err.Error())
-			}
-
-			for err == nil {
-				_, err = genericTLSConn.Read(b)
-			}
-			if err != io.EOF {
-				return fmt.Errorf("Failed to close tls: %s", err.Error())
-			}
-
-			// TODO: Listen for auth ACK
-
-			http2TLSConn, err := s.http2ALPNTLSWrap(tcpConn)
+			http2TLSConn, err := s.openTunnel(m.ClientID)
 			if err != nil {
 				return err
 			}
@@ -172,6 +199,17 @@ func (s *HTTP2Handler) ListenAndServe() error {
 			}
 			s.logger.Info("Serving http2 Connection")
 			go s.server.ServeConn(http2TLSConn, opts)
+		case *messages.AuthResult:
+			if err := m.Err(); err != nil {
+				return err
+			}
+			s.logger.Infof("Authenticated session %s listening on: %s", m.SessionID, strings.Join(m.Endpoints, ", "))
+			// presented when reconnecting to keep the same session and endpoints
+			s.resumeToken = m.ResumeToken
+			s.tunnelAuth = m.TunnelAuth
+			if err := s.setReleaseWriter(s.writer); err != nil {
+				return fmt.Errorf("error sending release: " + err.Error())
+			}
 		case *messages.Shutdown:
 			s.logger.Debugf("Received Shutdown message: %s", m.Error)
 			return s.Close()
@@ -184,6 +222,11 @@ func (s *HTTP2Handler) ListenAndServe() error {
 }
 
 func (s *HTTP2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if upgrade := r.Header.Get(wnet.UpgradeHeader); upgrade != "" {
+		s.serveUpgrade(w, r, upgrade)
+		return
+	}
+
 	r.URL.Host = s.LocalEndpoint
 	if s.localEndpointTLS {
 		r.URL.Scheme = "https"
@@ -193,29 +236,118 @@ func (s *HTTP2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Host = s.LocalEndpoint
 	r.RequestURI = ""
 
-	// We ignore the error ONLY because it will be forwarded
-	// to the end user
-	// TODO: Handle this error
 	resp, err := s.fClient.Do(r)
 	if err != nil {
-		s.logger.Error(err)
+		s.gatewayError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	s.copyResponse(w, resp)
+}
+
+// serveUpgrade sends an upgrade request carried over a tunnel stream to the local endpoint
+// Once the local endpoint switched protocols, its connection is spliced with the stream
+func (s *HTTP2Handler) serveUpgrade(w http.ResponseWriter, r *http.Request, upgrade string) {
+	local, err := s.dialLocal()
+	if err != nil {
+		s.gatewayError(w, err)
+		return
+	}
+
+	r.Header.Del(wnet.UpgradeHeader)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", upgrade)
+	// the request body carries the upgraded connection, it's only sent once switched
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     r.Header,
+		Host:       s.LocalEndpoint,
+	}
+	localBuf := bufio.NewReader(local)
+	if err := req.Write(local); err != nil {
+		local.Close()
+		s.gatewayError(w, err)
+		return
+	}
+	resp, err := http.ReadResponse(localBuf, req)
+	if err != nil {
+		local.Close()
+		s.gatewayError(w, err)
+		return
 	}
 
-	// Delete this so we don't copy it over
-	// Will be handled by http.ResponseWriter
-	resp.Header.Del("Content-Length")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer local.Close()
+		defer resp.Body.Close()
+		s.copyResponse(w, resp)
+		return
+	}
 
 	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+		switch http.CanonicalHeaderKey(key) {
+		// connection-specific, HTTP2 doesn't allow them
+		case "Connection", "Upgrade", "Keep-Alive", "Transfer-Encoding":
+		// only set on gateway errors of the client
+		case wnet.TunnelErrorHeader, wnet.GatewayErrorHeader:
+		default:
+			w.Header()[key] = values
 		}
 	}
+	w.Header().Set(wnet.UpgradeHeader, resp.Header.Get("Upgrade"))
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		// the server hijacks the ingress connection once it gets the headers
+		f.Flush()
+	}
 
-	w.WriteHeader(resp.StatusCode)
+	stream := wnet.NewStreamConn(r.Body, w, r.Body.Close)
+	rcvd, sent, err := wnet.CopyCloseIO(wnet.NewBufferedConn(local, localBuf), stream)
+	if err != nil {
+		s.logger.Debugf("Upgraded connection closed: %s", err.Error())
+	}
+	s.logger.Infof("Copied %d and %d bytes over upgraded connection", rcvd, sent)
+}
 
-	defer resp.Body.Close()
+// dialLocal opens a connection to the local endpoint, over TLS if it's configured to use it
+func (s *HTTP2Handler) dialLocal() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", s.LocalEndpoint, localDialTimeout)
+	if err != nil || !s.localEndpointTLS {
+		return conn, err
+	}
+
+	cfg := s.localEndpointTLSConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(s.LocalEndpoint)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
 
-	nr, err := io.Copy(w, resp.Body)
+// gatewayError answers a request which couldn't be sent to the local endpoint
+// The tunnel error header tells the server it's not a response of the local endpoint
+func (s *HTTP2Handler) gatewayError(w http.ResponseWriter, err error) {
+	class := wnet.ClassifyLocalError(err)
+	s.logger.WithField("error_class", class).Errorf("Couldn't reach local endpoint: %s", err.Error())
+	w.Header().Set(wnet.TunnelErrorHeader, string(class))
+	wnet.WriteGatewayError(w, class, s.gatewayErrorBody)
+}
+
+// copyResponse writes a response of the local endpoint to w
+func (s *HTTP2Handler) copyResponse(w http.ResponseWriter, resp *http.Response) {
+	// the local endpoint can't have the server switch protocols without answering 101,
+	// nor pass its responses off as gateway errors
+	resp.Header.Del(wnet.UpgradeHeader)
+	resp.Header.Del(wnet.TunnelErrorHeader)
+	resp.Header.Del(wnet.GatewayErrorHeader)
+	nr, err := wnet.CopyResponse(w, resp, s.flushInterval)
 	if err != nil {
 		s.logger.Errorf("Could not copy response body")
 		return
@@ -223,6 +355,33 @@ func (s *HTTP2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.logger.Infof("Copied %d bytes between connection bodies", nr)
 }
 
+// UpdateRelease replaces the release of the local program, e.g. after it was restarted,
+// and sends it to the server if the session is established
+func (s *HTTP2Handler) UpdateRelease(release *messages.Release) error {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.Release = release
+	return s.sendRelease()
+}
+
+// setReleaseWriter sends the release over w, the control of an authenticated session,
+// and later updates until it's reset to nil
+func (s *HTTP2Handler) setReleaseWriter(w *messages.Writer) error {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.releaseWriter = w
+	return s.sendRelease()
+}
+
+// sendRelease must be called with releaseMu held
+func (s *HTTP2Handler) sendRelease() error {
+	if s.releaseWriter == nil || s.Release == nil {
+		return nil
+	}
+	s.logger.Info("Sending release info...")
+	return s.releaseWriter.WriteMessage(s.Release)
+}
+
 // Close closes the listener and TCP connection
 func (s *HTTP2Handler) Close() error {
 	err := s.control.Close()
@@ -252,22 +411,113 @@ func (s *HTTP2Handler) dial() (*net.TCPConn, error) {
 	return tcpConn, nil
 }
 
-func (s *HTTP2Handler) dialControl() (net.Conn, error) {
-	conn, err := s.dial()
+// openTunnel connects a tunnel for the session and returns it once authenticated, ready to serve h2
+// The auth messages are exchanged before h2 starts on the same TLS conn, unless the server
+// doesn't negotiate h2 along with ALPNHTTP2. The tunnel then takes another TLS handshake.
+func (s *HTTP2Handler) openTunnel(clientID string) (net.Conn, error) {
+	tcpConn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := s.tunnelTLSWrap(tcpConn)
 	if err != nil {
 		return nil, err
 	}
+	authMsg := &messages.AuthTunnel{ClientID: clientID, Token: s.FlyToken}
+	if err := messages.NewWriter(tlsConn).WriteMessage(authMsg); err != nil {
+		return nil, fmt.Errorf("Failed to auth tunnel: %s", err.Error())
+	}
+
+	r := messages.NewReader(tlsConn)
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		if _, err := readAuthResult(r); err != nil {
+			tlsConn.Close()
+			return nil, fmt.Errorf("Failed to auth tunnel: %s", err.Error())
+		}
+		// the server may have sent its h2 preface along with the auth result
+		return wnet.NewBufferedConn(tlsConn, r), nil
+	}
+
+	// servers which don't negotiate h2 expect the TLS conn to be closed after the auth message
+	// those which didn't announce tunnelAuth close it without sending an AuthResult
+	if err := tlsConn.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("Failed to close tls: %s", err.Error())
+	}
+	if s.tunnelAuth {
+		if _, err := readAuthResult(r); err != nil {
+			return nil, fmt.Errorf("Failed to auth tunnel: %s", err.Error())
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, fmt.Errorf("Failed to close tls: %s", err.Error())
+	}
+	return s.http2ALPNTLSWrap(tcpConn)
+}
 
-	cConn, err := s.genericTLSWrap(conn)
+func (s *HTTP2Handler) dialControl() (*tls.Conn, error) {
+	conn, err := s.dial()
 	if err != nil {
 		return nil, err
 	}
 
-	return cConn, nil
+	if s.controlStream {
+		return s.tunnelTLSWrap(conn)
+	}
+	return s.genericTLSWrap(conn)
+}
+
+// acceptControlStream serves h2 on the control conn, which the server then uses as a tunnel
+// as well, and returns the stream it opens on it to exchange control messages
+func (s *HTTP2Handler) acceptControlStream(conn net.Conn) (io.ReadWriteCloser, error) {
+	streams := make(chan io.ReadWriteCloser, 1)
+	done := make(chan struct{})
+	var opened int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(wnet.ControlStreamHeader) == "" {
+			s.ServeHTTP(w, r)
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&opened, 0, 1) {
+			http.Error(w, "control stream already open", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		streams <- wnet.NewStreamConn(r.Body, w, func() error {
+			close(done)
+			return nil
+		})
+		// the response ends with the stream
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	})
+
+	s.logger.Info("Serving http2 Connection")
+	go s.server.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+
+	select {
+	case stream := <-streams:
+		return stream, nil
+	case <-time.After(controlStreamTimeout):
+		return nil, errors.New("server didn't open the control stream")
+	}
 }
 
 func (s *HTTP2Handler) genericTLSWrap(conn *net.TCPConn) (*tls.Conn, error) {
-	return wnet.GenericTLSWrap(conn, s.remoteTLSConfig, tls.Client)
+	// advertise the transport so the server can route the connection
+	cfg := s.remoteTLSConfig.Clone()
+	cfg.NextProtos = []string{wnet.ALPNHTTP2}
+	return wnet.GenericTLSWrap(conn, cfg, tls.Client)
+}
+
+// tunnelTLSWrap offers h2 along with ALPNHTTP2, for the tunnel to speak h2 on the TLS conn
+// it's authenticated on, see http2ALPNTLSWrap
+func (s *HTTP2Handler) tunnelTLSWrap(conn *net.TCPConn) (*tls.Conn, error) {
+	cfg := s.remoteTLSConfig.Clone()
+	cfg.NextProtos = []string{wnet.ALPNHTTP2, http2.NextProtoTLS}
+	return wnet.GenericTLSWrap(conn, cfg, tls.Client)
 }
 
 // This wrapper fulfills the requirement for specifying the 'h2' ALPN TLS negotiation for
@@ -307,13 +557,12 @@ func (s *HTTP2Handler) heartbeat() {
 			}
 
 		case <-ping.C:
-			b, err := messages.Pack(&messages.Ping{})
-			if err != nil {
-				s.logger.Errorf("Got error %v when creating PingMsg", err)
-				return
+			// report the round trip time of the previous Ping to the server
+			msg := &messages.Ping{}
+			if lastPong := time.Unix(0, atomic.LoadInt64(&s.lastPongAt)); lastPong.After(lastPing) {
+				msg.RTT = int64(lastPong.Sub(lastPing))
 			}
-			_, err = s.control.Write(b)
-			if err != nil {
+			if err := s.writer.WriteMessage(msg); err != nil {
 				s.logger.Errorf("Got error %v when writing PingMsg", err)
 				return
 			}
@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -18,6 +20,14 @@ import (
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 
 	"os"
 )
@@ -226,6 +236,12 @@ func TestHTTP2Handler(t *testing.T) {
 			assert.Equal(t, authTunMsg.ClientID, oMsg.ClientID, "Should have same clientID as openTunnel")
 			assert.Equal(t, authTunMsg.Token, h.FlyToken, "Should have matching tokens")
 
+			ack, err := messages.Pack(&messages.AuthResult{SessionID: oMsg.ClientID})
+			assert.NoError(t, err, "Should have no error packing auth result")
+
+			_, err = tunTLSConn.Write(ack)
+			assert.NoError(t, err, "Should have no error acknowledging tunnel")
+
 			err = tunTLSConn.CloseWrite()
 			assert.NoError(t, err, "Should be no error closing conn")
 
@@ -247,5 +263,374 @@ func TestHTTP2Handler(t *testing.T) {
 
 			assert.Equal(t, testBody, string(body))
 		})
+
+		t.Run("Test_open_tunnel_single_handshake", func(t *testing.T) {
+			buf, err := messages.Pack(&messages.OpenTunnel{ClientID: "test"})
+			assert.NoError(t, err, "Should have no error packing messages")
+
+			_, err = controlCTLS.Write(buf)
+			assert.NoError(t, err, "Should have no error writing message")
+
+			tunConn, err := testRemoteListener.AcceptTCP()
+			assert.NoError(t, err, "Should have no error accepting tunnel")
+
+			cfg := testTLSServerConfig.Clone()
+			cfg.NextProtos = []string{http2.NextProtoTLS, wnet.ALPNHTTP2}
+			tunTLSConn, err := wnet.GenericTLSWrap(tunConn, cfg, tls.Server)
+			assert.NoError(t, err, "Should have no error wrapping tunnel")
+			assert.Equal(t, http2.NextProtoTLS, tunTLSConn.ConnectionState().NegotiatedProtocol, "Should negotiate h2")
+
+			r := messages.NewReader(tunTLSConn)
+			msg, err := r.ReadMessage()
+			assert.NoError(t, err, "Should have no error reading auth message")
+
+			authTunMsg, ok := msg.(*messages.AuthTunnel)
+			assert.True(t, ok, "Should be of type authtunnel")
+			assert.Equal(t, "test", authTunMsg.ClientID, "Should have same clientID as openTunnel")
+
+			err = messages.NewWriter(tunTLSConn).WriteMessage(&messages.AuthResult{SessionID: "test"})
+			assert.NoError(t, err, "Should have no error acknowledging tunnel")
+
+			// no second handshake, h2 starts on the same TLS conn
+			tr := &http2.Transport{}
+			http2Client, err := tr.NewClientConn(wnet.NewBufferedConn(tunTLSConn, r))
+			assert.NoError(t, err, "Should be no error creating new client conn")
+
+			req, err := http.NewRequest("GET", "https://127.0.0.1:8000", nil)
+			assert.NoError(t, err, "Should have no error making request")
+
+			resp, err := http2Client.RoundTrip(req)
+			assert.NoError(t, err, "Should have no error sending request")
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err, "Should have no error reading body")
+
+			assert.Equal(t, testBody, string(body))
+		})
+	})
+}
+
+func TestHTTP2HandlerControlStream(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+
+	h, err := NewHTTP2Handler(&config.ClientConfig{
+		Config: config.Config{
+			Logger:  logrus.New(),
+			Version: "test_version",
+			TLSCert: testTLSCACert,
+		},
+		Token:              "test_token",
+		LocalEndpoint:      httpTestServer.Listener.Addr().String(),
+		RemoteEndpoint:     ln.Addr().String(),
+		HTTP2ControlStream: true,
+	}, &messages.Release{ID: "test_id"})
+	assert.NoError(t, err, "Should be no error creating handler")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenAndServe()
+	}()
+
+	conn, err := ln.AcceptTCP()
+	assert.NoError(t, err, "Should have no error accepting control conn")
+	cfg := testTLSServerConfig.Clone()
+	cfg.NextProtos = []string{http2.NextProtoTLS, wnet.ALPNHTTP2}
+	tlsConn, err := wnet.GenericTLSWrap(conn, cfg, tls.Server)
+	assert.NoError(t, err, "Should have no error wrapping control conn")
+	assert.Equal(t, http2.NextProtoTLS, tlsConn.ConnectionState().NegotiatedProtocol, "Should negotiate h2")
+
+	r := messages.NewReader(tlsConn)
+	msg, err := r.ReadMessage()
+	assert.NoError(t, err, "Should have no error reading auth message")
+	assert.IsType(t, &messages.AuthControl{}, msg)
+
+	cc, err := (&http2.Transport{}).NewClientConn(wnet.NewBufferedConn(tlsConn, r))
+	assert.NoError(t, err, "Should be no error creating client conn")
+	openStream := func(body io.Reader) *http.Response {
+		req, err := http.NewRequest("POST", "https://127.0.0.1:8000", body)
+		assert.NoError(t, err, "Should have no error making request")
+		req.Header.Set(wnet.ControlStreamHeader, "1")
+		resp, err := cc.RoundTrip(req)
+		assert.NoError(t, err, "Should have no error opening the control stream")
+		return resp
+	}
+
+	pr, pw := io.Pipe()
+	resp := openStream(pr)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	control := messages.NewReader(resp.Body)
+
+	t.Run("Test_control_messages", func(t *testing.T) {
+		assert.NoError(t, messages.NewWriter(pw).WriteMessage(&messages.AuthResult{SessionID: "test"}))
+		// the client sends its release once authenticated
+		msg, err := control.ReadMessage()
+		assert.NoError(t, err, "Should have no error reading release")
+		release, ok := msg.(*messages.Release)
+		assert.True(t, ok, "Should be a release message")
+		assert.Equal(t, "test_id", release.ID)
+	})
+
+	t.Run("Test_update_release", func(t *testing.T) {
+		assert.NoError(t, h.UpdateRelease(&messages.Release{ID: "test_id_2"}), "Should have no error updating release")
+		if release := readRelease(t, control); release != nil {
+			assert.Equal(t, "test_id_2", release.ID, "Should send the updated release")
+		}
+	})
+
+	t.Run("Test_round_trip", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "https://127.0.0.1:8000", nil)
+		assert.NoError(t, err, "Should have no error making request")
+		resp, err := cc.RoundTrip(req)
+		assert.NoError(t, err, "Should have no error sending request")
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Should have no error reading body")
+		assert.Equal(t, testBody, string(body), "The control conn should serve requests")
+
+		resp = openStream(nil)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "Should only open one control stream")
+	})
+
+	t.Run("Test_closed_by_server", func(t *testing.T) {
+		pw.Close()
+		select {
+		case err := <-done:
+			assert.Error(t, err, "Should stop once the control stream is closed")
+		case <-time.After(time.Second):
+			t.Error("Should stop once the control stream is closed")
+		}
+	})
+}
+
+func TestHTTP2HandlerLegacyTunnel(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+
+	h, err := NewHTTP2Handler(&config.ClientConfig{
+		Config: config.Config{
+			Logger:  logrus.New(),
+			Version: "test_version",
+			TLSCert: testTLSCACert,
+		},
+		Token:          "test_token",
+		LocalEndpoint:  httpTestServer.Listener.Addr().String(),
+		RemoteEndpoint: ln.Addr().String(),
+	}, &messages.Release{ID: "test_id"})
+	assert.NoError(t, err, "Should be no error creating handler")
+
+	// servers predating tunnel auth results don't negotiate h2 and don't answer AuthTunnel,
+	// they close their side of the TLS conn and take another handshake negotiating h2
+	served := make(chan error, 1)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			served <- err
+			return
+		}
+		tlsConn, err := wnet.GenericTLSWrap(conn, testTLSServerConfig, tls.Server)
+		if err != nil {
+			served <- err
+			return
+		}
+		r := messages.NewReader(tlsConn)
+		if _, err := r.ReadMessage(); err != nil {
+			served <- err
+			return
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			served <- err
+			return
+		}
+		tlsConn.CloseWrite()
+		cfg := testTLSServerConfig.Clone()
+		cfg.NextProtos = []string{http2.NextProtoTLS}
+		_, err = wnet.GenericTLSWrap(conn, cfg, tls.Server)
+		served <- err
+	}()
+
+	tunnel, err := h.openTunnel("test")
+	assert.NoError(t, err, "Should be no error opening tunnel without tunnel auth")
+	assert.NoError(t, <-served, "Server should negotiate h2 on the tunnel")
+	if err == nil {
+		assert.Equal(t, http2.NextProtoTLS, tunnel.(*tls.Conn).ConnectionState().NegotiatedProtocol, "Should negotiate h2")
+		tunnel.Close()
+	}
+}
+
+func TestHTTP2HandlerGatewayErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	h := &HTTP2Handler{
+		fClient:          &http.Client{Timeout: 50 * time.Millisecond},
+		logger:           logrus.NewEntry(logrus.New()),
+		gatewayErrorBody: "<html>Down for maintenance</html>",
+	}
+
+	t.Run("Test_local_dial_failed", func(t *testing.T) {
+		h.LocalEndpoint = closedAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, "local_dial_failed", w.Header().Get(wnet.GatewayErrorHeader))
+		assert.Equal(t, "local_dial_failed", w.Header().Get(wnet.TunnelErrorHeader), "Should tell the server it's a gateway error")
+		assert.Equal(t, "<html>Down for maintenance</html>\n", w.Body.String(), "Should send the configured body")
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("Test_local_timeout", func(t *testing.T) {
+		h.LocalEndpoint = slow.Listener.Addr().String()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.Equal(t, "local_timeout", w.Header().Get(wnet.GatewayErrorHeader))
+		assert.Equal(t, "local_timeout", w.Header().Get(wnet.TunnelErrorHeader), "Should tell the server it's a gateway error")
+	})
+
+	t.Run("Test_local_endpoint_class", func(t *testing.T) {
+		spoofing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(wnet.GatewayErrorHeader, string(wnet.LocalTimeout))
+			w.Header().Set(wnet.TunnelErrorHeader, string(wnet.LocalTimeout))
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}))
+		defer spoofing.Close()
+
+		h.LocalEndpoint = spoofing.Listener.Addr().String()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code, "Should pass the response of the local endpoint through")
+		assert.Empty(t, w.Header().Get(wnet.GatewayErrorHeader), "Local endpoints shouldn't set the class")
+		assert.Empty(t, w.Header().Get(wnet.TunnelErrorHeader), "Local endpoints shouldn't pass responses off as gateway errors")
+	})
+}
+
+func TestHTTP2HandlerUpgrade(t *testing.T) {
+	// a local endpoint switching to an echo protocol
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nEcho-Accept: %s\r\n\r\n", r.Header.Get("Echo-Key"))
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer local.Close()
+
+	h := &HTTP2Handler{
+		LocalEndpoint: local.Listener.Addr().String(),
+		logger:        logrus.NewEntry(logrus.New()),
+	}
+	tunnel := httptest.NewUnstartedServer(h)
+	tunnel.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS}}
+	tunnel.StartTLS()
+	defer tunnel.Close()
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	t.Run("Test_switched", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		req, err := http.NewRequest("GET", tunnel.URL+"/echo", pr)
+		assert.NoError(t, err, "Should be no error creating request")
+		req.Header.Set(wnet.UpgradeHeader, "echo")
+		req.Header.Set("Echo-Key", "key")
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err, "Should be no error sending request")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "echo", resp.Header.Get(wnet.UpgradeHeader))
+		assert.Equal(t, "key", resp.Header.Get("Echo-Accept"))
+
+		fmt.Fprint(pw, "ping")
+		b := make([]byte, 4)
+		_, err = io.ReadFull(resp.Body, b)
+		assert.NoError(t, err, "Should be no error reading from the stream")
+		assert.Equal(t, "ping", string(b))
+	})
+
+	t.Run("Test_refused", func(t *testing.T) {
+		req, err := http.NewRequest("GET", tunnel.URL+"/echo", nil)
+		assert.NoError(t, err, "Should be no error creating request")
+		req.Header.Set(wnet.UpgradeHeader, "other")
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err, "Should be no error sending request")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode, "Should pass the response of the local endpoint through")
+		assert.Empty(t, resp.Header.Get(wnet.UpgradeHeader))
+	})
+}
+
+func TestHTTP2HandlerGRPC(t *testing.T) {
+	// a gRPC local endpoint, speaking h2c
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("wormhole", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	reflection.Register(grpcServer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	go grpcServer.Serve(ln)
+	defer grpcServer.Stop()
+
+	h := &HTTP2Handler{
+		LocalEndpoint: ln.Addr().String(),
+		fClient:       &http.Client{Transport: localHTTP2Transport(nil, false)},
+		logger:        logrus.NewEntry(logrus.New()),
+	}
+	tunnel := httptest.NewUnstartedServer(h)
+	tunnel.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS}}
+	tunnel.StartTLS()
+	defer tunnel.Close()
+
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	conn, err := grpc.Dial(tunnel.Listener.Addr().String(), grpc.WithTransportCredentials(creds))
+	assert.NoError(t, err, "Should be no error dialing the handler")
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("Test_unary", func(t *testing.T) {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "wormhole"})
+		assert.NoError(t, err, "Should be no error calling the service")
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err), "Should get the status from the trailers")
+	})
+
+	t.Run("Test_bidirectional_stream", func(t *testing.T) {
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		assert.NoError(t, err, "Should be no error opening a stream")
+		req := &reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		}
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, stream.Send(req), "Should be no error sending on the stream")
+			resp, err := stream.Recv()
+			assert.NoError(t, err, "Should be no error receiving from the stream")
+			assert.NotEmpty(t, resp.GetListServicesResponse().GetService())
+		}
+		assert.NoError(t, stream.CloseSend())
 	})
 }
@@ -3,10 +3,12 @@ package local
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -39,6 +41,9 @@ type SSHHandler struct {
 	logger                 *logrus.Entry
 	lastKeepaliveReplyAt   int64
 	localEndpointTLSConfig *tls.Config
+	hostKeyCallback        ssh.HostKeyCallback
+	authMethods            []ssh.AuthMethod
+	releaseMu              sync.Mutex
 }
 
 // NewSSHHandler initializes SSHHandler
@@ -61,6 +66,16 @@ func NewSSHHandler(cfg *config.ClientConfig, release *messages.Release) (*SSHHan
 		localTLSConfig.RootCAs = rootCAs
 	}
 
+	logger := cfg.Logger.WithFields(logrus.Fields{"prefix": "SSHHandler"})
+	hostKeyCallback, err := sshHostKeyCallback(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	authMethods, err := sshAuthMethods(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SSHHandler{
 		FlyToken:               cfg.Token,
 		RemoteEndpoint:         cfg.RemoteEndpoint,
@@ -68,11 +83,44 @@ func NewSSHHandler(cfg *config.ClientConfig, release *messages.Release) (*SSHHan
 		Release:                release,
 		Version:                cfg.Version,
 		shutdown:               utils.NewShutdown(),
-		logger:                 cfg.Logger.WithFields(logrus.Fields{"prefix": "SSHHandler"}),
+		logger:                 logger,
 		localEndpointTLSConfig: localTLSConfig,
+		hostKeyCallback:        hostKeyCallback,
+		authMethods:            authMethods,
 	}, nil
 }
 
+// sshAuthMethods returns the methods the client authenticates with, in order:
+// the SSH key (or its certificate) when configured, then the token
+func sshAuthMethods(cfg *config.ClientConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if len(cfg.SSHKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(cfg.SSHKey)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse SSH key: %s", err.Error())
+		}
+		if len(cfg.SSHCert) > 0 {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey(cfg.SSHCert)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't parse SSH certificate: %s", err.Error())
+			}
+			cert, ok := pub.(*ssh.Certificate)
+			if !ok {
+				return nil, errors.New("SSH certificate file doesn't hold a certificate")
+			}
+			signer, err = ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if len(cfg.Token) > 0 {
+		methods = append(methods, ssh.Password(cfg.Token))
+	}
+	return methods, nil
+}
+
 // ListenAndServe accepts requests coming from wormhole server
 // and forwards them to the local server
 func (s *SSHHandler) ListenAndServe() error {
@@ -83,7 +131,9 @@ func (s *SSHHandler) ListenAndServe() error {
 	}
 	defer ln.Close()
 	defer ssh.Close()
+	s.releaseMu.Lock()
 	s.ssh = ssh
+	s.releaseMu.Unlock()
 	s.ln = ln
 	s.lastKeepaliveReplyAt = time.Now().UnixNano()
 
@@ -125,7 +175,7 @@ func (s *SSHHandler) Close() error {
 
 // connects to wormhole server, performs SSH handshake, and
 // opens a port on wormhole server that SshHandler can listen on.
-// SSH uses FLY_TOKEN for authentication
+// SSH uses the SSH key and/or FLY_TOKEN for authentication
 func (s *SSHHandler) dial() (*ssh.Client, net.Listener, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -133,13 +183,11 @@ func (s *SSHHandler) dial() (*ssh.Client, net.Listener, error) {
 	}
 
 	config := &ssh.ClientConfig{
-		User:          hostname,
-		ClientVersion: "wormhole " + s.Version,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(s.FlyToken),
-		},
+		User:            hostname,
+		ClientVersion:   "wormhole " + s.Version,
+		Auth:            s.authMethods,
 		Timeout:         sshConnTimeout,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: s.hostKeyCallback,
 	}
 
 	// SSH into wormhole server
@@ -222,12 +270,34 @@ func (s *SSHHandler) stayAlive() {
 }
 
 func (s *SSHHandler) registerRelease() {
-	s.logger.Info("Sending release info...")
-	releaseBytes, err := messages.Pack(s.Release)
-	_, _, err = s.ssh.SendRequest("register-release", false, releaseBytes)
-	if err != nil {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	if err := s.sendRelease(); err != nil {
 		s.logger.Errorf("Failed to send release info: %s", err.Error())
 		return
 	}
 	s.logger.Debug("Release info sent.")
 }
+
+// UpdateRelease replaces the release of the local program, e.g. after it was restarted,
+// and sends it to the server if connected
+func (s *SSHHandler) UpdateRelease(release *messages.Release) error {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.Release = release
+	if s.ssh == nil {
+		return nil
+	}
+	return s.sendRelease()
+}
+
+// sendRelease must be called with releaseMu held
+func (s *SSHHandler) sendRelease() error {
+	s.logger.Info("Sending release info...")
+	releaseBytes, err := messages.Pack(s.Release)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.ssh.SendRequest("register-release", false, releaseBytes)
+	return err
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -26,6 +27,7 @@ var testRespBody string
 const testSSHToken = "test_token"
 
 var testSSHServerConfig *ssh.ServerConfig
+var testSSHHostKeyFingerprint string
 var testSSHClientConfig *tls.Config
 
 var testSSHRemoteListener *net.TCPListener
@@ -58,6 +60,7 @@ func init() {
 
 	if private, err := ssh.ParsePrivateKey(pkey); err == nil {
 		testSSHServerConfig.AddHostKey(private)
+		testSSHHostKeyFingerprint = ssh.FingerprintSHA256(private.PublicKey())
 	} else {
 		os.Exit(1)
 	}
@@ -76,9 +79,10 @@ func TestNewSSHHandler(t *testing.T) {
 			Logger:  logrus.New(),
 			Version: "test_version",
 		},
-		Token:          testSSHToken,
-		LocalEndpoint:  localTestServer.Listener.Addr().String(),
-		RemoteEndpoint: testSSHRemoteListener.Addr().String(),
+		Token:                 testSSHToken,
+		LocalEndpoint:         localTestServer.Listener.Addr().String(),
+		RemoteEndpoint:        testSSHRemoteListener.Addr().String(),
+		SSHHostKeyFingerprint: testSSHHostKeyFingerprint,
 	}
 
 	testRelease := &messages.Release{
@@ -106,9 +110,10 @@ func newTestSSHHandler() (*SSHHandler, error) {
 			Logger:  logrus.New(),
 			Version: "test_version",
 		},
-		Token:          testSSHToken,
-		LocalEndpoint:  localTestServer.Listener.Addr().String(),
-		RemoteEndpoint: testSSHRemoteListener.Addr().String(),
+		Token:                 testSSHToken,
+		LocalEndpoint:         localTestServer.Listener.Addr().String(),
+		RemoteEndpoint:        testSSHRemoteListener.Addr().String(),
+		SSHHostKeyFingerprint: testSSHHostKeyFingerprint,
 	}
 
 	testRelease := &messages.Release{
@@ -192,3 +197,88 @@ func TestSSHHandler(t *testing.T) {
 		assert.NotNil(t, sshconn, "Should have sshconn from initializing the SSH server")
 	})
 }
+
+func TestSSHAuthMethods(t *testing.T) {
+	key, err := ioutil.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods, err := sshAuthMethods(&config.ClientConfig{Token: testSSHToken})
+	assert.NoError(t, err, "Should be no error with a token")
+	assert.Len(t, methods, 1, "Should authenticate with the token")
+
+	methods, err = sshAuthMethods(&config.ClientConfig{Token: testSSHToken, SSHKey: key})
+	assert.NoError(t, err, "Should be no error with a key")
+	assert.Len(t, methods, 2, "Should authenticate with the key, then the token")
+
+	_, err = sshAuthMethods(&config.ClientConfig{SSHKey: key, SSHCert: []byte("not a cert")})
+	assert.Error(t, err, "Should reject an invalid certificate")
+}
+
+func TestSSHHandlerUpdateRelease(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+
+	h, err := newTestSSHHandler()
+	assert.NoError(t, err, "Should be no error creating test handler")
+	h.RemoteEndpoint = ln.Addr().String()
+	assert.NoError(t, h.UpdateRelease(&messages.Release{ID: "test_id_1"}), "Should be no error updating release before connecting")
+
+	releases := make(chan *messages.Release, 2)
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns <- conn
+		_, chans, reqs, err := ssh.NewServerConn(conn, testSSHServerConfig)
+		if err != nil {
+			return
+		}
+		go func() {
+			for newChannel := range chans {
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			}
+		}()
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, uint32(1024))
+				req.Reply(true, b)
+			case "register-release":
+				if msg, err := messages.Unpack(req.Payload); err == nil {
+					releases <- msg.(*messages.Release)
+				}
+			}
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenAndServe()
+	}()
+
+	readRelease := func() *messages.Release {
+		select {
+		case release := <-releases:
+			return release
+		case <-time.After(5 * time.Second):
+			t.Fatal("Should send the release")
+			return nil
+		}
+	}
+	assert.Equal(t, "test_id_1", readRelease().ID, "Should send the latest release once connected")
+
+	assert.NoError(t, h.UpdateRelease(&messages.Release{ID: "test_id_2"}), "Should be no error updating release")
+	assert.Equal(t, "test_id_2", readRelease().ID, "Should send the updated release")
+
+	(<-conns).Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Should stop once the SSH conn is closed")
+	}
+}
@@ -0,0 +1,91 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshHostKeyCallback returns the callback verifying the wormhole server host key.
+// A pinned fingerprint takes precedence over the known_hosts file.
+func sshHostKeyCallback(cfg *config.ClientConfig, logger *logrus.Entry) (ssh.HostKeyCallback, error) {
+	if len(cfg.SSHHostKeyFingerprint) > 0 {
+		return fingerprintHostKeyCallback(cfg.SSHHostKeyFingerprint), nil
+	}
+	if len(cfg.SSHKnownHostsFile) == 0 {
+		return nil, errors.New("a host key fingerprint or a known_hosts file is required to verify the wormhole server")
+	}
+	k := &knownHosts{
+		path:            cfg.SSHKnownHostsFile,
+		trustOnFirstUse: !cfg.SSHStrictHostKeyChecking,
+		logger:          logger,
+	}
+	return k.check, nil
+}
+
+// fingerprintHostKeyCallback accepts the host key matching the SHA256 (or legacy MD5) fingerprint
+func fingerprintHostKeyCallback(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ssh.FingerprintSHA256(key) == fingerprint || ssh.FingerprintLegacyMD5(key) == fingerprint {
+			return nil
+		}
+		return fmt.Errorf("host key %s of %s doesn't match pinned fingerprint %s", ssh.FingerprintSHA256(key), hostname, fingerprint)
+	}
+}
+
+// knownHosts verifies host keys against a known_hosts file
+// Unknown hosts are added to the file when trusting on first use
+type knownHosts struct {
+	path            string
+	trustOnFirstUse bool
+	logger          *logrus.Entry
+	lock            sync.Mutex
+}
+
+func (k *knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	// the file is read on every connection so that edits are picked up without a restart
+	callback, err := knownhosts.New(k.path)
+	if err == nil {
+		err = callback(hostname, remote, key)
+		// keys for the host which don't match are rejected, it may be a MITM
+		if keyErr, ok := err.(*knownhosts.KeyError); !ok || len(keyErr.Want) > 0 {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !k.trustOnFirstUse {
+		return fmt.Errorf("host %s is unknown, add its key to %s", hostname, k.path)
+	}
+	if err := k.add(hostname, key); err != nil {
+		return fmt.Errorf("couldn't record host key of %s: %s", hostname, err.Error())
+	}
+	k.logger.Warnf("Trusting host key %s of %s on first use", ssh.FingerprintSHA256(key), hostname)
+	return nil
+}
+
+func (k *knownHosts) add(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
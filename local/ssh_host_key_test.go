@@ -0,0 +1,65 @@
+package local
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/config"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSSHHostKeyFingerprint(t *testing.T) {
+	key := newTestHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 30000}
+
+	cfg := &config.ClientConfig{SSHHostKeyFingerprint: ssh.FingerprintSHA256(key)}
+	callback, err := sshHostKeyCallback(cfg, logrus.NewEntry(logrus.New()))
+	assert.NoError(t, err, "Should be no error creating host key callback")
+
+	assert.NoError(t, callback("wormhole:30000", remote, key), "Should accept the pinned key")
+	assert.Error(t, callback("wormhole:30000", remote, newTestHostKey(t)), "Should reject other keys")
+}
+
+func TestSSHHostKeyTrustOnFirstUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := newTestHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 30000}
+
+	cfg := &config.ClientConfig{SSHKnownHostsFile: filepath.Join(dir, ".wormhole", "known_hosts")}
+	callback, err := sshHostKeyCallback(cfg, logrus.NewEntry(logrus.New()))
+	assert.NoError(t, err, "Should be no error creating host key callback")
+
+	assert.NoError(t, callback("wormhole:30000", remote, key), "Should trust unknown host on first use")
+	assert.NoError(t, callback("wormhole:30000", remote, key), "Should accept the recorded key")
+	assert.Error(t, callback("wormhole:30000", remote, newTestHostKey(t)), "Should reject a changed key")
+
+	cfg.SSHStrictHostKeyChecking = true
+	callback, err = sshHostKeyCallback(cfg, logrus.NewEntry(logrus.New()))
+	assert.NoError(t, err, "Should be no error creating host key callback")
+
+	assert.NoError(t, callback("wormhole:30000", remote, key), "Should accept the recorded key")
+	assert.Error(t, callback("other:30000", remote, key), "Should reject unknown host")
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/sirupsen/logrus"
 	"github.com/superfly/wormhole/config"
 	"github.com/superfly/wormhole/messages"
@@ -30,11 +33,19 @@ type TCPHandler struct {
 	Version                string
 	ln                     net.Listener
 	control                net.Conn
+	writer                 *messages.Writer
 	conns                  []net.Conn
+	mux                    bool
+	session                *yamux.Session
+	dialControl            func() (net.Conn, error)
 	encrypted              bool
 	remoteTLSConfig        *tls.Config
 	localEndpointTLSConfig *tls.Config
 	lastPongAt             int64
+	resumeToken            string
+	tunnelAuth             bool
+	releaseMu              sync.Mutex
+	releaseWriter          *messages.Writer
 	logger                 *logrus.Entry
 }
 
@@ -47,6 +58,7 @@ func NewTCPHandler(cfg *config.ClientConfig, release *messages.Release) (*TCPHan
 		LocalEndpoint:  cfg.LocalEndpoint,
 		Release:        release,
 		Version:        cfg.Version,
+		mux:            cfg.Protocol == config.TCPMux,
 		logger:         cfg.Logger.WithFields(logrus.Fields{"prefix": "TCPHandler"}),
 	}
 
@@ -73,49 +85,68 @@ func NewTCPHandler(cfg *config.ClientConfig, release *messages.Release) (*TCPHan
 		if !ok {
 			return nil, fmt.Errorf("couln't append a root CA: ")
 		}
-		h.remoteTLSConfig = &tls.Config{RootCAs: rootCAs}
+		certs, err := clientCertificates(cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.remoteTLSConfig = &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: certs,
+			NextProtos:   []string{wnet.ALPNTCP},
+		}
 	}
+	h.dialControl = h.dial
 	return h, nil
 }
 
 // ListenAndServe accepts requests coming from wormhole server
 // and forwards them to the local server
 func (s *TCPHandler) ListenAndServe() error {
-	control, err := s.dial()
+	control, err := s.dialControl()
 	if err != nil {
 		return err
 	}
 	defer control.Close()
+	defer s.setReleaseWriter(nil)
 
 	s.control = control
+	s.tunnelAuth = false
 	ctlAuthMsg := &messages.AuthControl{
-		Token: s.FlyToken,
+		Token:       s.FlyToken,
+		ResumeToken: s.resumeToken,
+		Mux:         s.mux,
 	}
-	buf, err := messages.Pack(ctlAuthMsg)
-	if err != nil {
-		return fmt.Errorf("error packing message to control: " + err.Error())
+	if err := messages.NewWriter(s.control).WriteMessage(ctlAuthMsg); err != nil {
+		return fmt.Errorf("error writing to control: " + err.Error())
 	}
 
-	_, err = s.control.Write(buf)
-	if err != nil {
-		return fmt.Errorf("error writing to control: " + err.Error())
+	if s.mux {
+		session, err := yamux.Client(control, wnet.MuxConfig())
+		if err != nil {
+			return fmt.Errorf("error creating multiplexed session: %s", err.Error())
+		}
+		defer session.Close()
+
+		// the server opens the control stream first so that nothing is written
+		// on the connection before it has read the auth message
+		stream, err := session.Accept()
+		if err != nil {
+			return fmt.Errorf("error accepting control stream: %s", err.Error())
+		}
+		s.session = session
+		s.control = stream
+		go s.acceptStreams(session)
 	}
 
+	s.writer = messages.NewWriter(s.control)
 	s.lastPongAt = time.Now().UnixNano()
 	go s.heartbeat()
 
-	b := make([]byte, 1024)
+	r := messages.NewReader(s.control)
 	for {
-		nr, err := s.control.Read(b)
-		if err == io.EOF {
-			continue
-		}
+		msg, err := r.ReadMessage()
 		if err != nil {
-			return fmt.Errorf("error reading from control: " + err.Error())
-		}
-		msg, err := messages.Unpack(b[:nr])
-		if err != nil {
-			return fmt.Errorf("error parsing message from stream: " + err.Error())
+			return fmt.Errorf("error reading message from control: " + err.Error())
 		}
 		switch m := msg.(type) {
 		case *messages.OpenTunnel:
@@ -125,15 +156,23 @@ func (s *TCPHandler) ListenAndServe() error {
 				return err
 			}
 			authMsg := &messages.AuthTunnel{ClientID: m.ClientID, Token: s.FlyToken}
-			b, _ := messages.Pack(authMsg)
-			_, err = conn.Write(b)
-			if err != nil {
+			if err := messages.NewWriter(conn).WriteMessage(authMsg); err != nil {
 				return fmt.Errorf("Failed to auth tunnel: %s", err.Error())
 			}
 
-			s.logger.Infof("Established TCP Tunnel connection for Session: %s", m.ClientID)
 			s.conns = append(s.conns, conn)
-			go s.forwardConnection(conn, s.LocalEndpoint)
+			go s.acceptTunnel(conn, m.ClientID, s.tunnelAuth)
+		case *messages.AuthResult:
+			if err := m.Err(); err != nil {
+				return err
+			}
+			s.logger.Infof("Authenticated session %s listening on: %s", m.SessionID, strings.Join(m.Endpoints, ", "))
+			// presented when reconnecting to keep the same session and endpoints
+			s.resumeToken = m.ResumeToken
+			s.tunnelAuth = m.TunnelAuth
+			if err := s.setReleaseWriter(s.writer); err != nil {
+				return fmt.Errorf("error sending release: " + err.Error())
+			}
 		case *messages.Shutdown:
 			s.logger.Debugf("Received Shutdown message: %s", m.Error)
 			return s.Close()
@@ -145,12 +184,45 @@ func (s *TCPHandler) ListenAndServe() error {
 	}
 }
 
+// UpdateRelease replaces the release of the local program, e.g. after it was restarted,
+// and sends it to the server if the session is established
+func (s *TCPHandler) UpdateRelease(release *messages.Release) error {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.Release = release
+	return s.sendRelease()
+}
+
+// setReleaseWriter sends the release over w, the control of an authenticated session,
+// and later updates until it's reset to nil
+func (s *TCPHandler) setReleaseWriter(w *messages.Writer) error {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.releaseWriter = w
+	return s.sendRelease()
+}
+
+// sendRelease must be called with releaseMu held
+func (s *TCPHandler) sendRelease() error {
+	if s.releaseWriter == nil || s.Release == nil {
+		return nil
+	}
+	s.logger.Info("Sending release info...")
+	return s.releaseWriter.WriteMessage(s.Release)
+}
+
 // Close closes the listener and TCP connection
 func (s *TCPHandler) Close() error {
 	err := s.control.Close()
 	if err != nil {
 		s.logger.Errorf("Control TCP conn close: %s", err)
 	}
+	if s.session != nil {
+		err = s.session.Close()
+		if err != nil {
+			s.logger.Errorf("Multiplexed session close: %s", err)
+		}
+	}
 	for _, c := range s.conns {
 		err = c.Close()
 		if err != nil {
@@ -203,13 +275,12 @@ func (s *TCPHandler) heartbeat() {
 			}
 
 		case <-ping.C:
-			b, err := messages.Pack(&messages.Ping{})
-			if err != nil {
-				s.logger.Errorf("Got error %v when creating PingMsg", err)
-				return
+			// report the round trip time of the previous Ping to the server
+			msg := &messages.Ping{}
+			if lastPong := time.Unix(0, atomic.LoadInt64(&s.lastPongAt)); lastPong.After(lastPing) {
+				msg.RTT = int64(lastPong.Sub(lastPing))
 			}
-			_, err = s.control.Write(b)
-			if err != nil {
+			if err := s.writer.WriteMessage(msg); err != nil {
 				s.logger.Errorf("Got error %v when writing PingMsg", err)
 				return
 			}
@@ -219,6 +290,40 @@ func (s *TCPHandler) heartbeat() {
 	}
 }
 
+// acceptStreams forwards tunnel streams opened by the server until the session is closed
+func (s *TCPHandler) acceptStreams(session *yamux.Session) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if !session.IsClosed() {
+				s.logger.Errorf("Failed to accept tunnel stream: %s", err.Error())
+			}
+			s.control.Close()
+			return
+		}
+		s.logger.Debug("Accepted tunnel stream.")
+		go s.forwardConnection(stream, s.LocalEndpoint)
+	}
+}
+
+// acceptTunnel waits for the server to acknowledge the tunnel conn before forwarding it
+// Servers which didn't announce tunnelAuth use the conn right away
+func (s *TCPHandler) acceptTunnel(conn net.Conn, clientID string, tunnelAuth bool) {
+	if !tunnelAuth {
+		s.logger.Infof("Established TCP Tunnel connection for Session: %s", clientID)
+		s.forwardConnection(conn, s.LocalEndpoint)
+		return
+	}
+	r := messages.NewReader(conn)
+	if _, err := readAuthResult(r); err != nil {
+		s.logger.Errorf("Tunnel connection for Session %s rejected: %s", clientID, err.Error())
+		conn.Close()
+		return
+	}
+	s.logger.Infof("Established TCP Tunnel connection for Session: %s", clientID)
+	s.forwardConnection(wnet.NewBufferedConn(conn, r), s.LocalEndpoint)
+}
+
 func (s *TCPHandler) forwardConnection(tunnel net.Conn, local string) {
 	s.logger.Debugf("Accepted TCP session on %s", tunnel.RemoteAddr())
 
@@ -232,6 +337,8 @@ func (s *TCPHandler) forwardConnection(tunnel net.Conn, local string) {
 	}
 	if err != nil {
 		s.logger.Errorf("Failed to reach local server: %s", err.Error())
+		tunnel.Close()
+		return
 	}
 
 	s.logger.Debugf("Dialed local server on %s", local)
@@ -0,0 +1,153 @@
+package local
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+)
+
+func TestTCPHandlerTunnelAuth(t *testing.T) {
+	t.Run("Test_tunnel_auth", func(t *testing.T) {
+		testTCPHandlerTunnel(t, true)
+	})
+	// servers predating tunnel auth results use tunnel conns right after AuthTunnel
+	t.Run("Test_legacy_server", func(t *testing.T) {
+		testTCPHandlerTunnel(t, false)
+	})
+}
+
+func testTCPHandlerTunnel(t *testing.T, tunnelAuth bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+
+	h, err := NewTCPHandler(&config.ClientConfig{
+		Config: config.Config{
+			Logger:   logrus.New(),
+			Version:  "test_version",
+			Insecure: true,
+		},
+		Token:          "test_token",
+		LocalEndpoint:  httpTestServer.Listener.Addr().String(),
+		RemoteEndpoint: ln.Addr().String(),
+	}, &messages.Release{ID: "test_id"})
+	assert.NoError(t, err, "Should be no error creating handler")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenAndServe()
+	}()
+
+	control, err := ln.Accept()
+	assert.NoError(t, err, "Should be no error accepting control conn")
+	defer control.Close()
+	msg, err := messages.NewReader(control).ReadMessage()
+	assert.NoError(t, err, "Should be no error reading auth message")
+	assert.IsType(t, &messages.AuthControl{}, msg)
+
+	w := messages.NewWriter(control)
+	if tunnelAuth {
+		assert.NoError(t, w.WriteMessage(&messages.AuthResult{SessionID: "test", TunnelAuth: true}))
+	}
+	assert.NoError(t, w.WriteMessage(&messages.OpenTunnel{ClientID: "test"}))
+
+	tunnel, err := ln.Accept()
+	assert.NoError(t, err, "Should be no error accepting tunnel conn")
+	defer tunnel.Close()
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+	msg, err = messages.NewReader(tunnel).ReadMessage()
+	assert.NoError(t, err, "Should be no error reading tunnel auth message")
+	assert.IsType(t, &messages.AuthTunnel{}, msg)
+	if tunnelAuth {
+		assert.NoError(t, messages.NewWriter(tunnel).WriteMessage(&messages.AuthResult{SessionID: "test"}))
+	}
+
+	req, err := http.NewRequest("GET", "http://"+httpTestServer.Listener.Addr().String()+"/", nil)
+	assert.NoError(t, err, "Should be no error making request")
+	assert.NoError(t, req.Write(tunnel), "Should be no error writing request")
+	resp, err := http.ReadResponse(bufio.NewReader(tunnel), req)
+	assert.NoError(t, err, "Tunnel should be forwarded to the local endpoint")
+	if err == nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Should be no error reading body")
+		assert.Equal(t, testBody, string(body))
+	}
+
+	control.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Should stop once the control conn is closed")
+	}
+}
+
+// readRelease reads the next release sent over the control conn, skipping heartbeats
+func readRelease(t *testing.T, r *messages.Reader) *messages.Release {
+	for {
+		msg, err := r.ReadMessage()
+		if !assert.NoError(t, err, "Should be no error reading release") {
+			return nil
+		}
+		if release, ok := msg.(*messages.Release); ok {
+			return release
+		}
+	}
+}
+
+func TestTCPHandlerUpdateRelease(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+
+	h, err := NewTCPHandler(&config.ClientConfig{
+		Config: config.Config{
+			Logger:   logrus.New(),
+			Version:  "test_version",
+			Insecure: true,
+		},
+		Token:          "test_token",
+		LocalEndpoint:  httpTestServer.Listener.Addr().String(),
+		RemoteEndpoint: ln.Addr().String(),
+	}, &messages.Release{ID: "test_id"})
+	assert.NoError(t, err, "Should be no error creating handler")
+	assert.NoError(t, h.UpdateRelease(&messages.Release{ID: "test_id_1"}), "Should be no error updating release before connecting")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenAndServe()
+	}()
+
+	control, err := ln.Accept()
+	assert.NoError(t, err, "Should be no error accepting control conn")
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	r := messages.NewReader(control)
+	msg, err := r.ReadMessage()
+	assert.NoError(t, err, "Should be no error reading auth message")
+	assert.IsType(t, &messages.AuthControl{}, msg)
+	assert.NoError(t, messages.NewWriter(control).WriteMessage(&messages.AuthResult{SessionID: "test", TunnelAuth: true}))
+
+	if release := readRelease(t, r); release != nil {
+		assert.Equal(t, "test_id_1", release.ID, "Should send the latest release once authenticated")
+	}
+
+	assert.NoError(t, h.UpdateRelease(&messages.Release{ID: "test_id_2"}), "Should be no error updating release")
+	if release := readRelease(t, r); release != nil {
+		assert.Equal(t, "test_id_2", release.ID, "Should send the updated release")
+	}
+
+	control.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Should stop once the control conn is closed")
+	}
+}
@@ -0,0 +1,171 @@
+package local
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+	"golang.org/x/net/websocket"
+)
+
+const remoteConnTimeout = 10 * time.Second
+
+// WebSocketHandler type represents the handler that runs the multiplexed TCP transport
+// over a websocket, so that the wormhole server can be reached through HTTPS-only proxies
+type WebSocketHandler struct {
+	*TCPHandler
+	wsConfig *websocket.Config
+	// proxy returns the proxy to reach the server through, see http.Transport.Proxy
+	proxy func(*http.Request) (*url.URL, error)
+}
+
+// NewWebSocketHandler returns a WebSocketHandler struct
+// The remote TLS config trusts the system root CAs and the optional TLSCert
+func NewWebSocketHandler(cfg *config.ClientConfig, release *messages.Release) (*WebSocketHandler, error) {
+	// TLS is established by the websocket dialer, before the HTTP upgrade
+	tcpCfg := *cfg
+	tcpCfg.Insecure = true
+	tcp, err := NewTCPHandler(&tcpCfg, release)
+	if err != nil {
+		return nil, err
+	}
+	tcp.mux = true
+	tcp.logger = cfg.Logger.WithFields(logrus.Fields{"prefix": "WebSocketHandler"})
+
+	scheme, origin := "wss", "https"
+	if cfg.Insecure {
+		scheme, origin = "ws", "http"
+	}
+	wsConfig, err := websocket.NewConfig(scheme+"://"+cfg.RemoteEndpoint+"/", origin+"://"+cfg.RemoteEndpoint+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.Insecure {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.TLSCert) != 0 {
+			ok := rootCAs.AppendCertsFromPEM(cfg.TLSCert)
+			if !ok {
+				return nil, fmt.Errorf("couldn't append a root CA")
+			}
+		}
+		tlsHost, _, err := net.SplitHostPort(cfg.RemoteEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		wsConfig.TlsConfig = &tls.Config{RootCAs: rootCAs, ServerName: tlsHost}
+	}
+
+	h := &WebSocketHandler{
+		TCPHandler: tcp,
+		wsConfig:   wsConfig,
+		proxy:      http.ProxyFromEnvironment,
+	}
+	tcp.dialControl = h.dial
+	return h, nil
+}
+
+// connects to wormhole server and upgrades the connection to a websocket
+func (s *WebSocketHandler) dial() (net.Conn, error) {
+	conn, err := s.dialRemote()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to establish TCP connection: %s", err.Error())
+	}
+
+	if s.wsConfig.TlsConfig != nil {
+		tlsConn := tls.Client(conn, s.wsConfig.TlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to establish TLS connection: %s", err.Error())
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(s.wsConfig, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to establish websocket connection: %s", err.Error())
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	s.logger.Info("Established websocket connection.")
+
+	return ws, nil
+}
+
+// dialRemote opens a TCP connection to the wormhole server, going through
+// the proxy set in the environment (HTTPS_PROXY, NO_PROXY) when there is one
+func (s *WebSocketHandler) dialRemote() (net.Conn, error) {
+	proxyURL, err := s.proxy(&http.Request{
+		URL: &url.URL{Scheme: "https", Host: s.RemoteEndpoint},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return net.DialTimeout("tcp", s.RemoteEndpoint, remoteConnTimeout)
+	}
+
+	proxyAddr := proxyURL.Host
+	if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyAddr, "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyAddr, "80")
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, remoteConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsHost, _, _ := net.SplitHostPort(proxyAddr)
+		conn = tls.Client(conn, &tls.Config{ServerName: tlsHost})
+	}
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: s.RemoteEndpoint},
+		Host:   s.RemoteEndpoint,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	conn.SetDeadline(time.Now().Add(remoteConnTimeout))
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the proxy doesn't send anything past its response before we start the
+	// TLS handshake, so it's safe to drop the reader
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect: %s", proxyURL.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.logger.Infof("Connected through proxy %s.", proxyURL.Host)
+	return conn, nil
+}
@@ -0,0 +1,174 @@
+package local
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+	wnet "github.com/superfly/wormhole/net"
+	"github.com/superfly/wormhole/remote"
+	"github.com/superfly/wormhole/session"
+)
+
+// ingressListenerFactory hands the ingress listeners of sessions over to the test
+type ingressListenerFactory struct {
+	listeners chan net.Listener
+}
+
+func (f *ingressListenerFactory) Close() error { return nil }
+
+func (f *ingressListenerFactory) Listener(args *wnet.ListenerFromFactoryArgs) (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f.listeners <- ln
+	return ln, nil
+}
+
+// newConnectProxy returns an HTTP proxy tunneling CONNECT requests to their target
+// The requests it got are sent to requests
+func newConnectProxy(requests chan<- *http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		requests <- r
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		wnet.CopyCloseIO(conn, target)
+	}))
+}
+
+func TestWebSocketHandlerThroughProxy(t *testing.T) {
+	for _, insecure := range []bool{false, true} {
+		name := "Test_wss"
+		if insecure {
+			name = "Test_ws"
+		}
+		t.Run(name, func(t *testing.T) {
+			testWebSocketHandlerThroughProxy(t, insecure)
+		})
+	}
+}
+
+func testWebSocketHandlerThroughProxy(t *testing.T, insecure bool) {
+	logger := logrus.New()
+
+	store := session.NewMemoryStore()
+	assert.NoError(t, store.AddToken("test_token", "test_backend"), "Should be no error adding token")
+	factory := &ingressListenerFactory{listeners: make(chan net.Listener, 1)}
+	server, err := remote.NewWebSocketHandler(&config.ServerConfig{
+		Config: config.Config{Logger: logger},
+		NodeID: "test_node",
+	}, session.NewRegistry(logger), store, factory)
+	assert.NoError(t, err, "Should be no error creating server handler")
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Should be no error listening")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// the shared port terminates TLS before handing conns over
+			if !insecure {
+				conn = tls.Server(conn, testTLSServerConfig)
+			}
+			go server.Serve(conn)
+		}
+	}()
+
+	requests := make(chan *http.Request, 1)
+	proxy := newConnectProxy(requests)
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err, "Should be no error parsing proxy URL")
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	h, err := NewWebSocketHandler(&config.ClientConfig{
+		Config: config.Config{
+			Logger:   logger,
+			Version:  "test_version",
+			TLSCert:  testTLSCACert,
+			Insecure: insecure,
+		},
+		Token:          "test_token",
+		LocalEndpoint:  httpTestServer.Listener.Addr().String(),
+		RemoteEndpoint: ln.Addr().String(),
+	}, &messages.Release{ID: "test_id"})
+	assert.NoError(t, err, "Should be no error creating client handler")
+	h.proxy = http.ProxyURL(proxyURL)
+
+	if insecure {
+		assert.Equal(t, "ws", h.wsConfig.Location.Scheme, "Insecure clients should upgrade plain HTTP")
+		assert.Nil(t, h.wsConfig.TlsConfig, "Insecure clients shouldn't use TLS")
+	} else {
+		assert.Equal(t, "wss", h.wsConfig.Location.Scheme, "Clients should upgrade HTTPS")
+		assert.NotNil(t, h.wsConfig.TlsConfig, "Clients should use TLS")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ListenAndServe()
+	}()
+
+	var ingress net.Listener
+	select {
+	case req := <-requests:
+		assert.Equal(t, ln.Addr().String(), req.Host, "Should CONNECT to the server")
+		auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+		assert.Equal(t, "Basic "+auth, req.Header.Get("Proxy-Authorization"), "Should authenticate with the proxy")
+	case err := <-done:
+		t.Fatalf("Handler stopped before connecting through the proxy: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Should connect through the proxy")
+	}
+	select {
+	case ingress = <-factory.listeners:
+	case err := <-done:
+		t.Fatalf("Handler stopped before the session started: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session should start listening")
+	}
+
+	conn, err := net.Dial("tcp", ingress.Addr().String())
+	assert.NoError(t, err, "Should be no error dialing ingress")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, err := http.NewRequest("GET", "http://"+ingress.Addr().String()+"/", nil)
+	assert.NoError(t, err, "Should be no error making request")
+	assert.NoError(t, req.Write(conn), "Should be no error writing request")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	assert.NoError(t, err, "Should be no error reading response")
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "Should be no error reading body")
+	assert.Equal(t, testBody, string(body), "Ingress should be proxied to the local endpoint")
+
+	h.Close()
+}
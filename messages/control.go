@@ -11,6 +11,10 @@ import (
 
 //messages sent directly over the control conn
 
+// Preface holds the leading bytes of every packed message (the Envelope header)
+// It lets the server recognise wormhole connections which aren't wrapped in TLS
+var Preface = []byte{0x82, 0xa4, 0x54, 0x79, 0x70, 0x65}
+
 // MessageType is an encoding for the underlying payload
 type MessageType int
 
@@ -24,6 +28,7 @@ const (
 	MsgPong
 	MsgShutdown
 	MsgRelease
+	MsgAuthResult
 
 	// insert new messagess above me
 	msgEnd // for automated test generation
@@ -45,6 +50,8 @@ func typeToMessage(mt MessageType) Message {
 		return &Shutdown{}
 	case MsgRelease:
 		return &Release{}
+	case MsgAuthResult:
+		return &AuthResult{}
 	default:
 		return nil
 	}
@@ -66,6 +73,8 @@ func messageToType(m Message) MessageType {
 		return MsgShutdown
 	case *Release:
 		return MsgRelease
+	case *AuthResult:
+		return MsgAuthResult
 	default:
 		return MsgUnsupported
 	}
@@ -87,8 +96,12 @@ type Envelope struct {
 }
 
 // AuthControl is sent by the client to create and authenticate a new session
+// Mux indicates that tunnels should be multiplexed as streams over the control connection
+// ResumeToken is the token issued for the previous session of the client, if any
 type AuthControl struct {
-	Token string `msg:"token"`
+	Token       string `msg:"token"`
+	Mux         bool   `msg:"mux"`
+	ResumeToken string `msg:"resume_token"`
 }
 
 // AuthTunnel is sent by the client to create and authenticate a tunnel connection
@@ -97,6 +110,73 @@ type AuthTunnel struct {
 	Token    string `msg:"token"`
 }
 
+// AuthErrorCode tells why the server rejected an AuthControl or AuthTunnel message
+type AuthErrorCode int
+
+// definitions of authentication error codes
+const (
+	AuthOK AuthErrorCode = iota
+	AuthInvalidToken
+	AuthUnknownSession
+	AuthServerError
+)
+
+func (c AuthErrorCode) String() string {
+	switch c {
+	case AuthOK:
+		return "ok"
+	case AuthInvalidToken:
+		return "invalid token"
+	case AuthUnknownSession:
+		return "unknown session"
+	case AuthServerError:
+		return "server error"
+	default:
+		return fmt.Sprintf("unknown code %d", int(c))
+	}
+}
+
+// AuthResult is sent by the server in response to AuthControl and AuthTunnel
+// On success it carries the session ID, the endpoints assigned to the session and
+// the token to present to resume the session after reconnecting,
+// otherwise Code and Error describe why the client was rejected
+// TunnelAuth tells the client that tunnel conns are acknowledged with an AuthResult as well,
+// servers predating it start using them right after the AuthTunnel message
+type AuthResult struct {
+	SessionID   string        `msg:"session_id"`
+	Endpoints   []string      `msg:"endpoints"`
+	ResumeToken string        `msg:"resume_token"`
+	Code        AuthErrorCode `msg:"code"`
+	Error       string        `msg:"error"`
+	TunnelAuth  bool          `msg:"tunnel_auth"`
+}
+
+// Err returns the error reported by the server or nil if the client was authenticated
+func (r *AuthResult) Err() error {
+	if r.Code == AuthOK {
+		return nil
+	}
+	return &AuthError{Code: r.Code, Message: r.Error}
+}
+
+// AuthError is returned by AuthResult.Err when the server rejected the client
+type AuthError struct {
+	Code    AuthErrorCode
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("authentication failed: %s", e.Code)
+	}
+	return fmt.Sprintf("authentication failed: %s: %s", e.Code, e.Message)
+}
+
+// Temporary reports whether authenticating again may succeed
+func (e *AuthError) Temporary() bool {
+	return e.Code != AuthInvalidToken
+}
+
 // OpenTunnel is sent by server to the client to request a new Tunnel connection
 type OpenTunnel struct {
 	ClientID string `msg:"client_id"`
@@ -109,7 +189,11 @@ type Shutdown struct {
 }
 
 // Ping is sent to request a Pong response and check the liveness of the connection
-type Ping struct{}
+type Ping struct {
+	// RTT is the round trip time of the previous Ping in nanoseconds, as measured by the client
+	// It's 0 if the previous Ping wasn't answered
+	RTT int64 `msg:"rtt"`
+}
 
 // Pong is a response ot the Ping message
 type Pong struct{}
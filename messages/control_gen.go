@@ -29,6 +29,16 @@ func (z *AuthControl) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "Mux":
+			z.Mux, err = dc.ReadBool()
+			if err != nil {
+				return
+			}
+		case "ResumeToken":
+			z.ResumeToken, err = dc.ReadString()
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -41,9 +51,9 @@ func (z *AuthControl) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z AuthControl) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 1
+	// map header, size 3
 	// write "Token"
-	err = en.Append(0x81, 0xa5, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	err = en.Append(0x83, 0xa5, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
 	if err != nil {
 		return
 	}
@@ -51,16 +61,40 @@ func (z AuthControl) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "Mux"
+	err = en.Append(0xa3, 0x4d, 0x75, 0x78)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Mux)
+	if err != nil {
+		return
+	}
+	// write "ResumeToken"
+	err = en.Append(0xab, 0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ResumeToken)
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z AuthControl) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 1
+	// map header, size 3
 	// string "Token"
-	o = append(o, 0x81, 0xa5, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	o = append(o, 0x83, 0xa5, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
 	o = msgp.AppendString(o, z.Token)
+	// string "Mux"
+	o = append(o, 0xa3, 0x4d, 0x75, 0x78)
+	o = msgp.AppendBool(o, z.Mux)
+	// string "ResumeToken"
+	o = append(o, 0xab, 0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	o = msgp.AppendString(o, z.ResumeToken)
 	return
 }
 
@@ -85,6 +119,16 @@ func (z *AuthControl) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			if err != nil {
 				return
 			}
+		case "Mux":
+			z.Mux, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				return
+			}
+		case "ResumeToken":
+			z.ResumeToken, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -98,7 +142,305 @@ func (z *AuthControl) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z AuthControl) Msgsize() (s int) {
-	s = 1 + 6 + msgp.StringPrefixSize + len(z.Token)
+	s = 1 + 6 + msgp.StringPrefixSize + len(z.Token) + 4 + msgp.BoolSize + 12 + msgp.StringPrefixSize + len(z.ResumeToken)
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *AuthErrorCode) DecodeMsg(dc *msgp.Reader) (err error) {
+	{
+		var zb0001 int
+		zb0001, err = dc.ReadInt()
+		if err != nil {
+			return
+		}
+		(*z) = AuthErrorCode(zb0001)
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z AuthErrorCode) EncodeMsg(en *msgp.Writer) (err error) {
+	err = en.WriteInt(int(z))
+	if err != nil {
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z AuthErrorCode) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	o = msgp.AppendInt(o, int(z))
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *AuthErrorCode) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	{
+		var zb0001 int
+		zb0001, bts, err = msgp.ReadIntBytes(bts)
+		if err != nil {
+			return
+		}
+		(*z) = AuthErrorCode(zb0001)
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z AuthErrorCode) Msgsize() (s int) {
+	s = msgp.IntSize
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+func (z *AuthResult) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "SessionID":
+			z.SessionID, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "Endpoints":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				return
+			}
+			if cap(z.Endpoints) >= int(zb0002) {
+				z.Endpoints = (z.Endpoints)[:zb0002]
+			} else {
+				z.Endpoints = make([]string, zb0002)
+			}
+			for za0001 := range z.Endpoints {
+				z.Endpoints[za0001], err = dc.ReadString()
+				if err != nil {
+					return
+				}
+			}
+		case "ResumeToken":
+			z.ResumeToken, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "Code":
+			{
+				var zb0003 int
+				zb0003, err = dc.ReadInt()
+				if err != nil {
+					return
+				}
+				z.Code = AuthErrorCode(zb0003)
+			}
+		case "Error":
+			z.Error, err = dc.ReadString()
+			if err != nil {
+				return
+			}
+		case "TunnelAuth":
+			z.TunnelAuth, err = dc.ReadBool()
+			if err != nil {
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *AuthResult) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 6
+	// write "SessionID"
+	err = en.Append(0x86, 0xa9, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x44)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.SessionID)
+	if err != nil {
+		return
+	}
+	// write "Endpoints"
+	err = en.Append(0xa9, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Endpoints)))
+	if err != nil {
+		return
+	}
+	for za0001 := range z.Endpoints {
+		err = en.WriteString(z.Endpoints[za0001])
+		if err != nil {
+			return
+		}
+	}
+	// write "ResumeToken"
+	err = en.Append(0xab, 0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ResumeToken)
+	if err != nil {
+		return
+	}
+	// write "Code"
+	err = en.Append(0xa4, 0x43, 0x6f, 0x64, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt(int(z.Code))
+	if err != nil {
+		return
+	}
+	// write "Error"
+	err = en.Append(0xa5, 0x45, 0x72, 0x72, 0x6f, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Error)
+	if err != nil {
+		return
+	}
+	// write "TunnelAuth"
+	err = en.Append(0xaa, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x41, 0x75, 0x74, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.TunnelAuth)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *AuthResult) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 6
+	// string "SessionID"
+	o = append(o, 0x86, 0xa9, 0x53, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x44)
+	o = msgp.AppendString(o, z.SessionID)
+	// string "Endpoints"
+	o = append(o, 0xa9, 0x45, 0x6e, 0x64, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Endpoints)))
+	for za0001 := range z.Endpoints {
+		o = msgp.AppendString(o, z.Endpoints[za0001])
+	}
+	// string "ResumeToken"
+	o = append(o, 0xab, 0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x54, 0x6f, 0x6b, 0x65, 0x6e)
+	o = msgp.AppendString(o, z.ResumeToken)
+	// string "Code"
+	o = append(o, 0xa4, 0x43, 0x6f, 0x64, 0x65)
+	o = msgp.AppendInt(o, int(z.Code))
+	// string "Error"
+	o = append(o, 0xa5, 0x45, 0x72, 0x72, 0x6f, 0x72)
+	o = msgp.AppendString(o, z.Error)
+	// string "TunnelAuth"
+	o = append(o, 0xaa, 0x54, 0x75, 0x6e, 0x6e, 0x65, 0x6c, 0x41, 0x75, 0x74, 0x68)
+	o = msgp.AppendBool(o, z.TunnelAuth)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *AuthResult) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "SessionID":
+			z.SessionID, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "Endpoints":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				return
+			}
+			if cap(z.Endpoints) >= int(zb0002) {
+				z.Endpoints = (z.Endpoints)[:zb0002]
+			} else {
+				z.Endpoints = make([]string, zb0002)
+			}
+			for za0001 := range z.Endpoints {
+				z.Endpoints[za0001], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					return
+				}
+			}
+		case "ResumeToken":
+			z.ResumeToken, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "Code":
+			{
+				var zb0003 int
+				zb0003, bts, err = msgp.ReadIntBytes(bts)
+				if err != nil {
+					return
+				}
+				z.Code = AuthErrorCode(zb0003)
+			}
+		case "Error":
+			z.Error, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				return
+			}
+		case "TunnelAuth":
+			z.TunnelAuth, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *AuthResult) Msgsize() (s int) {
+	s = 1 + 10 + msgp.StringPrefixSize + len(z.SessionID) + 10 + msgp.ArrayHeaderSize
+	for za0001 := range z.Endpoints {
+		s += msgp.StringPrefixSize + len(z.Endpoints[za0001])
+	}
+	s += 12 + msgp.StringPrefixSize + len(z.ResumeToken) + 5 + msgp.IntSize + 6 + msgp.StringPrefixSize + len(z.Error) + 11 + msgp.BoolSize
 	return
 }
 
@@ -504,6 +846,11 @@ func (z *Ping) DecodeMsg(dc *msgp.Reader) (err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
+		case "RTT":
+			z.RTT, err = dc.ReadInt64()
+			if err != nil {
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -516,8 +863,13 @@ func (z *Ping) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z Ping) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 0
-	err = en.Append(0x80)
+	// map header, size 1
+	// write "RTT"
+	err = en.Append(0x81, 0xa3, 0x52, 0x54, 0x54)
+	if err != nil {
+		return
+	}
+	err = en.WriteInt64(z.RTT)
 	if err != nil {
 		return
 	}
@@ -527,8 +879,10 @@ func (z Ping) EncodeMsg(en *msgp.Writer) (err error) {
 // MarshalMsg implements msgp.Marshaler
 func (z Ping) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 0
-	o = append(o, 0x80)
+	// map header, size 1
+	// string "RTT"
+	o = append(o, 0x81, 0xa3, 0x52, 0x54, 0x54)
+	o = msgp.AppendInt64(o, z.RTT)
 	return
 }
 
@@ -548,6 +902,11 @@ func (z *Ping) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			return
 		}
 		switch msgp.UnsafeString(field) {
+		case "RTT":
+			z.RTT, bts, err = msgp.ReadInt64Bytes(bts)
+			if err != nil {
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -561,7 +920,7 @@ func (z *Ping) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z Ping) Msgsize() (s int) {
-	s = 1
+	s = 1 + 4 + msgp.Int64Size
 	return
 }
 
@@ -0,0 +1,65 @@
+package messages
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPackStartsWithPreface(t *testing.T) {
+	for mt := MsgUnsupported + 1; mt < msgEnd; mt++ {
+		b, err := Pack(typeToMessage(mt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, Preface) {
+			t.Errorf("packed message type %d doesn't start with the preface", mt)
+		}
+	}
+}
+
+func TestAuthResultErr(t *testing.T) {
+	if err := (&AuthResult{SessionID: "1"}).Err(); err != nil {
+		t.Errorf("expected no error for a successful result, got %s", err)
+	}
+
+	err := (&AuthResult{Code: AuthInvalidToken, Error: "bad token"}).Err()
+	authErr, ok := err.(*AuthError)
+	if !ok {
+		t.Fatalf("expected an *AuthError, got %T", err)
+	}
+	if authErr.Temporary() {
+		t.Error("invalid token errors shouldn't be temporary")
+	}
+
+	err = (&AuthResult{Code: AuthServerError}).Err()
+	if authErr, ok := err.(*AuthError); !ok || !authErr.Temporary() {
+		t.Error("server errors should be temporary")
+	}
+}
+
+func TestPackUnpackAuthMessages(t *testing.T) {
+	sent := []Message{
+		&AuthControl{Token: "token", Mux: true, ResumeToken: "resume"},
+		&AuthResult{
+			SessionID:   "id",
+			Endpoints:   []string{"a:1", "b:2"},
+			ResumeToken: "resume",
+			Code:        AuthServerError,
+			Error:       "error",
+		},
+	}
+	for _, m := range sent {
+		b, err := Pack(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Unpack(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("expected %+v, got %+v", m, got)
+		}
+	}
+}
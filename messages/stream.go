@@ -0,0 +1,131 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// MaxMessageSize is the largest encoded message read or written by a stream
+// It bounds what a peer can have buffered before it authenticates
+const MaxMessageSize = 64 << 10
+
+// ErrMessageTooLarge is returned for messages exceeding MaxMessageSize
+var ErrMessageTooLarge = errors.New("message exceeds the maximum size")
+
+// Reader decodes messages from a stream
+// msgpack objects are self-delimiting, so messages are read one by one regardless
+// of how they were split or coalesced by the underlying transport
+type Reader struct {
+	r *msgp.Reader
+}
+
+// NewReader returns a Reader decoding messages from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: msgp.NewReader(r)}
+}
+
+// ReadMessage reads the next message from the stream
+func (r *Reader) ReadMessage() (Message, error) {
+	b, err := r.peekEnvelope()
+	if err != nil {
+		return nil, err
+	}
+	var env Envelope
+	if _, err := env.UnmarshalMsg(b); err != nil {
+		return nil, err
+	}
+	if _, err := r.r.R.Skip(len(b)); err != nil {
+		return nil, err
+	}
+
+	msg := typeToMessage(env.Type)
+	if msg == nil {
+		return nil, fmt.Errorf("Unsupported message type %d", env.Type)
+	}
+	if _, err := msg.UnmarshalMsg(env.Payload); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// peekEnvelope buffers the stream until it holds a whole envelope and returns it
+// Decoding straight from the stream would allocate whatever lengths the peer declares,
+// while msgp.Skip only walks the buffered bytes
+func (r *Reader) peekEnvelope() ([]byte, error) {
+	n := 1
+	for {
+		// check what's buffered before waiting for more, the peer may be waiting for us
+		if buffered := r.r.R.Buffered(); buffered > n {
+			n = buffered
+		}
+		b, err := r.r.R.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		rest, err := msgp.Skip(b)
+		if err == nil {
+			return b[:len(b)-len(rest)], nil
+		} else if err != msgp.ErrShortBytes {
+			return nil, err
+		}
+		if len(b) >= MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		n = len(b) + 1
+	}
+}
+
+// Read implements io.Reader. It returns data buffered past the last message first,
+// so the stream can be handed over once the messages exchange is done.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// Buffered returns the number of bytes read from the stream past the last message
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// Writer encodes messages to a stream
+// It is safe for concurrent use
+type Writer struct {
+	mu sync.Mutex
+	w  *msgp.Writer
+}
+
+// NewWriter returns a Writer encoding messages to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: msgp.NewWriter(w)}
+}
+
+// WriteMessage writes a message to the stream and flushes it
+func (w *Writer) WriteMessage(m Message) error {
+	mType := messageToType(m)
+	if mType == MsgUnsupported {
+		return fmt.Errorf("Unsupported message type")
+	}
+
+	raw, err := m.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	env := &Envelope{
+		Type:    mType,
+		Payload: raw,
+	}
+	if env.Msgsize() > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := env.EncodeMsg(w.w); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,100 @@
+package messages
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestReaderCoalescedMessages(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	release := &Release{
+		ID:                 "1",
+		VCSRevisionMessage: strings.Repeat("a", 2048),
+	}
+	sent := []Message{&AuthControl{Token: "token"}, release, &Ping{}}
+	for _, m := range sent {
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.WriteString("trailing")
+
+	// deliver the stream one byte at a time to make sure messages are reassembled
+	r := NewReader(iotest.OneByteReader(&buf))
+	for _, want := range sent {
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageToType(got) != messageToType(want) {
+			t.Fatalf("expected message type %d, got %d", messageToType(want), messageToType(got))
+		}
+	}
+
+	rest := make([]byte, len("trailing"))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "trailing" {
+		t.Errorf("expected data after the last message to be readable, got %q", rest)
+	}
+}
+
+func TestReaderLargeRelease(t *testing.T) {
+	var buf bytes.Buffer
+	release := &Release{
+		ID:                 "1",
+		VCSRevisionMessage: strings.Repeat("a", 4096),
+	}
+	if err := NewWriter(&buf).WriteMessage(release); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := NewReader(&buf).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := msg.(*Release)
+	if !ok {
+		t.Fatalf("expected a Release, got %T", msg)
+	}
+	if got.VCSRevisionMessage != release.VCSRevisionMessage {
+		t.Error("Release message was truncated")
+	}
+}
+
+func TestReaderMessageTooLarge(t *testing.T) {
+	// an envelope declaring a payload of 1GB, followed by more data than MaxMessageSize
+	b := msgp.AppendMapHeader(nil, 2)
+	b = msgp.AppendString(b, "Type")
+	b = msgp.AppendInt(b, int(MsgRelease))
+	b = msgp.AppendString(b, "Payload")
+	b = append(b, 0xc6, 0x40, 0x00, 0x00, 0x00) // bin 32 header
+	stream := io.MultiReader(bytes.NewReader(b), io.LimitReader(zeroReader{}, 2*MaxMessageSize))
+
+	if _, err := NewReader(stream).ReadMessage(); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	release := &Release{ID: "1", VCSRevisionMessage: strings.Repeat("a", MaxMessageSize)}
+	if err := NewWriter(ioutil.Discard).WriteMessage(release); err != ErrMessageTooLarge {
+		t.Fatalf("expected writing ErrMessageTooLarge, got %v", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,52 @@
+package net
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// BufferedReader is a reader which may hold data read ahead from the underlying conn
+type BufferedReader interface {
+	io.Reader
+	Buffered() int
+}
+
+// bufferedConn is a net.Conn reading through the BufferedReader wrapping it
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connectionStater is implemented by *tls.Conn
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// bufferedTLSConn is a bufferedConn keeping the TLS state of the conn, which the http2
+// package checks on the conns it serves
+type bufferedTLSConn struct {
+	bufferedConn
+	cs connectionStater
+}
+
+func (c *bufferedTLSConn) ConnectionState() tls.ConnectionState {
+	return c.cs.ConnectionState()
+}
+
+// NewBufferedConn returns a net.Conn which returns the data already buffered by r
+// before reading from conn. conn is returned as is when r holds no data.
+// r must be reading from conn.
+func NewBufferedConn(conn net.Conn, r BufferedReader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	if cs, ok := conn.(connectionStater); ok {
+		return &bufferedTLSConn{bufferedConn: bufferedConn{Conn: conn, r: r}, cs: cs}
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
@@ -2,6 +2,7 @@ package net
 
 import (
 	"container/heap"
+	"context"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"sync"
@@ -28,6 +29,9 @@ type ConnPoolObjectCanMux interface {
 	Value() <-chan int
 }
 
+// ErrConnPoolClosed is returned when getting from or inserting into a closed ConnPool
+var ErrConnPoolClosed = errors.New("connection pool is closed")
+
 // ConnPoolContext is what a ConnPool returns from a Get
 type ConnPoolContext interface {
 	ConnPoolObject() ConnPoolObject
@@ -46,7 +50,11 @@ type connNode struct {
 	obj ConnPoolObject
 
 	numberUsers int64
-	loopback    chan<- *connNode
+	// inUse counts the Gets of the node which aren't Done yet
+	inUse    int64
+	loopback chan<- *connNode
+	// done is closed with the pool, nodes aren't looped back anymore
+	done <-chan struct{}
 
 	// only for use if obj is ConnPoolObjectCanMux
 	index int
@@ -72,8 +80,15 @@ func (cn *connNode) NumberOfUsers() int64 {
 }
 
 func (cn *connNode) Done() {
+	atomic.AddInt64(&cn.inUse, -1)
 	cn.decrementUsers()
-	cn.loopback <- cn
+	if atomic.LoadUint32(&cn.deleted) == 1 {
+		return
+	}
+	select {
+	case cn.loopback <- cn:
+	case <-cn.done:
+	}
 }
 
 // ConnPool is a fast concurrency safe connection pool structure
@@ -81,7 +96,29 @@ type ConnPool interface {
 	// Insert returns a no error false case only when we try to insert
 	// beyond our max connections limit
 	Insert(ConnPoolObject) (bool, error)
+	// Get blocks until an object is available, it returns nil once the pool is closed
 	Get() ConnPoolContext
+	// GetContext is Get returning ctx.Err() once ctx is done, or ErrConnPoolClosed
+	GetContext(ctx context.Context) (ConnPoolContext, error)
+	// Remove deletes an object from the pool and closes it
+	// It returns false if the object isn't in the pool
+	Remove(ConnPoolObject) (bool, error)
+	// Close closes all objects of the pool and stops its goroutines
+	Close() error
+	// Stats returns a snapshot of the objects in the pool
+	Stats() ConnPoolStats
+}
+
+// ConnPoolStats is a snapshot of the objects in a ConnPool
+type ConnPoolStats struct {
+	// Size is the number of objects in the pool
+	Size int
+	// Idle objects aren't held by anyone
+	Idle int
+	// InUse objects were returned by a Get which isn't Done yet
+	InUse int
+	// MuxedLoad adds up the values of ConnPoolObjectCanMux objects, e.g. their streams
+	MuxedLoad int
 }
 
 // connPool is designed to be a speedy connection pool
@@ -97,6 +134,12 @@ type connPool struct {
 	noActivityConnCh chan *connNode
 	loopbackConnCh   chan *connNode
 
+	// mu protects nodes and serializes inserts, deletes and closing
+	mu     sync.Mutex
+	nodes  map[ConnPoolObject]*connNode
+	closed bool
+	done   chan struct{}
+
 	muxHeap            muxableConnHeap
 	muxHeapEmptyMutex  sync.RWMutex // protects from reading 0 index
 	muxHeapChangeMutex sync.Mutex
@@ -132,12 +175,20 @@ func (mh *muxableConnHeap) Pop() interface{} {
 	return cn
 }
 
-func (pool *connPool) getMuxableConn() <-chan ConnPoolContext {
-	cc := make(chan ConnPoolContext)
+// getMuxableConn returns the least loaded muxable conn, once there's one
+// It's buffered so that the goroutine doesn't leak if the caller gets another conn,
+// and it gets nil if the pool is closed in the meantime
+func (pool *connPool) getMuxableConn() <-chan *connNode {
+	cc := make(chan *connNode, 1)
 
-	go func(cc chan<- ConnPoolContext) {
+	go func(cc chan<- *connNode) {
 		pool.muxHeapEmptyMutex.RLock()
-		cn := pool.muxHeap[0]
+		pool.muxHeapChangeMutex.Lock()
+		var cn *connNode
+		if len(pool.muxHeap) > 0 {
+			cn = pool.muxHeap[0]
+		}
+		pool.muxHeapChangeMutex.Unlock()
 		pool.muxHeapEmptyMutex.RUnlock()
 		cc <- cn
 	}(cc)
@@ -175,6 +226,8 @@ func NewConnPool(logger *logrus.Entry, maxConns int64, initialConns []ConnPoolOb
 		delConnCh:        make(chan *connNode, maxConns),
 		noActivityConnCh: make(chan *connNode, maxConns),
 		loopbackConnCh:   make(chan *connNode, maxConns),
+		nodes:            make(map[ConnPoolObject]*connNode),
+		done:             make(chan struct{}),
 	}
 	pool.muxHeapEmptyMutex.Lock()
 
@@ -190,39 +243,53 @@ func NewConnPool(logger *logrus.Entry, maxConns int64, initialConns []ConnPoolOb
 
 	go pool.handleLoopback()
 	go pool.delLoop()
+	registerConnPool(pool)
 	return pool, nil
 }
 
 func (pool *connPool) delLoop() {
 	for {
-		delConn := <-pool.delConnCh
-		// spawn a new goroutine even though
-		// delExistingConn immediately locks the pool
-		// because the go runtime does clever things to organize
-		// the goroutine mapping to help unlock as often as possible
-		go pool.delExistingConn(delConn)
+		select {
+		case delConn := <-pool.delConnCh:
+			// spawn a new goroutine even though
+			// delExistingConn immediately locks the pool
+			// because the go runtime does clever things to organize
+			// the goroutine mapping to help unlock as often as possible
+			go pool.delExistingConn(delConn)
+		case <-pool.done:
+			return
+		}
 	}
 }
 
 // delExistingConn deletes an connNode from the pool
 // the node MUST be in the list currently or be deleted
 // NOTE: this is only to be called from the delete chan loop
-// NOTE: this only really does anything when a node is muxable
 func (pool *connPool) delExistingConn(hc *connNode) {
-	// we only need to delete the conn if it was muxable
-	// otherwise it simply isn't round tripped from the loopback
-	// and is garbage collected
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !pool.deleteNode(hc) {
+		pool.logger.Info("Caught multiple delete request")
+	}
+}
+
+// deleteNode removes a node from the pool, it returns false if it was deleted already
+// pool.mu must be held
+func (pool *connPool) deleteNode(hc *connNode) bool {
+	if !atomic.CompareAndSwapUint32(&hc.deleted, 0, 1) {
+		return false
+	}
+	delete(pool.nodes, hc.obj)
+
+	// non muxable conns simply aren't round tripped from the loopback
+	// and are garbage collected
 	if _, ok := hc.obj.(ConnPoolObjectCanMux); ok {
-		alreadyDeleted := !atomic.CompareAndSwapUint32(&hc.deleted, 0, 1)
-		if alreadyDeleted {
-			pool.logger.Info("Caught multiple delete request")
-			return
-		}
 		pool.deleteMuxableConn(hc)
 	}
 
 	// whether muxable or not we need to decrement the number of total conns
 	atomic.AddInt64(&pool.numConns, -1)
+	return true
 }
 
 // Insert adds a new conn to the end of the circulary linked list
@@ -237,12 +304,11 @@ func (pool *connPool) Insert(obj ConnPoolObject) (bool, error) {
 	newConn := &connNode{
 		obj:      obj,
 		loopback: pool.loopbackConnCh,
+		done:     pool.done,
 	}
 
-	newConn.incrementUsers()
-	pool.noActivityConnCh <- newConn
-
-	if mc, ok := obj.(ConnPoolObjectCanMux); ok {
+	mc, muxable := obj.(ConnPoolObjectCanMux)
+	if muxable {
 		// hack to get first value
 		valC := make(chan int)
 		go func(valC chan<- int, mc ConnPoolObjectCanMux) {
@@ -250,61 +316,199 @@ func (pool *connPool) Insert(obj ConnPoolObject) (bool, error) {
 			valC <- val
 		}(valC, mc)
 		newConn.value = <-valC
+	}
 
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		atomic.AddInt64(&pool.numConns, -1)
+		return false, ErrConnPoolClosed
+	}
+	pool.nodes[obj] = newConn
+	if muxable {
 		pool.addMuxableConn(newConn)
 		go pool.handleRevalue(newConn)
 	}
+	pool.mu.Unlock()
+
+	newConn.incrementUsers()
+	pool.noActivityConnCh <- newConn
 
 	return true, nil
 }
 
 func (pool *connPool) handleRevalue(c *connNode) error {
-	if mc, ok := c.obj.(ConnPoolObjectCanMux); ok {
-		for val := range mc.Value() {
+	mc, ok := c.obj.(ConnPoolObjectCanMux)
+	if !ok {
+		return errors.New("connNode does not represent a muxable conn")
+	}
+
+	for {
+		select {
+		case val := <-mc.Value():
 			pool.muxHeapChangeMutex.Lock()
+			// a deleted node isn't in the heap anymore
+			if atomic.LoadUint32(&c.deleted) == 1 {
+				pool.muxHeapChangeMutex.Unlock()
+				return nil
+			}
 			c.value = val
 			heap.Fix(&pool.muxHeap, c.index)
 			pool.muxHeapChangeMutex.Unlock()
+		case <-pool.done:
+			return nil
 		}
-	} else {
-		return errors.New("connNode does not represent a muxable conn")
 	}
-
-	return nil
 }
 
 // populateAvailable is a run loop which constantly updates the channel of
 // non-active connections to be used
 func (pool *connPool) handleLoopback() {
-	for c := range pool.loopbackConnCh {
+	for {
+		var c *connNode
+		select {
+		case c = <-pool.loopbackConnCh:
+		case <-pool.done:
+			return
+		}
+
 		go func(c *connNode) {
 			if c.obj.ShouldDelete() {
-				pool.delConnCh <- c
+				select {
+				case pool.delConnCh <- c:
+				case <-pool.done:
+				}
 				return
 			}
 
 			if ok := atomic.CompareAndSwapInt64(&c.numberUsers, 0, 1); ok {
-				pool.noActivityConnCh <- c
+				select {
+				case pool.noActivityConnCh <- c:
+				case <-pool.done:
+				}
 			}
 		}(c)
 	}
 }
 
-// Get returns a ConnPoolObject
-// TODO: Allow set timeout
+// Get returns a ConnPoolObject, blocking until one is available
+// It returns nil once the pool is closed
 func (pool *connPool) Get() ConnPoolContext {
+	conn, err := pool.GetContext(context.Background())
+	if err != nil {
+		return nil
+	}
+	return conn
+}
+
+// GetContext returns a ConnPoolObject, or an error if ctx is done or the pool closed
+// before one is available
+func (pool *connPool) GetContext(ctx context.Context) (ConnPoolContext, error) {
+	for {
+		conn, err := pool.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// removed objects may still be queued
+		if atomic.LoadUint32(&conn.deleted) == 1 {
+			continue
+		}
+		atomic.AddInt64(&conn.inUse, 1)
+		return conn, nil
+	}
+}
+
+func (pool *connPool) next(ctx context.Context) (*connNode, error) {
 	// since select chooses a chan at random when both are populated we want
 	// to prioritize the noActicityConnCh first
 	select {
 	case conn := <-pool.noActivityConnCh:
-		return conn
+		return conn, nil
 	default:
 	}
 
 	select {
 	case conn := <-pool.noActivityConnCh:
-		return conn
+		return conn, nil
 	case conn := <-pool.getMuxableConn():
-		return conn
+		if conn == nil {
+			return nil, ErrConnPoolClosed
+		}
+		return conn, nil
+	case <-pool.done:
+		return nil, ErrConnPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Remove deletes an object from the pool and closes it
+func (pool *connPool) Remove(obj ConnPoolObject) (bool, error) {
+	pool.mu.Lock()
+	hc, ok := pool.nodes[obj]
+	if ok {
+		ok = pool.deleteNode(hc)
+	}
+	pool.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, obj.Close()
+}
+
+// Close closes all objects of the pool and stops its goroutines
+// It returns the first error closing an object
+func (pool *connPool) Close() error {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return nil
+	}
+	pool.closed = true
+	close(pool.done)
+	nodes := pool.nodes
+	pool.nodes = make(map[ConnPoolObject]*connNode)
+	for _, hc := range nodes {
+		atomic.StoreUint32(&hc.deleted, 1)
+	}
+	pool.muxHeapChangeMutex.Lock()
+	pool.muxHeap = nil
+	pool.muxHeapChangeMutex.Unlock()
+	// the heap is locked while empty, waiting getMuxableConn goroutines now get nil
+	if atomic.SwapInt64(&pool.numMuxableConns, 0) == 0 {
+		pool.muxHeapEmptyMutex.Unlock()
+	}
+	pool.mu.Unlock()
+
+	unregisterConnPool(pool)
+
+	var err error
+	for obj := range nodes {
+		if closeErr := obj.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
+
+// Stats returns a snapshot of the objects in the pool
+func (pool *connPool) Stats() ConnPoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	stats := ConnPoolStats{Size: len(pool.nodes)}
+	for _, hc := range pool.nodes {
+		if atomic.LoadInt64(&hc.inUse) > 0 {
+			stats.InUse++
+		}
+	}
+	stats.Idle = stats.Size - stats.InUse
+
+	pool.muxHeapChangeMutex.Lock()
+	for _, hc := range pool.muxHeap {
+		stats.MuxedLoad += hc.value
+	}
+	pool.muxHeapChangeMutex.Unlock()
+	return stats
 }
@@ -0,0 +1,89 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connPoolSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("wormhole", "net", "conn_pool_size"),
+		"Number of objects in open connection pools.",
+		nil, nil)
+
+	connPoolIdleDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("wormhole", "net", "conn_pool_idle"),
+		"Number of objects of open connection pools which aren't in use.",
+		nil, nil)
+
+	connPoolInUseDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("wormhole", "net", "conn_pool_in_use"),
+		"Number of objects of open connection pools which are in use.",
+		nil, nil)
+
+	connPoolMuxedLoadDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("wormhole", "net", "conn_pool_muxed_load"),
+		"Load of the muxable objects of open connection pools (e.g. HTTP2 streams).",
+		nil, nil)
+)
+
+// openConnPools are the pools whose stats are reported, until they're closed
+var openConnPools = struct {
+	sync.Mutex
+	pools map[ConnPool]struct{}
+}{pools: make(map[ConnPool]struct{})}
+
+func init() {
+	prometheus.MustRegister(connPoolCollector{})
+}
+
+func registerConnPool(pool ConnPool) {
+	openConnPools.Lock()
+	openConnPools.pools[pool] = struct{}{}
+	openConnPools.Unlock()
+}
+
+func unregisterConnPool(pool ConnPool) {
+	openConnPools.Lock()
+	delete(openConnPools.pools, pool)
+	openConnPools.Unlock()
+}
+
+// connPoolCollector exports the stats of all open pools, added up, as gauges
+type connPoolCollector struct{}
+
+func (connPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connPoolSizeDesc
+	ch <- connPoolIdleDesc
+	ch <- connPoolInUseDesc
+	ch <- connPoolMuxedLoadDesc
+}
+
+func (connPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := openConnPoolStats()
+	ch <- prometheus.MustNewConstMetric(connPoolSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+	ch <- prometheus.MustNewConstMetric(connPoolIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(connPoolInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(connPoolMuxedLoadDesc, prometheus.GaugeValue, float64(stats.MuxedLoad))
+}
+
+// openConnPoolStats adds up the stats of all open pools
+func openConnPoolStats() ConnPoolStats {
+	openConnPools.Lock()
+	pools := make([]ConnPool, 0, len(openConnPools.pools))
+	for pool := range openConnPools.pools {
+		pools = append(pools, pool)
+	}
+	openConnPools.Unlock()
+
+	var total ConnPoolStats
+	for _, pool := range pools {
+		stats := pool.Stats()
+		total.Size += stats.Size
+		total.Idle += stats.Idle
+		total.InUse += stats.InUse
+		total.MuxedLoad += stats.MuxedLoad
+	}
+	return total
+}
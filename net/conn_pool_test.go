@@ -1,24 +1,44 @@
 package net
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"sync"
 	_ "sync/atomic"
 	"testing"
-	_ "time"
+	"time"
 	_ "unsafe"
 )
 
 type testConnPoolObj struct {
 	canContinue bool
+	closed      bool
 	sync.Mutex
 }
 
 func (c *testConnPoolObj) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
 	return nil
 }
 
+func (c *testConnPoolObj) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+type testMuxableConnPoolObj struct {
+	testConnPoolObj
+	valC chan int
+}
+
+func (c *testMuxableConnPoolObj) Value() <-chan int {
+	return c.valC
+}
+
 func (c *testConnPoolObj) ShouldDelete() bool {
 	return !c.canContinue
 }
@@ -80,3 +100,89 @@ func TestInsertMulti(t *testing.T) {
 	assert.True(t, objGet2.ConnPoolObject() == obj1 || objGet2.ConnPoolObject() == obj2, "Everything we get should be in the set we inserted-2")
 
 }
+
+func TestGetContext(t *testing.T) {
+	pool, err := newBaseConnPool([]ConnPoolObject{}, 10)
+	assert.NoError(t, err, "Should be no error creating pool")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pool.GetContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "Should give up on an empty pool once the context is done")
+
+	obj := &testConnPoolObj{canContinue: true}
+	_, err = pool.Insert(obj)
+	assert.NoError(t, err, "Should have no error inserting into pool")
+
+	objGet, err := pool.GetContext(context.Background())
+	assert.NoError(t, err, "Should have no error getting from pool")
+	assert.Equal(t, obj, objGet.ConnPoolObject())
+}
+
+func TestRemove(t *testing.T) {
+	pool, err := newBaseConnPool([]ConnPoolObject{}, 1)
+	assert.NoError(t, err, "Should be no error creating pool")
+
+	obj := &testConnPoolObj{canContinue: true}
+	_, err = pool.Insert(obj)
+	assert.NoError(t, err, "Should have no error inserting into pool")
+
+	ok, err := pool.Remove(obj)
+	assert.True(t, ok, "Should remove object in pool")
+	assert.NoError(t, err)
+	assert.True(t, obj.isClosed(), "Should close removed object")
+
+	ok, _ = pool.Remove(obj)
+	assert.False(t, ok, "Should not remove object twice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pool.GetContext(ctx)
+	assert.Error(t, err, "Should not get removed object")
+
+	ok, err = pool.Insert(&testConnPoolObj{canContinue: true})
+	assert.True(t, ok, "Should have room in pool once object is removed")
+	assert.NoError(t, err)
+}
+
+func TestClose(t *testing.T) {
+	obj := &testConnPoolObj{canContinue: true}
+	muxObj := &testMuxableConnPoolObj{testConnPoolObj: testConnPoolObj{canContinue: true}, valC: make(chan int, 1)}
+	muxObj.valC <- 0
+	pool, err := newBaseConnPool([]ConnPoolObject{obj, muxObj}, 10)
+	assert.NoError(t, err, "Should be no error creating pool")
+
+	assert.NoError(t, pool.Close())
+	assert.True(t, obj.isClosed(), "Should close objects")
+	assert.True(t, muxObj.isClosed(), "Should close muxable objects")
+
+	_, err = pool.GetContext(context.Background())
+	assert.Equal(t, ErrConnPoolClosed, err)
+	assert.Nil(t, pool.Get())
+
+	ok, err := pool.Insert(&testConnPoolObj{canContinue: true})
+	assert.False(t, ok)
+	assert.Equal(t, ErrConnPoolClosed, err)
+	assert.Equal(t, ConnPoolStats{}, pool.Stats())
+}
+
+func TestStats(t *testing.T) {
+	obj := &testConnPoolObj{canContinue: true}
+	muxObj := &testMuxableConnPoolObj{testConnPoolObj: testConnPoolObj{canContinue: true}, valC: make(chan int, 1)}
+	muxObj.valC <- 3
+	open := openConnPoolStats()
+	pool, err := newBaseConnPool([]ConnPoolObject{obj, muxObj}, 10)
+	assert.NoError(t, err, "Should be no error creating pool")
+
+	assert.Equal(t, ConnPoolStats{Size: 2, Idle: 2, MuxedLoad: 3}, pool.Stats())
+
+	objGet := pool.Get()
+	assert.Equal(t, ConnPoolStats{Size: 2, Idle: 1, InUse: 1, MuxedLoad: 3}, pool.Stats())
+	assert.Equal(t, open.Size+2, openConnPoolStats().Size, "Should report stats of open pools")
+
+	objGet.Done()
+	assert.Equal(t, ConnPoolStats{Size: 2, Idle: 2, MuxedLoad: 3}, pool.Stats())
+
+	assert.NoError(t, pool.Close())
+	assert.Equal(t, open, openConnPoolStats(), "Should not report stats of closed pools")
+}
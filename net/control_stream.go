@@ -0,0 +1,7 @@
+package net
+
+// ControlStreamHeader marks the request the server opens on the first tunnel of an HTTP2
+// session whose control connection negotiated h2. The request body carries the control
+// messages of the server, the response body those of the client, for as long as the session.
+// Ingress requests can't set it.
+const ControlStreamHeader = "Wormhole-Control-Stream"
@@ -0,0 +1,64 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// GatewayErrorClass tells why a request couldn't be proxied to the local endpoint
+type GatewayErrorClass string
+
+const (
+	// NoTunnel means the server had no tunnel to the client to send the request over
+	NoTunnel GatewayErrorClass = "no_tunnel"
+	// TunnelBroken means the tunnel failed before the client answered
+	TunnelBroken GatewayErrorClass = "tunnel_broken"
+	// LocalDialFailed means the client couldn't connect to, or get a response from, the local endpoint
+	LocalDialFailed GatewayErrorClass = "local_dial_failed"
+	// LocalTimeout means the local endpoint didn't answer in time
+	LocalTimeout GatewayErrorClass = "local_timeout"
+)
+
+// GatewayErrorHeader is set on gateway error responses to their class
+const GatewayErrorHeader = "Wormhole-Error-Class"
+
+// TunnelErrorHeader carries the class of the gateway errors of clients over HTTP2 tunnels.
+// Clients strip it from the responses of local endpoints, so that the server only reports
+// the errors clients answered with themselves.
+const TunnelErrorHeader = "Wormhole-Tunnel-Error-Class"
+
+// StatusCode returns the status gateway errors of the class are answered with
+func (c GatewayErrorClass) StatusCode() int {
+	switch c {
+	case NoTunnel:
+		return http.StatusServiceUnavailable
+	case LocalTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ClassifyLocalError returns the class of an error returned by a request to the local endpoint
+func ClassifyLocalError(err error) GatewayErrorClass {
+	// url.Error and context.DeadlineExceeded are net.Errors as well
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return LocalTimeout
+	}
+	return LocalDialFailed
+}
+
+// WriteGatewayError answers a request which couldn't be proxied with the status of class
+// body is sent instead of the status text if set, its content type is detected
+func WriteGatewayError(w http.ResponseWriter, class GatewayErrorClass, body string) {
+	status := class.StatusCode()
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	h := w.Header()
+	h.Set("Content-Type", http.DetectContentType([]byte(body)))
+	h.Set(GatewayErrorHeader, string(class))
+	w.WriteHeader(status)
+	fmt.Fprintln(w, body)
+}
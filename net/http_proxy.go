@@ -0,0 +1,129 @@
+package net
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CopyResponse writes a proxied response to w, then its trailers. The Content-Length is kept
+// unless the length is unknown or trailers follow the body.
+// The body is flushed as it's read for server-sent events and responses of unknown length
+// (e.g. gRPC or chunked progress), so streams aren't held back. Other bodies are flushed
+// flushInterval after a write, on every write if it's negative, or once done if it's 0.
+func CopyResponse(w http.ResponseWriter, resp *http.Response, flushInterval time.Duration) (int64, error) {
+	header := w.Header()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+
+	// trailers known in advance are announced, others are sent with http.TrailerPrefix
+	header.Del("Trailer")
+	announced := make(map[string]bool, len(resp.Trailer))
+	for key := range resp.Trailer {
+		header.Add("Trailer", key)
+		announced[key] = true
+	}
+	if resp.ContentLength < 0 || len(resp.Trailer) > 0 {
+		header.Del("Content-Length")
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if f, ok := w.(http.Flusher); ok {
+		latency := responseFlushInterval(resp, flushInterval)
+		if latency < 0 {
+			// streams get their headers right away, before their first message
+			f.Flush()
+		}
+		if latency != 0 {
+			fw := &flushWriter{w: w, flusher: f, latency: latency}
+			defer fw.stop()
+			dst = fw
+		}
+	}
+
+	n, err := io.Copy(dst, resp.Body)
+	if err != nil {
+		return n, err
+	}
+
+	// resp.Trailer is only complete once the body is read
+	for key, values := range resp.Trailer {
+		if announced[key] {
+			header[key] = values
+		} else {
+			header[http.TrailerPrefix+key] = values
+		}
+	}
+	return n, nil
+}
+
+// responseFlushInterval returns how long writes of the body of resp may stay buffered,
+// they're flushed immediately if it's negative
+func responseFlushInterval(resp *http.Response, flushInterval time.Duration) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength < 0 {
+		return -1
+	}
+	return flushInterval
+}
+
+// flushWriter flushes the writes to an http.ResponseWriter, immediately if latency is
+// negative, else at most latency after them. stop must be called once done writing.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex
+	t            *time.Timer
+	flushPending bool
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(b)
+	if fw.latency < 0 {
+		fw.flusher.Flush()
+		return n, err
+	}
+	if fw.flushPending {
+		return n, err
+	}
+	if fw.t == nil {
+		fw.t = time.AfterFunc(fw.latency, fw.delayedFlush)
+	} else {
+		fw.t.Reset(fw.latency)
+	}
+	fw.flushPending = true
+	return n, err
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	// stopped, the ResponseWriter may not be used anymore
+	if !fw.flushPending {
+		return
+	}
+	fw.flusher.Flush()
+	fw.flushPending = false
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.flushPending = false
+	if fw.t != nil {
+		fw.t.Stop()
+	}
+}
@@ -0,0 +1,115 @@
+package net
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushRecorder records what was flushed of a response written concurrently
+type flushRecorder struct {
+	header http.Header
+
+	mu      sync.Mutex
+	body    string
+	flushed string
+}
+
+func (r *flushRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *flushRecorder) WriteHeader(int) {}
+
+func (r *flushRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.body += string(b)
+	return len(b), nil
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed = r.body
+}
+
+// waitFlushed returns what was flushed once it's want, or after timeout
+func (r *flushRecorder) waitFlushed(want string, timeout time.Duration) string {
+	deadline := time.Now().Add(timeout)
+	for {
+		r.mu.Lock()
+		flushed := r.flushed
+		r.mu.Unlock()
+		if flushed == want || time.Now().After(deadline) {
+			return flushed
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCopyResponseFlush(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		contentType   string
+		contentLength int64
+		flushInterval time.Duration
+		flushed       bool
+	}{
+		{"Test_event_stream", "text/event-stream; charset=utf-8", 100, 0, true},
+		{"Test_unknown_length", "text/plain", -1, 0, true},
+		{"Test_flush_interval", "text/plain", 100, 10 * time.Millisecond, true},
+		{"Test_flush_every_write", "text/plain", 100, -1, true},
+		{"Test_buffered", "text/plain", 100, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pr, pw := io.Pipe()
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {tc.contentType}},
+				ContentLength: tc.contentLength,
+				Body:          pr,
+			}
+			w := &flushRecorder{header: http.Header{}}
+			done := make(chan struct{})
+			go func() {
+				CopyResponse(w, resp, tc.flushInterval)
+				close(done)
+			}()
+
+			io.WriteString(pw, "data: 1\n\n")
+			if tc.flushed {
+				assert.Equal(t, "data: 1\n\n", w.waitFlushed("data: 1\n\n", time.Second), "Should flush the body before it ends")
+			} else {
+				assert.Empty(t, w.waitFlushed("data: 1\n\n", 50*time.Millisecond), "Shouldn't flush the body before it ends")
+			}
+			pw.Close()
+			<-done
+		})
+	}
+}
+
+func TestCopyResponseTrailers(t *testing.T) {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {"4"}},
+		ContentLength: 4,
+		Body:          ioutil.NopCloser(strings.NewReader("test")),
+		Trailer:       http.Header{"Grpc-Status": {"0"}},
+	}
+	w := httptest.NewRecorder()
+	n, err := CopyResponse(w, resp, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+
+	result := w.Result()
+	assert.Empty(t, result.Header.Get("Content-Length"), "Shouldn't frame a response with trailers by its length")
+	assert.Equal(t, "0", result.Trailer.Get("Grpc-Status"), "Should forward trailers")
+}
@@ -0,0 +1,157 @@
+package net
+
+import (
+	"errors"
+	"io"
+
+	"github.com/soheilhy/cmux"
+)
+
+const (
+	// ALPNTCP is the ALPN protocol advertised by TLS connections of the TCP transports
+	ALPNTCP = "wormhole-tcp"
+	// ALPNHTTP2 is the ALPN protocol advertised by TLS connections of the HTTP2 transport
+	// Tunnels, and control connections carrying a control stream, advertise h2 as well. The
+	// server negotiates it to have them speak h2 right after authenticating, on the same TLS connection
+	ALPNHTTP2 = "wormhole-http2"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionALPN            = 0x10
+	maxTLSRecordLen          = 16384 + 2048
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// TLSALPN returns a cmux.Matcher matching TLS connections which advertise
+// any of the given protocols in the ALPN extension of their ClientHello
+func TLSALPN(protos ...string) cmux.Matcher {
+	return func(r io.Reader) bool {
+		offered, err := readClientHelloALPN(r)
+		if err != nil {
+			return false
+		}
+		for _, o := range offered {
+			for _, p := range protos {
+				if o == p {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// TLSWithoutALPN returns a cmux.Matcher matching TLS connections whose
+// ClientHello has no ALPN extension, like those of clients predating ALPN routing
+func TLSWithoutALPN() cmux.Matcher {
+	return func(r io.Reader) bool {
+		offered, err := readClientHelloALPN(r)
+		return err == nil && len(offered) == 0
+	}
+}
+
+// readClientHelloALPN reads the first TLS record from r and returns the ALPN
+// protocols listed in the ClientHello it contains
+func readClientHelloALPN(r io.Reader) ([]string, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return nil, err
+	}
+	// bail out before reading any further from connections which aren't TLS
+	if hdr[0] != recordTypeHandshake {
+		return nil, errNotClientHello
+	}
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return nil, err
+	}
+	n := int(hdr[3])<<8 | int(hdr[4])
+	if n > maxTLSRecordLen {
+		return nil, errNotClientHello
+	}
+	record := make([]byte, n)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+
+	p := &helloParser{b: record}
+	if p.uint8() != handshakeTypeClientHello {
+		return nil, errNotClientHello
+	}
+	p.skip(3)                 // handshake length
+	p.skip(2 + 32)            // client version, random
+	p.skip(p.uint8())         // session id
+	p.skip(p.uint16())        // cipher suites
+	p.skip(p.uint8())         // compression methods
+	exts := p.sub(p.uint16()) // extensions
+
+	for !exts.empty() {
+		typ := exts.uint16()
+		ext := exts.sub(exts.uint16())
+		if typ != extensionALPN {
+			continue
+		}
+		var protos []string
+		list := ext.sub(ext.uint16())
+		for !list.empty() {
+			protos = append(protos, string(list.bytes(list.uint8())))
+		}
+		if list.err || ext.err {
+			return nil, errNotClientHello
+		}
+		return protos, nil
+	}
+	if p.err || exts.err {
+		return nil, errNotClientHello
+	}
+	return nil, nil
+}
+
+// helloParser reads big endian fields from a TLS handshake message
+// Reading past the end of the message sets err and yields zero values
+type helloParser struct {
+	b   []byte
+	err bool
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.err || len(p.b) < n {
+		p.err = true
+		p.b = nil
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *helloParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *helloParser) uint8() int {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (p *helloParser) uint16() int {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+func (p *helloParser) sub(n int) *helloParser {
+	b := p.bytes(n)
+	return &helloParser{b: b, err: p.err}
+}
+
+func (p *helloParser) empty() bool {
+	return p.err || len(p.b) == 0
+}
@@ -0,0 +1,50 @@
+package net
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clientHello captures the first flight written by a TLS client advertising protos
+func clientHello(protos ...string) []byte {
+	cConn, sConn := net.Pipe()
+	defer sConn.Close()
+
+	go func() {
+		tls.Client(cConn, &tls.Config{ServerName: "localhost", NextProtos: protos}).Handshake()
+	}()
+
+	b := make([]byte, maxTLSRecordLen)
+	n, _ := sConn.Read(b)
+	cConn.Close()
+	return b[:n]
+}
+
+func TestTLSALPN(t *testing.T) {
+	matcher := TLSALPN(ALPNTCP)
+
+	assert.True(t, matcher(bytes.NewReader(clientHello(ALPNTCP))), "Should match advertised protocol")
+	assert.True(t, matcher(bytes.NewReader(clientHello("h2", ALPNTCP))), "Should match any advertised protocol")
+	assert.False(t, matcher(bytes.NewReader(clientHello(ALPNHTTP2))), "Should not match other protocols")
+	assert.False(t, matcher(bytes.NewReader(clientHello())), "Should not match without ALPN")
+	assert.False(t, matcher(strings.NewReader("SSH-2.0-Go\r\n")), "Should not match plain text")
+
+	hello := clientHello(ALPNTCP)
+	assert.False(t, matcher(bytes.NewReader(hello[:len(hello)/2])), "Should not match truncated ClientHello")
+}
+
+func TestTLSWithoutALPN(t *testing.T) {
+	matcher := TLSWithoutALPN()
+
+	assert.True(t, matcher(bytes.NewReader(clientHello())), "Should match without ALPN")
+	assert.False(t, matcher(bytes.NewReader(clientHello(ALPNTCP))), "Should not match advertised protocols")
+	assert.False(t, matcher(strings.NewReader("SSH-2.0-Go\r\n")), "Should not match plain text")
+
+	hello := clientHello()
+	assert.False(t, matcher(bytes.NewReader(hello[:len(hello)/2])), "Should not match truncated ClientHello")
+}
@@ -0,0 +1,17 @@
+package net
+
+import (
+	"io/ioutil"
+
+	"github.com/hashicorp/yamux"
+)
+
+// MuxConfig returns the yamux configuration shared by both ends
+// of a multiplexed tunnel connection
+func MuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	// errors are surfaced through the session and its streams
+	// and get logged by the callers
+	cfg.LogOutput = ioutil.Discard
+	return cfg
+}
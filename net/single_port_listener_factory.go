@@ -17,7 +17,8 @@ type sharedPortTLSListenerFactory struct {
 	fLock   sync.Mutex
 	logger  *logrus.Entry
 
-	stopC chan struct{}
+	stopC    chan struct{}
+	stopOnce sync.Once
 }
 
 // SharedPortTLSListenerFactoryArgs provides the data needed to create a SharedPortTLSListenerFactory
@@ -84,7 +85,8 @@ func (sl *sharedPortTLSListenerFactory) Listener(args *ListenerFromFactoryArgs)
 
 // Close...
 func (sl *sharedPortTLSListenerFactory) Close() error {
-	close(sl.stopC)
+	// the factory is shared by all handlers, each of them closes it
+	sl.stopOnce.Do(func() { close(sl.stopC) })
 	return nil
 }
 
@@ -159,18 +161,25 @@ type sharedPortTLSListener struct {
 
 	// f is stored such that we can delete ourselves when Close is called
 	f *sharedPortTLSListenerFactory
+
+	closeOnce sync.Once
 }
 
 // Close...
 func (l *sharedPortTLSListener) Close() error {
-	close(l.done)
-	defer close(l.connCh)
-
-	// delete all refs so garbage collector will clean us up
-	l.f.fLock.Lock()
-	delete(l.f.forward, l.id)
-	l.f.fLock.Unlock()
-	l.f = nil
+	l.closeOnce.Do(func() {
+		close(l.done)
+		defer close(l.connCh)
+
+		// delete all refs so garbage collector will clean us up,
+		// unless a resumed session is already listening with the same ID
+		l.f.fLock.Lock()
+		if l.f.forward[l.id] == l {
+			delete(l.f.forward, l.id)
+		}
+		l.f.fLock.Unlock()
+		l.f = nil
+	})
 
 	return nil
 }
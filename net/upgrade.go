@@ -0,0 +1,65 @@
+package net
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// UpgradeHeader carries the Upgrade header of HTTP/1.1 upgrade requests over HTTP2 tunnels,
+// which don't allow connection-specific headers. The client answers with 200 and the protocol
+// the local endpoint switched to in the same header, the stream then carries the upgraded
+// connection both ways.
+const UpgradeHeader = "Wormhole-Upgrade"
+
+// IsUpgradeRequest tells whether r asks to switch protocols, e.g. to a websocket
+func IsUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header["Connection"], "upgrade")
+}
+
+// headerHasToken tells whether one of the comma separated values of a header is token
+func headerHasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamConn is a full-duplex stream made of an HTTP2 request body and its response
+type streamConn struct {
+	r         io.Reader
+	w         io.Writer
+	closeFn   func() error
+	closeOnce sync.Once
+}
+
+// NewStreamConn returns a stream reading from r and writing to w, flushing every write
+// if w is an http.Flusher. closeFn is called once, by Close, and must unblock reads and writes.
+func NewStreamConn(r io.Reader, w io.Writer, closeFn func() error) io.ReadWriteCloser {
+	return &streamConn{r: r, w: w, closeFn: closeFn}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if f, ok := c.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.closeFn()
+	})
+	return err
+}
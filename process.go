@@ -5,29 +5,55 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// restartDelay is the time waited before restarting a program which exited
+const restartDelay = time.Second
+
 // Process is a wrapper around external program
 // It handles execution and shutdown of a program and can notify an optional io.Closer
 // when a program is terminated.
 type Process struct {
-	cmd    *exec.Cmd
-	closer io.Closer
-	logger *logrus.Entry
+	program string
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	closer  io.Closer
+	logger  *logrus.Entry
+	shell   func(program string) []string
+	exit    func(code int)
+
+	// Restart restarts the program whenever it exits, whether it succeeded or failed,
+	// like a supervisor would. Otherwise wormhole exits along with a program which failed,
+	// and keeps running without one which succeeded.
+	Restart bool
+	// OnRestart is called after the program was restarted, e.g. to report its new release
+	OnRestart func()
 }
 
 // NewProcess returns the Process to execute a named program
 func NewProcess(logger *logrus.Logger, program string, closer io.Closer) *Process {
-	cs := shellArgs(program)
+	return &Process{
+		program: program,
+		closer:  closer,
+		logger:  logger.WithFields(logrus.Fields{"prefix": "process"}),
+		shell:   shellArgs,
+		exit:    os.Exit,
+	}
+}
+
+func (p *Process) command() *exec.Cmd {
+	cs := p.shell(p.program)
 	cmd := exec.Command(cs[0], cs[1:]...)
 	cmd.Stdin = nil
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
-	return &Process{cmd: cmd, closer: closer, logger: logger.WithFields(logrus.Fields{"prefix": "process"})}
+	return cmd
 }
 
 // Run starts the specified command and returns
@@ -36,18 +62,27 @@ func NewProcess(logger *logrus.Logger, program string, closer io.Closer) *Proces
 // It also closer the Closer if present.
 func (p *Process) Run() (err error) {
 	p.handleOsSignal()
+	return p.start()
+}
+
+func (p *Process) start() (err error) {
+	cmd := p.command()
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
 
-	p.logger.Println("Starting program:", p.cmd.Path)
-	if err = p.cmd.Start(); err != nil {
+	p.logger.Println("Starting program:", cmd.Path)
+	if err = cmd.Start(); err != nil {
 		p.logger.Println("Failed to start program:", err)
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
 				p.logger.Printf("Exit Status: %d", status.ExitStatus())
-				os.Exit(status.ExitStatus())
+				p.exit(status.ExitStatus())
 			}
 		}
+		return
 	}
-	go wait(p.cmd, p.logger)
+	go p.wait(cmd)
 	return
 }
 
@@ -58,8 +93,11 @@ func (p *Process) handleOsSignal() {
 		for sig := range signalChan {
 			var exitStatus int
 			var exited bool
-			if p.cmd != nil {
-				exited, exitStatus, _ = signalProcess(p.cmd, sig)
+			p.mu.Lock()
+			cmd := p.cmd
+			p.mu.Unlock()
+			if cmd != nil {
+				exited, exitStatus, _ = signalProcess(cmd, sig)
 			} else {
 				exitStatus = 0
 			}
@@ -69,10 +107,10 @@ func (p *Process) handleOsSignal() {
 				if p.closer != nil {
 					p.closer.Close()
 				}
-				os.Exit(int(exitStatus))
+				p.exit(int(exitStatus))
 			default:
-				if p.cmd != nil && exited {
-					os.Exit(int(exitStatus))
+				if cmd != nil && exited {
+					p.exit(int(exitStatus))
 				}
 			}
 		}
@@ -92,15 +130,39 @@ func signalProcess(cmd *exec.Cmd, sig os.Signal) (exited bool, exitStatus int, e
 	return
 }
 
-func wait(cmd *exec.Cmd, log *logrus.Entry) {
-	if err := cmd.Wait(); err != nil {
-		log.Errorln("Program error:", err)
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				log.Printf("Exit Status: %d", status.ExitStatus())
-				os.Exit(status.ExitStatus())
-			}
+func (p *Process) wait(cmd *exec.Cmd) {
+	err := cmd.Wait()
+	if err != nil {
+		p.logger.Errorln("Program error:", err)
+	}
+	if p.Restart {
+		p.restart()
+		return
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			p.logger.Printf("Exit Status: %d", status.ExitStatus())
+			p.exit(status.ExitStatus())
+			return
 		}
 	}
-	log.Println("Terminating program", cmd.Path)
+	p.logger.Println("Terminating program", cmd.Path)
+}
+
+// restart starts the program again after restartDelay and calls OnRestart
+// wormhole exits if the program can't be started, rather than run without it
+func (p *Process) restart() {
+	p.logger.Printf("Program exited, restarting in %s", restartDelay)
+	time.Sleep(restartDelay)
+	if err := p.start(); err != nil {
+		p.logger.Errorf("Couldn't restart program: %s", err.Error())
+		if p.closer != nil {
+			p.closer.Close()
+		}
+		p.exit(1)
+		return
+	}
+	if p.OnRestart != nil {
+		p.OnRestart()
+	}
 }
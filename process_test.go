@@ -0,0 +1,115 @@
+package wormhole
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+)
+
+// testCloser reports when it's closed
+type testCloser struct {
+	closed chan struct{}
+}
+
+func (c *testCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// newTestProcess returns a Process which can be started runs times,
+// after which it fails to start. Exit codes are sent to exits instead of exiting.
+func newTestProcess(program string, runs int) (*Process, *testCloser, chan int) {
+	closer := &testCloser{closed: make(chan struct{})}
+	p := NewProcess(logrus.New(), program, closer)
+
+	var mu sync.Mutex
+	p.shell = func(program string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		if runs == 0 {
+			return []string{"/nonexistent/program"}
+		}
+		runs--
+		return shellArgs(program)
+	}
+	exits := make(chan int, 1)
+	p.exit = func(code int) {
+		exits <- code
+	}
+	return p, closer, exits
+}
+
+func waitExit(t *testing.T, exits chan int) int {
+	select {
+	case code := <-exits:
+		return code
+	case <-time.After(5 * restartDelay):
+		t.Fatal("Should have exited")
+		return 0
+	}
+}
+
+func TestProcessRestart(t *testing.T) {
+	for name, program := range map[string]string{
+		"Test_clean_exit":  "exit 0",
+		"Test_failed_exit": "exit 3",
+	} {
+		program := program
+		t.Run(name, func(t *testing.T) {
+			p, closer, exits := newTestProcess(program, 2)
+			p.Restart = true
+			restarts := make(chan struct{}, 2)
+			p.OnRestart = func() {
+				restarts <- struct{}{}
+			}
+
+			assert.NoError(t, p.start(), "Should be no error starting program")
+			// the second restart fails, which has to exit wormhole
+			assert.Equal(t, 1, waitExit(t, exits), "Should exit once the program can't be restarted")
+			assert.Len(t, restarts, 1, "OnRestart should be called once the program was restarted")
+			select {
+			case <-closer.closed:
+			default:
+				t.Error("Closer should be closed when the program can't be restarted")
+			}
+		})
+	}
+}
+
+func TestProcessWithoutRestart(t *testing.T) {
+	p, _, exits := newTestProcess("exit 3", 2)
+	p.OnRestart = func() {
+		t.Error("Program shouldn't be restarted")
+	}
+
+	assert.NoError(t, p.start(), "Should be no error starting program")
+	assert.Equal(t, 3, waitExit(t, exits), "Should exit with the status of the program")
+}
+
+type testReleaseUpdater struct {
+	releases []*messages.Release
+}
+
+func (u *testReleaseUpdater) UpdateRelease(release *messages.Release) error {
+	u.releases = append(u.releases, release)
+	return nil
+}
+
+func TestUpdateRelease(t *testing.T) {
+	updater := &testReleaseUpdater{}
+	cfg := &config.ClientConfig{
+		ReleaseID:   "test_id",
+		ReleaseDesc: "test_desc",
+	}
+	updateRelease(cfg, updater, logrus.NewEntry(logrus.New()))
+
+	if assert.Len(t, updater.releases, 1, "Should send the release") {
+		assert.Equal(t, "test_id", updater.releases[0].ID)
+		assert.Equal(t, "test_desc", updater.releases[0].Description)
+	}
+}
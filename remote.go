@@ -2,6 +2,8 @@ package wormhole
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
@@ -13,7 +15,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/soheilhy/cmux"
 	"github.com/superfly/wormhole/api"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 	handler "github.com/superfly/wormhole/remote"
 	wserver "github.com/superfly/wormhole/server"
@@ -21,9 +25,12 @@ import (
 	tlsc "github.com/superfly/wormhole/tls"
 )
 
+// sshBanner is the prefix of the identification string sent by SSH clients
+const sshBanner = "SSH-"
+
 var (
-	redisPool *redis.Pool
-	log       *logrus.Entry
+	store session.Store
+	log   *logrus.Entry
 )
 
 // StartRemote ...
@@ -33,8 +40,6 @@ func StartRemote(cfg *config.ServerConfig) {
 
 	registry := session.NewRegistry(cfg.Logger)
 
-	var h handler.Handler
-	var err error
 	server := &handler.Server{Logger: cfg.Logger}
 
 	listenerFactory, err := listenerFactoryFromConfig(registry, cfg)
@@ -42,57 +47,129 @@ func StartRemote(cfg *config.ServerConfig) {
 		log.Fatalf("Could not create listener factory: %+v", err)
 	}
 
+	handlers, err := handlersFromConfig(registry, listenerFactory, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var hs []handler.Handler
+	for _, h := range handlers {
+		hs = append(hs, h)
+	}
+	go handleDeath(hs, registry)
+
 	l, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	m := cmux.New(l)
-	httpL := m.Match(cmux.TLS())
-	tcpL := m.Match(cmux.Any())
+	apiL, err := muxSharedPort(m, server, handlers, cfg)
+	if err != nil {
+		log.Fatal("could not parse tls key/value pair", err)
+	}
 
-	switch cfg.Protocol {
-	case config.SSH:
-		h, err = handler.NewSSHHandler(cfg, registry, redisPool, listenerFactory)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case config.TCP:
-		h, err = handler.NewTCPHandler(cfg, registry, redisPool, listenerFactory)
-		if err != nil {
-			log.Fatal(err)
-		}
-	case config.HTTP2:
-		h, err = handler.NewHTTP2Handler(cfg, registry, redisPool, listenerFactory)
-		if err != nil {
-			log.Fatal(err)
-		}
-	default:
-		log.Fatal("Unknown wormhole transport layer protocol selected.")
+	serverRep := &wserver.Representation{Address: cfg.ClusterURL, Port: cfg.Port, Region: cfg.Region}
+	if h, ok := handlers[config.SSH].(*handler.SSHHandler); ok {
+		serverRep.HostKeyFingerprints = h.HostKeyFingerprints()
+	}
+	rep, err := serverRep.MarshalMsg(nil)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	go handleDeath(h, registry)
+	go api.NewServer(cfg.Logger, store, auth.NewVerifier(cfg.TokenSigningKeys)).Serve(apiL)
+	go store.Announce(rep)
+	if err := m.Serve(); err != nil {
+		log.Error("server error", err)
+		exitGracefully(hs, registry)
+	}
+}
+
+// muxSharedPort routes the connections accepted by m to the handlers of their tunnel type
+// and returns the listener of the API server, which gets any other TLS connection.
+// Connections are told apart by:
+// - the banner sent by SSH clients
+// - the ALPN protocol advertised by TLS clients
+// - the message preface sent by TCP clients running without TLS
+// TLS connections without ALPN go to the legacy transport, if any, so API clients
+// have to advertise http/1.1 or h2 when FLY_LEGACY_TLS_PROTO is set.
+func muxSharedPort(m cmux.CMux, server *handler.Server, handlers map[config.TunnelProto]handler.Handler, cfg *config.ServerConfig) (net.Listener, error) {
+	if h, ok := handlers[config.SSH]; ok {
+		go server.Serve(m.Match(cmux.PrefixMatcher(sshBanner)), h)
+	}
+	if h, ok := handlers[config.TCP]; ok {
+		go server.Serve(m.Match(cmux.PrefixMatcher(string(messages.Preface)), wnet.TLSALPN(wnet.ALPNTCP)), h)
+	}
+	if h, ok := handlers[config.HTTP2]; ok {
+		go server.Serve(m.Match(wnet.TLSALPN(wnet.ALPNHTTP2)), h)
+	}
+	if h, ok := handlers[cfg.LegacyTLSProtocol]; ok {
+		go server.Serve(m.Match(wnet.TLSWithoutALPN()), h)
+	}
+	httpL := m.Match(cmux.TLS())
 
 	crt, err := tls.X509KeyPair(cfg.SharedPortTLSCert, cfg.SharedPortTLSPrivateKey)
 	if err != nil {
-		log.Fatal("could not parse tls key/value pair", err)
+		return nil, err
 	}
 	tlsl := tls.NewListener(httpL, &tls.Config{
 		Certificates: []tls.Certificate{crt},
 	})
 
-	rep, err := wserver.Representation{Address: cfg.ClusterURL, Port: cfg.Port, Region: cfg.Region}.MarshalMsg(nil)
-	if err != nil {
-		log.Fatal(err)
+	h, ok := handlers[config.WS]
+	if !ok {
+		return tlsl, nil
 	}
+	// websocket upgrades share the TLS listener with the API server
+	tm := cmux.New(tlsl)
+	wsL := tm.Match(cmux.HTTP1HeaderField("Upgrade", "websocket"))
+	apiL := tm.Match(cmux.Any())
+	go server.Serve(wsL, h)
+	go tm.Serve()
 
-	go api.NewServer(cfg.Logger, redisPool).Serve(tlsl)
-	go server.Serve(tcpL, h)
-	go session.NewRedisStore(redisPool).Announce(rep)
-	if err := m.Serve(); err != nil {
-		log.Error("server error", err)
-		exitGracefully(h, registry)
+	// clients running without TLS upgrade plain HTTP connections, which would expose
+	// their token, so they're only accepted by insecure servers
+	// this has to be matched last as it reads up to the end of the request headers
+	if cfg.Insecure {
+		go server.Serve(m.Match(cmux.HTTP1HeaderField("Upgrade", "websocket")), h)
 	}
+	return apiL, nil
+}
+
+// handlersFromConfig creates a handler for each tunnel type accepted by the server
+// A single TCPHandler serves both pooled and multiplexed TCP sessions
+func handlersFromConfig(registry *session.Registry, factory wnet.ListenerFactory, cfg *config.ServerConfig) (map[config.TunnelProto]handler.Handler, error) {
+	handlers := make(map[config.TunnelProto]handler.Handler)
+
+	for _, proto := range cfg.Protocols {
+		if proto == config.TCPMux {
+			proto = config.TCP
+		}
+		if _, ok := handlers[proto]; ok {
+			continue
+		}
+
+		var h handler.Handler
+		var err error
+		switch proto {
+		case config.SSH:
+			h, err = handler.NewSSHHandler(cfg, registry, store, factory)
+		case config.TCP:
+			h, err = handler.NewTCPHandler(cfg, registry, store, factory)
+		case config.HTTP2:
+			h, err = handler.NewHTTP2Handler(cfg, registry, store, factory)
+		case config.WS:
+			h, err = handler.NewWebSocketHandler(cfg, registry, store, factory)
+		default:
+			return nil, errors.New("Unknown wormhole transport layer protocol selected")
+		}
+		if err != nil {
+			return nil, err
+		}
+		handlers[proto] = h
+	}
+	return handlers, nil
 }
 
 func listenerFactoryFromConfig(registry *session.Registry, cfg *config.ServerConfig) (wnet.ListenerFactory, error) {
@@ -136,14 +213,57 @@ func listenerFactoryFromConfig(registry *session.Registry, cfg *config.ServerCon
 func ensureRemoteEnvironment(cfg *config.ServerConfig) {
 	var err error
 
-	redisPool = newRedisPool(cfg.RedisURL)
+	store, err = storeFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Couldn't open session store: %s", err.Error())
+	}
+}
+
+// storeFromConfig opens the session store selected with FLY_STORE
+func storeFromConfig(cfg *config.ServerConfig) (session.Store, error) {
+	switch cfg.Store {
+	case config.MemoryStore:
+		return provisionStore(session.NewMemoryStore(), cfg)
+	case config.BoltStore:
+		s, err := session.NewBoltStore(cfg.StorePath)
+		if err != nil {
+			return nil, err
+		}
+		return provisionStore(s, cfg)
+	}
+
+	redisPool := newRedisPool(cfg.RedisURL)
 
 	redisConn := redisPool.Get()
 	defer redisConn.Close()
-	_, err = redisConn.Do("PING")
+	if _, err := redisConn.Do("PING"); err != nil {
+		return nil, fmt.Errorf("couldn't connect to Redis: %s", err.Error())
+	}
+	return session.NewRedisStore(redisPool), nil
+}
+
+// provisionStore registers the backend tokens of the config in an embedded store
+func provisionStore(s *session.KVStore, cfg *config.ServerConfig) (session.Store, error) {
+	for token, backendID := range cfg.BackendTokens {
+		if err := s.AddToken(token, backendID); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// MigrateTokens hashes the backend tokens still stored in plaintext
+// Servers predating hashed tokens only look them up in plaintext, so this is run
+// once every server sharing the store has been upgraded
+func MigrateTokens(cfg *config.ServerConfig) {
+	log = cfg.Logger.WithFields(logrus.Fields{"prefix": "wormhole"})
+	ensureRemoteEnvironment(cfg)
+
+	n, err := store.MigrateTokens()
 	if err != nil {
-		log.Fatalf("Couldn't connect to Redis: %s", err.Error())
+		log.Fatalf("Couldn't migrate backend tokens: %s", err.Error())
 	}
+	log.Infof("Migrated %d backend tokens to hashes", n)
 }
 
 func newRedisPool(redisURL string) *redis.Pool {
@@ -181,19 +301,21 @@ func newRedisPool(redisURL string) *redis.Pool {
 }
 
 // IT CAN BE HANDLED!
-func handleDeath(h handler.Handler, r *session.Registry) {
+func handleDeath(hs []handler.Handler, r *session.Registry) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func(c <-chan os.Signal) {
 		for range c {
-			exitGracefully(h, r)
+			exitGracefully(hs, r)
 		}
 	}(c)
 }
 
-func exitGracefully(h handler.Handler, r *session.Registry) {
+func exitGracefully(hs []handler.Handler, r *session.Registry) {
 	log.Print("Cleaning up before exit...")
-	h.Close()
+	for _, h := range hs {
+		h.Close()
+	}
 	r.Close()
 	log.Print("Cleaned up connections.")
 	os.Exit(1)
@@ -0,0 +1,42 @@
+package remote
+
+import (
+	"errors"
+
+	"github.com/superfly/wormhole/auth"
+	"github.com/superfly/wormhole/messages"
+	"github.com/superfly/wormhole/session"
+)
+
+var errUnknownSession = errors.New("tunnel conn not associated with any session")
+
+// resumableSession is a session the client can resume after reconnecting
+type resumableSession interface {
+	ResumeToken() string
+}
+
+// authSucceeded returns the AuthResult sent to the client once its session is listening
+func authSucceeded(sess session.Session) *messages.AuthResult {
+	result := &messages.AuthResult{SessionID: sess.ID(), TunnelAuth: true}
+	if r, ok := sess.(resumableSession); ok {
+		result.ResumeToken = r.ResumeToken()
+	}
+	for _, e := range sess.Endpoints() {
+		result.Endpoints = append(result.Endpoints, e.String())
+	}
+	return result
+}
+
+// authFailed returns the AuthResult sent to the client when it can't be served
+func authFailed(code messages.AuthErrorCode, err error) *messages.AuthResult {
+	return &messages.AuthResult{Code: code, Error: err.Error()}
+}
+
+// authErrorCode returns the code reported to the client when authentication fails with err
+func authErrorCode(err error) messages.AuthErrorCode {
+	switch err {
+	case session.ErrInvalidToken, session.ErrTokenNotAllowed, session.ErrInvalidClientCertificate, auth.ErrTokenExpired:
+		return messages.AuthInvalidToken
+	}
+	return messages.AuthServerError
+}
@@ -1,6 +1,16 @@
 package remote
 
-import "net"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+	"github.com/superfly/wormhole/session"
+)
 
 // Handler serves a connection.
 // It's the entry point for starting a session, managing a handshake, auth
@@ -9,3 +19,66 @@ type Handler interface {
 	Serve(net.Conn)
 	Close()
 }
+
+// authTimeout bounds the time clients have to send their auth message
+const authTimeout = 10 * time.Second
+
+// readAuthMessage reads the message clients send first, giving up after authTimeout
+func readAuthMessage(conn net.Conn, r *messages.Reader) (messages.Message, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+		return nil, err
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return msg, conn.SetReadDeadline(time.Time{})
+}
+
+// tlsServerConfig returns the TLS config of the TCP and HTTP2 handlers
+// Client certificates signed by the client CA are verified when one is configured
+func tlsServerConfig(cfg *config.ServerConfig) (*tls.Config, error) {
+	keyPair, err := tls.X509KeyPair(cfg.TLSCert, cfg.TLSPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+	}
+
+	if len(cfg.TLSClientCACert) != 0 {
+		pool := x509.NewCertPool()
+		if ok := pool.AppendCertsFromPEM(cfg.TLSClientCACert); !ok {
+			return nil, errors.New("couldn't append the client CA")
+		}
+		tlsConfig.ClientCAs = pool
+		// clients may still authenticate with a token unless certificates are required
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireTLSClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+// tunnelLimits returns the default tunnel limits of TCP and HTTP2 sessions
+func tunnelLimits(cfg *config.ServerConfig) session.TunnelLimits {
+	return session.TunnelLimits{
+		MinIdle:     cfg.TunnelMinIdle,
+		MaxTotal:    cfg.TunnelMaxTotal,
+		IdleTimeout: cfg.TunnelIdleTimeout,
+	}
+}
+
+// peerCertificate returns the certificate presented by the client during the TLS handshake, if any
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
@@ -2,15 +2,19 @@ package remote
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"io"
+	"io/ioutil"
 	"net"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/config"
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 	"github.com/superfly/wormhole/session"
+	"golang.org/x/net/http2"
 )
 
 // HTTP2Handler type represents the handler that accepts incoming wormhole connections
@@ -18,32 +22,45 @@ type HTTP2Handler struct {
 	nodeID     string
 	localhost  string
 	clusterURL string
+	region     string
 	registry   *session.Registry
-	pool       *redis.Pool
+	store      session.Store
 	logger     *logrus.Entry
 	tlsConfig  *tls.Config
 	lFactory   wnet.ListenerFactory
+	tokens     *auth.Verifier
+
+	tunnelLimits     session.TunnelLimits
+	gatewayErrorBody string
+	flushInterval    time.Duration
 }
 
 // NewHTTP2Handler ...
-func NewHTTP2Handler(cfg *config.ServerConfig, registry *session.Registry, pool *redis.Pool, factory wnet.ListenerFactory) (*HTTP2Handler, error) {
+func NewHTTP2Handler(cfg *config.ServerConfig, registry *session.Registry, store session.Store, factory wnet.ListenerFactory) (*HTTP2Handler, error) {
 	h := HTTP2Handler{
 		nodeID:     cfg.NodeID,
 		registry:   registry,
 		localhost:  cfg.Localhost,
 		clusterURL: cfg.ClusterURL,
-		pool:       pool,
+		region:     cfg.Region,
+		store:      store,
 		lFactory:   factory,
+		tokens:     auth.NewVerifier(cfg.TokenSigningKeys),
 		logger:     cfg.Logger.WithFields(logrus.Fields{"prefix": "HTTP2Handler"}),
+
+		tunnelLimits:     tunnelLimits(cfg),
+		gatewayErrorBody: cfg.GatewayErrorBody,
+		flushInterval:    cfg.FlushInterval,
 	}
 
-	crt, err := tls.X509KeyPair(cfg.TLSCert, cfg.TLSPrivateKey)
+	tlsConfig, err := tlsServerConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	h.tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{crt},
-	}
+	// control conns offering h2 along with ALPNHTTP2 carry their messages over a stream,
+	// tunnels offering it are authenticated on the conn they speak h2 on
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, wnet.ALPNHTTP2}
+	h.tlsConfig = tlsConfig
 	return &h, nil
 }
 
@@ -58,67 +75,85 @@ func (h *HTTP2Handler) Serve(conn net.Conn) {
 		return
 	}
 
-	buf := make([]byte, 1024)
-
-	waitClose := true
-	nr, err := tlsConn.Read(buf)
-	if err != nil {
-		// optimize for closing of initial TLS conn
-		if err == io.EOF {
-			waitClose = false
-		} else {
-			h.logger.Errorf("error reading from stream: " + err.Error())
-			return
-		}
-	}
-	msg, err := messages.Unpack(buf[:nr])
+	r := messages.NewReader(tlsConn)
+	msg, err := readAuthMessage(tlsConn, r)
 	if err != nil {
-		h.logger.Errorf("error parsing message from stream: " + err.Error())
+		h.logger.Errorf("error reading message from stream: " + err.Error())
+		tlsConn.Close()
 		return
 	}
 
 	switch m := msg.(type) {
 	case *messages.AuthControl:
-		go h.http2SessionHandler(tlsConn)
+		// clients negotiating h2 on their control conn exchange control messages over a stream of it
+		controlStream := tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+		go h.http2SessionHandler(wnet.NewBufferedConn(tlsConn, r), m, peerCertificate(tlsConn), controlStream)
 	case *messages.AuthTunnel:
-		if sess := h.registry.GetSession(m.ClientID); sess == nil {
-			h.logger.Error("New tunnel conn not associated with any session. Closing")
-			tlsConn.Close()
-		} else {
-			// open a proxy conn on current session
-			h.logger.Debugf("Adding New tunnel conn to session: %s", sess.ID())
-			http2Sess := sess.(*session.HTTP2Session)
-
-			for waitClose {
-				if _, err := tlsConn.Read(buf); err != nil {
-					if err != io.EOF {
-						h.logger.Errorf("Failed to get TLS Closed: %s", err.Error())
-						return
-					}
-					waitClose = false
-				}
-			}
-
-			if err := tlsConn.CloseWrite(); err != nil {
-				h.logger.Errorf("failed to close tls conn: %s", err.Error())
-			}
-			alpnConn, err := h.http2ALPNTLSWrap(conn)
-			if err != nil {
-				h.logger.Errorf("Couldn't establish ALPN connection")
-				return
-			}
-
-			if err := http2Sess.AddTunnel(alpnConn); err != nil {
-				h.logger.Errorf("Error establishing Tunnel: %v+", err)
-			}
-			h.logger.Debugf("Successfully Added New tunnel conn to session: %s", sess.ID())
-		}
+		h.handleTunnel(conn, tlsConn, r, m)
 	default:
 		h.logger.Error("unparsable response")
 		tlsConn.Close()
 	}
 }
 
+// handleTunnel authenticates a tunnel conn and adds it to its session
+// Clients which negotiated h2 serve it on the same TLS conn once authenticated. Others close
+// their side of it after the auth message, and do another TLS handshake negotiating h2.
+func (h *HTTP2Handler) handleTunnel(conn net.Conn, tlsConn *tls.Conn, r *messages.Reader, m *messages.AuthTunnel) {
+	w := messages.NewWriter(tlsConn)
+	// the registry holds the sessions of every transport
+	http2Sess, ok := h.registry.GetSession(m.ClientID).(*session.HTTP2Session)
+	if !ok {
+		h.logger.Error("New tunnel conn not associated with any HTTP2 session. Closing")
+		w.WriteMessage(authFailed(messages.AuthUnknownSession, errUnknownSession))
+		tlsConn.Close()
+		return
+	}
+	if err := http2Sess.AuthenticateTunnel(m.Token, peerCertificate(tlsConn)); err != nil {
+		h.logger.Errorf("Tunnel conn for session %s not authenticated: %s", http2Sess.ID(), err.Error())
+		w.WriteMessage(authFailed(authErrorCode(err), err))
+		tlsConn.Close()
+		return
+	}
+
+	// open a proxy conn on current session
+	h.logger.Debugf("Adding New tunnel conn to session: %s", http2Sess.ID())
+	var tunnel net.Conn
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		if err := w.WriteMessage(&messages.AuthResult{SessionID: http2Sess.ID()}); err != nil {
+			h.logger.Errorf("error acknowledging tunnel conn: %s", err.Error())
+			tlsConn.Close()
+			return
+		}
+		tunnel = wnet.NewBufferedConn(tlsConn, r)
+	} else {
+		// the client closes its side of the TLS conn after the auth message
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			h.logger.Errorf("Failed to get TLS Closed: %s", err.Error())
+			return
+		}
+
+		if err := w.WriteMessage(&messages.AuthResult{SessionID: http2Sess.ID()}); err != nil {
+			h.logger.Errorf("error acknowledging tunnel conn: %s", err.Error())
+			return
+		}
+		if err := tlsConn.CloseWrite(); err != nil {
+			h.logger.Errorf("failed to close tls conn: %s", err.Error())
+		}
+		alpnConn, err := h.http2ALPNTLSWrap(conn)
+		if err != nil {
+			h.logger.Errorf("Couldn't establish ALPN connection")
+			return
+		}
+		tunnel = alpnConn
+	}
+
+	if err := http2Sess.AddTunnel(tunnel); err != nil {
+		h.logger.Errorf("Error establishing Tunnel: %v+", err)
+	}
+	h.logger.Debugf("Successfully Added New tunnel conn to session: %s", http2Sess.ID())
+}
+
 func (h *HTTP2Handler) genericTLSWrap(conn net.Conn) (*tls.Conn, error) {
 	return wnet.GenericTLSWrap(conn, h.tlsConfig, tls.Server)
 }
@@ -136,13 +171,24 @@ func (h *HTTP2Handler) Close() {
 	h.lFactory.Close()
 }
 
-func (h *HTTP2Handler) http2SessionHandler(conn net.Conn) {
+func (h *HTTP2Handler) http2SessionHandler(conn net.Conn, auth *messages.AuthControl, cert *x509.Certificate, controlStream bool) {
 	args := &session.HTTP2SessionArgs{
-		Logger:    h.logger.Logger,
-		NodeID:    h.nodeID,
-		RedisPool: h.pool,
-		Conn:      conn,
-		TLSConfig: h.tlsConfig,
+		Logger:        h.logger.Logger,
+		NodeID:        h.nodeID,
+		Region:        h.region,
+		Store:         h.store,
+		Conn:          conn,
+		ControlStream: controlStream,
+		Token:         auth.Token,
+		ResumeToken:   auth.ResumeToken,
+		ClientCert:    cert,
+		TokenVerifier: h.tokens,
+		Registry:      h.registry,
+		TLSConfig:     h.tlsConfig,
+		TunnelLimits:  h.tunnelLimits,
+
+		GatewayErrorBody: h.gatewayErrorBody,
+		FlushInterval:    h.flushInterval,
 	}
 
 	sess, err := session.NewHTTP2Session(args)
@@ -150,19 +196,15 @@ func (h *HTTP2Handler) http2SessionHandler(conn net.Conn) {
 		h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error creating a session:", err)
 		return
 	}
-	h.registry.AddSession(sess)
-
-	if err := sess.RequireStream(); err != nil {
-		h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
-		return
-	}
+	defer h.closeSession(sess)
 
 	if err := sess.RequireAuthentication(); err != nil {
 		h.logger.Errorln(err)
+		sess.SendAuthResult(authFailed(authErrorCode(err), err))
 		return
 	}
-
-	defer h.closeSession(sess)
+	// the session ID is only final once authenticated since it may have been resumed
+	h.registry.AddSession(sess)
 
 	lnArgs := &wnet.ListenerFromFactoryArgs{
 		ID:       sess.ID(),
@@ -172,6 +214,7 @@ func (h *HTTP2Handler) http2SessionHandler(conn net.Conn) {
 	ln, err := h.lFactory.Listener(lnArgs)
 	if err != nil {
 		h.logger.Errorln(err)
+		sess.SendAuthResult(authFailed(messages.AuthServerError, err))
 		return
 	}
 
@@ -191,6 +234,22 @@ func (h *HTTP2Handler) http2SessionHandler(conn net.Conn) {
 
 	if err := sess.RegisterEndpoint(); err != nil {
 		h.logger.Errorln("Error registering endpoint:", err)
+		sess.SendAuthResult(authFailed(messages.AuthServerError, err))
+		ln.Close()
+		return
+	}
+
+	if err := sess.SendAuthResult(authSucceeded(sess)); err != nil {
+		h.logger.Errorln("Error sending auth result:", err)
+		ln.Close()
+		return
+	}
+
+	// tunnels are only requested once the client was told it's authenticated, with the final
+	// session ID, so that it knows to expect an AuthResult on them
+	if err := sess.RequireStream(); err != nil {
+		h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
+		ln.Close()
 		return
 	}
 
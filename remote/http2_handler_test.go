@@ -20,6 +20,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/superfly/tlstest"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/config"
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
@@ -63,6 +64,7 @@ func TestMain(m *testing.M) {
 
 	serverTLSConfig = &tls.Config{
 		Certificates: []tls.Certificate{serverTLSCert},
+		NextProtos:   []string{http2.NextProtoTLS, wnet.ALPNHTTP2},
 	}
 
 	certPool := x509.NewCertPool()
@@ -156,13 +158,13 @@ func TestNewHTTP2Handler(t *testing.T) {
 		ClusterURL:    "localhost",
 	}
 
-	h, err := NewHTTP2Handler(cfg, registry, redisPool, listenerFactory)
+	h, err := NewHTTP2Handler(cfg, registry, session.NewRedisStore(redisPool), listenerFactory)
 	assert.NoError(t, err, "Should be no error creating http2 handler")
 
 	hControl := &HTTP2Handler{
 		tlsConfig:  serverTLSConfig,
 		logger:     cfg.Logger.WithFields(log.Fields{"prefix": "HTTP2Handler"}),
-		pool:       redisPool,
+		store:      session.NewRedisStore(redisPool),
 		localhost:  "localhost",
 		clusterURL: "localhost",
 		registry:   registry,
@@ -177,7 +179,7 @@ func newTestHTTP2Handler() (*HTTP2Handler, error) {
 	h := &HTTP2Handler{
 		tlsConfig:  serverTLSConfig,
 		logger:     log.New().WithFields(log.Fields{"prefix": "TestHTTP2Handler"}),
-		pool:       redisPool,
+		store:      session.NewRedisStore(redisPool),
 		localhost:  "localhost",
 		clusterURL: "localhost",
 		registry:   registry,
@@ -249,8 +251,11 @@ func TestWrapsTLSOnServe(t *testing.T) {
 func wrapClientConn(cConn *net.TCPConn, tlsConf *tls.Config, alpn bool) (*tls.Conn, error) {
 
 	tlsConf = tlsConf.Clone()
-	// TODO: append here
-	tlsConf.NextProtos = []string{http2.NextProtoTLS}
+	// like clients, only the second handshake of tunnels negotiates h2
+	tlsConf.NextProtos = []string{wnet.ALPNHTTP2}
+	if alpn {
+		tlsConf.NextProtos = []string{http2.NextProtoTLS}
+	}
 	tlsConf.MinVersion = tls.VersionTLS12
 
 	var tlsClientConn *tls.Conn
@@ -310,6 +315,10 @@ func TestCreatesFullSession(t *testing.T) {
 
 	redisConn.Command("EXEC")
 
+	redisConn.Command("HGET", "backend_token_hashes", auth.HashToken("test")).Expect("test_backend")
+
+	redisConn.Command("HGET", "backend:test_backend", "client_auth_disabled").Expect(int64(1))
+
 	h, err := newTestHTTP2Handler()
 	assert.NoError(t, err, "Should be no error creating new HTTP2Handler")
 	assert.NotNil(t, h, "Handler shouldn't be nil")
@@ -324,6 +333,8 @@ func TestCreatesFullSession(t *testing.T) {
 	// Establish TLS connection
 	tlsCControlConn, err := wrapClientConn(cControlConn, clientTLSConfig, false)
 	assert.NoError(t, err, "Should have no error wrapping client in tls")
+	// keep the session open until the test is done
+	defer tlsCControlConn.Close()
 
 	authMessage := &messages.AuthControl{
 		Token: "test",
@@ -335,15 +346,21 @@ func TestCreatesFullSession(t *testing.T) {
 	_, err = tlsCControlConn.Write(authData)
 	assert.NoError(t, err, "Should be no error writing data")
 
-	tunData := make([]byte, 1024)
-	nr, err := tlsCControlConn.Read(tunData)
-	assert.NoError(t, err, "Should be no error reading tunnel message")
+	// tunnels are only requested once the client was told it's authenticated
+	controlReader := messages.NewReader(tlsCControlConn)
+	msg, err := controlReader.ReadMessage()
+	assert.NoError(t, err, "Should be no error reading auth result")
+	ctlResult, ok := msg.(*messages.AuthResult)
+	assert.True(t, ok, "Should be an auth result message")
+	assert.NoError(t, ctlResult.Err(), "Session should be authenticated")
+	assert.True(t, ctlResult.TunnelAuth, "Should announce tunnel auth results")
 
-	msg, err := messages.Unpack(tunData[:nr])
-	assert.NoError(t, err, "Should be no error unpacking message")
+	msg, err = controlReader.ReadMessage()
+	assert.NoError(t, err, "Should be no error reading tunnel message")
 
 	tunMessage, ok := msg.(*messages.OpenTunnel)
 	assert.True(t, ok, "Should be an opentunnel message")
+	assert.Equal(t, ctlResult.SessionID, tunMessage.ClientID, "Should request tunnels for the authenticated session")
 
 	// establish new connections for tunnel socket
 	sTunnelConn, cTunnelConn, err := newServerClientTCPConns()
@@ -356,6 +373,7 @@ func TestCreatesFullSession(t *testing.T) {
 
 	authTunMessage := &messages.AuthTunnel{
 		ClientID: tunMessage.ClientID,
+		Token:    "test",
 	}
 
 	authTunData, err := messages.Pack(authTunMessage)
@@ -367,6 +385,7 @@ func TestCreatesFullSession(t *testing.T) {
 	err = tlsCTunnelConn.CloseWrite()
 	assert.NoError(t, err, "Should have no error closing tunnel conn")
 
+	tunData := make([]byte, 1024)
 	for err == nil {
 		_, err = tlsCTunnelConn.Read(tunData)
 	}
@@ -378,10 +397,68 @@ func TestCreatesFullSession(t *testing.T) {
 
 	_ = alpnTunnelConn
 
+	// tunnels negotiating h2 along with ALPNHTTP2 take a single handshake
+	sTunnelConn, cTunnelConn, err = newServerClientTCPConns()
+	assert.NoError(t, err, "no error for conns")
+
+	go h.Serve(sTunnelConn)
+
+	tunTLSConfig := clientTLSConfig.Clone()
+	tunTLSConfig.NextProtos = []string{wnet.ALPNHTTP2, http2.NextProtoTLS}
+	tlsCTunnelConn, err = wnet.GenericTLSWrap(cTunnelConn, tunTLSConfig, tls.Client)
+	assert.NoError(t, err, "Should be no error wrapping client")
+	assert.Equal(t, http2.NextProtoTLS, tlsCTunnelConn.ConnectionState().NegotiatedProtocol, "Should negotiate h2")
+
+	_, err = tlsCTunnelConn.Write(authTunData)
+	assert.NoError(t, err, "Should have no error writing to tunnel conn")
+
+	r := messages.NewReader(tlsCTunnelConn)
+	msg, err = r.ReadMessage()
+	assert.NoError(t, err, "Should be no error reading auth result")
+	result, ok := msg.(*messages.AuthResult)
+	assert.True(t, ok, "Should be an auth result message")
+	assert.NoError(t, result.Err(), "Tunnel should be authenticated")
+
+	// the server starts h2 on the same conn right away
+	preface := make([]byte, len(http2.ClientPreface))
+	_, err = io.ReadFull(wnet.NewBufferedConn(tlsCTunnelConn, r), preface)
+	assert.NoError(t, err, "Should be no error reading h2 preface")
+	assert.Equal(t, http2.ClientPreface, string(preface), "Server should speak h2 after the auth result")
+
 	// TODO: Test throughput
 	//	 This is dependent on registering backend IDs with token upon creation like the SSH handler currently does
 }
 
+func TestTunnelForSessionOfAnotherTransport(t *testing.T) {
+	h, err := newTestHTTP2Handler()
+	assert.NoError(t, err, "Should be no error creating new HTTP2Handler")
+
+	ctlConn, _ := net.Pipe()
+	tcpSess := session.NewTCPSession(&session.TCPSessionArgs{
+		Logger: log.New(),
+		Store:  session.NewRedisStore(redisPool),
+		Conn:   ctlConn,
+	})
+	registry.AddSession(tcpSess)
+	defer registry.RemoveSession(tcpSess)
+
+	sTunnelConn, cTunnelConn, err := newServerClientTCPConns()
+	assert.NoError(t, err, "no error for conns")
+	go h.Serve(sTunnelConn)
+
+	tlsCTunnelConn, err := wrapClientConn(cTunnelConn, clientTLSConfig, false)
+	assert.NoError(t, err, "Should be no error wrapping client")
+
+	err = messages.NewWriter(tlsCTunnelConn).WriteMessage(&messages.AuthTunnel{ClientID: tcpSess.ID(), Token: "test"})
+	assert.NoError(t, err, "Should have no error writing to tunnel conn")
+
+	msg, err := messages.NewReader(tlsCTunnelConn).ReadMessage()
+	assert.NoError(t, err, "Should be no error reading auth result")
+	result, ok := msg.(*messages.AuthResult)
+	assert.True(t, ok, "Should be an auth result message")
+	assert.Equal(t, messages.AuthUnknownSession, result.Code, "Sessions of other transports should be unknown")
+}
+
 func init() {
 	redisConn = redigomock.NewConn()
 	redisPool = redis.NewPool(func() (redis.Conn, error) {
@@ -6,8 +6,8 @@ import (
 	"net"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/config"
 	wnet "github.com/superfly/wormhole/net"
 	"github.com/superfly/wormhole/session"
@@ -28,24 +28,27 @@ type SSHHandler struct {
 	clusterURL string
 	region     string
 	registry   *session.Registry
-	pool       *redis.Pool
+	store      session.Store
 	logger     *logrus.Entry
 	limiter    *limiter.Limiter
 	lFactory   wnet.ListenerFactory
+	tokens     *auth.Verifier
+
+	hostKeyFingerprints []string
 }
 
 // NewSSHHandler returns a new SSHHandler
-func NewSSHHandler(cfg *config.ServerConfig, registry *session.Registry, pool *redis.Pool, factory wnet.ListenerFactory) (*SSHHandler, error) {
+func NewSSHHandler(cfg *config.ServerConfig, registry *session.Registry, store session.Store, factory wnet.ListenerFactory) (*SSHHandler, error) {
 	rate, err := limiter.NewRateFromFormatted("30-M")
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create a rate limit for SSHHandler: %s", err.Error())
 	}
 	// use a in-memory store with a goroutine which clears expired keys every 30 seconds
-	store := limiter.NewMemoryStore()
+	limiterStore := limiter.NewMemoryStore()
 
-	limiterInstance := limiter.NewLimiter(store, rate)
+	limiterInstance := limiter.NewLimiter(limiterStore, rate)
 
-	config, err := makeConfig(cfg.SSHPrivateKey)
+	config, fingerprint, err := makeConfig(cfg.SSHPrivateKey)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create SSH Server Config: %s", err.Error())
 	}
@@ -56,15 +59,24 @@ func NewSSHHandler(cfg *config.ServerConfig, registry *session.Registry, pool *r
 		localhost:  cfg.Localhost,
 		clusterURL: cfg.ClusterURL,
 		region:     cfg.Region,
-		pool:       pool,
+		store:      store,
 		config:     config,
 		logger:     cfg.Logger.WithFields(logrus.Fields{"prefix": "SSHHandler"}),
 		limiter:    limiterInstance,
 		lFactory:   factory,
+		tokens:     auth.NewVerifier(cfg.TokenSigningKeys),
+
+		hostKeyFingerprints: []string{fingerprint},
 	}
 	return &s, nil
 }
 
+// HostKeyFingerprints returns the SHA256 fingerprints of the server host keys
+// Clients can pin them to verify the server
+func (s *SSHHandler) HostKeyFingerprints() []string {
+	return s.hostKeyFingerprints
+}
+
 // Serve accepts incoming wormhole connections and passes them to the handler
 func (s *SSHHandler) Serve(conn net.Conn) {
 	conn.RemoteAddr()
@@ -80,21 +92,22 @@ func (s *SSHHandler) Serve(conn net.Conn) {
 	s.sshSessionHandler(conn)
 }
 
-func makeConfig(key []byte) (*ssh.ServerConfig, error) {
+// makeConfig returns the SSH server config using key as host key, along with the key fingerprint
+func makeConfig(key []byte) (*ssh.ServerConfig, string, error) {
 	config := &ssh.ServerConfig{}
 
-	if private, err := ssh.ParsePrivateKey(key); err == nil {
-		config.AddHostKey(private)
-	} else {
-		return nil, err
+	private, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, "", err
 	}
+	config.AddHostKey(private)
 
-	return config, nil
+	return config, ssh.FingerprintSHA256(private.PublicKey()), nil
 }
 
 func (s *SSHHandler) sshSessionHandler(conn net.Conn) {
 	// Before use, a handshake must be performed on the incoming net.Conn.
-	sess := session.NewSSHSession(s.logger.Logger, s.clusterURL, s.nodeID, s.region, s.pool, conn, s.config)
+	sess := session.NewSSHSession(s.logger.Logger, s.clusterURL, s.nodeID, s.region, s.store, conn, s.config, s.tokens)
 	err := sess.RequireStream()
 	if err != nil {
 		s.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
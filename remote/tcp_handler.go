@@ -2,10 +2,11 @@ package remote
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/config"
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
@@ -18,34 +19,40 @@ type TCPHandler struct {
 	nodeID     string
 	localhost  string
 	clusterURL string
+	region     string
 	registry   *session.Registry
-	pool       *redis.Pool
+	store      session.Store
 	tlsConfig  *tls.Config
 	logger     *logrus.Entry
 	lFactory   wnet.ListenerFactory
+	tokens     *auth.Verifier
+
+	maxIngressConns int
+	tunnelLimits    session.TunnelLimits
 }
 
 // NewTCPHandler ...
-func NewTCPHandler(cfg *config.ServerConfig, registry *session.Registry, pool *redis.Pool, factory wnet.ListenerFactory) (*TCPHandler, error) {
+func NewTCPHandler(cfg *config.ServerConfig, registry *session.Registry, store session.Store, factory wnet.ListenerFactory) (*TCPHandler, error) {
 	h := TCPHandler{
 		nodeID:     cfg.NodeID,
 		registry:   registry,
 		localhost:  cfg.Localhost,
 		clusterURL: cfg.ClusterURL,
-		pool:       pool,
+		region:     cfg.Region,
+		store:      store,
 		lFactory:   factory,
+		tokens:     auth.NewVerifier(cfg.TokenSigningKeys),
 		logger:     cfg.Logger.WithFields(logrus.Fields{"prefix": "TCPHandler"}),
+
+		maxIngressConns: cfg.MaxIngressConns,
+		tunnelLimits:    tunnelLimits(cfg),
 	}
 
 	if len(cfg.TLSCert) != 0 && len(cfg.TLSPrivateKey) != 0 {
-		keyPair, err := tls.X509KeyPair(cfg.TLSCert, cfg.TLSPrivateKey)
+		sConf, err := tlsServerConfig(cfg)
 		if err != nil {
 			return nil, err
 		}
-
-		sConf := &tls.Config{
-			Certificates: []tls.Certificate{keyPair},
-		}
 		h.tlsConfig = sConf
 	}
 
@@ -60,40 +67,51 @@ func (h *TCPHandler) Serve(conn net.Conn) {
 		useConn, err = wnet.GenericTLSWrap(conn, h.tlsConfig, tls.Server)
 		if err != nil {
 			h.logger.Errorf("Error establishing TLS wrapping: " + err.Error())
+			conn.Close()
 			return
 		}
 	} else {
 		useConn = conn
 	}
 
-	buf := make([]byte, 1024)
-	nr, err := useConn.Read(buf)
+	r := messages.NewReader(useConn)
+	msg, err := readAuthMessage(useConn, r)
 	if err != nil {
-		h.logger.Errorf("error reading from stream: " + err.Error())
-		return
-	}
-	msg, err := messages.Unpack(buf[:nr])
-	if err != nil {
-		h.logger.Errorf("error parsing message from stream: " + err.Error())
+		h.logger.Errorf("error reading message from stream: " + err.Error())
+		useConn.Close()
 		return
 	}
+	cert := peerCertificate(useConn)
+	// don't lose data the client sent right after the auth message
+	useConn = wnet.NewBufferedConn(useConn, r)
 
 	switch m := msg.(type) {
 	case *messages.AuthControl:
-		go h.tcpSessionHandler(useConn)
+		go h.tcpSessionHandler(useConn, m, cert, "")
 	case *messages.AuthTunnel:
-		if sess := h.registry.GetSession(m.ClientID); sess == nil {
-			h.logger.Error("New tunnel conn not associated with any session. Closing")
-			conn.Close()
+		w := messages.NewWriter(useConn)
+		// the registry holds the sessions of every transport
+		if sess, ok := h.registry.GetSession(m.ClientID).(*session.TCPSession); !ok {
+			h.logger.Error("New tunnel conn not associated with any TCP session. Closing")
+			w.WriteMessage(authFailed(messages.AuthUnknownSession, errUnknownSession))
+			useConn.Close()
+		} else if err := sess.AuthenticateTunnel(m.Token, cert); err != nil {
+			h.logger.Errorf("Tunnel conn for session %s not authenticated: %s", sess.ID(), err.Error())
+			w.WriteMessage(authFailed(authErrorCode(err), err))
+			useConn.Close()
 		} else {
+			if err := w.WriteMessage(&messages.AuthResult{SessionID: sess.ID()}); err != nil {
+				h.logger.Errorf("error acknowledging tunnel conn: %s", err.Error())
+				useConn.Close()
+				return
+			}
 			// open a proxy conn on current session
 			h.logger.Debugf("Adding New tunnel conn to session: %s", sess.ID())
-			tcpSess := sess.(*session.TCPSession)
-			tcpSess.AddTunnel(useConn)
+			sess.AddTunnel(useConn)
 		}
 	default:
 		h.logger.Error("unparsable response")
-		conn.Close()
+		useConn.Close()
 	}
 }
 
@@ -102,26 +120,62 @@ func (h *TCPHandler) Close() {
 	h.lFactory.Close()
 }
 
-func (h *TCPHandler) tcpSessionHandler(conn net.Conn) {
+// tcpSessionHandler runs the session of a control conn until it's closed
+// protocol names the tunnel type of the session, the session picks it when empty
+func (h *TCPHandler) tcpSessionHandler(conn net.Conn, auth *messages.AuthControl, cert *x509.Certificate, protocol string) {
+	mux := auth.Mux
+	args := &session.TCPSessionArgs{
+		Logger:        h.logger.Logger,
+		NodeID:        h.nodeID,
+		Region:        h.region,
+		Store:         h.store,
+		Conn:          conn,
+		Token:         auth.Token,
+		ResumeToken:   auth.ResumeToken,
+		ClientCert:    cert,
+		TokenVerifier: h.tokens,
+		Registry:      h.registry,
+
+		MaxIngressConns: h.maxIngressConns,
+		TunnelLimits:    h.tunnelLimits,
+		Protocol:        protocol,
+	}
+
 	// Before use, a handshake must be performed on the incoming net.Conn.
-	sess := session.NewTCPSession(h.logger.Logger, h.nodeID, h.pool, conn)
-	h.registry.AddSession(sess)
+	var sess *session.TCPSession
+	if mux {
+		var err error
+		sess, err = session.NewTCPMuxSession(args)
+		if err != nil {
+			h.logger.Errorln("error creating multiplexed session:", err)
+			conn.Close()
+			return
+		}
+	} else {
+		sess = session.NewTCPSession(args)
+	}
+	sess.ClusterURL = h.clusterURL
+	defer h.closeSession(sess)
 
-	err := sess.RequireStream()
-	if err != nil {
-		h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
-		return
+	// in multiplexed mode the auth result is sent over the control stream,
+	// otherwise tunnels are only requested once the client was told it's authenticated
+	if mux {
+		if err := sess.RequireStream(); err != nil {
+			h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
+			return
+		}
 	}
 
-	err = sess.RequireAuthentication()
+	err := sess.RequireAuthentication()
 	if err != nil {
 		h.logger.Errorln(err)
+		sess.SendAuthResult(authFailed(authErrorCode(err), err))
 		return
 	}
 
 	h.logger.Println("Client authenticated.")
-
-	defer h.closeSession(sess)
+	// the session ID is only final once authenticated since it may have been resumed
+	h.registry.AddSession(sess)
 
 	/*
 		ln, err := listenTCP("tcp_ingress", sess)
@@ -139,6 +193,7 @@ func (h *TCPHandler) tcpSessionHandler(conn net.Conn) {
 	ln, err := h.lFactory.Listener(lnArgs)
 	if err != nil {
 		h.logger.Errorln(err)
+		sess.SendAuthResult(authFailed(messages.AuthServerError, err))
 		return
 	}
 
@@ -152,16 +207,31 @@ func (h *TCPHandler) tcpSessionHandler(conn net.Conn) {
 	} else {
 		sess.AddEndpoint(addr)
 	}
-	sess.ClusterURL = h.clusterURL
 	for _, e := range sess.Endpoints() {
 		h.logger.Infof("Session %s for %s (%s) listening on %s addr: %s", sess.ID(), sess.NodeID(), sess.Client(), e.Network(), e.String())
 	}
 
 	if err = sess.RegisterEndpoint(); err != nil {
 		h.logger.Errorln("Error registering endpoint:", err)
+		sess.SendAuthResult(authFailed(messages.AuthServerError, err))
+		ln.Close()
+		return
+	}
+
+	if err = sess.SendAuthResult(authSucceeded(sess)); err != nil {
+		h.logger.Errorln("Error sending auth result:", err)
+		ln.Close()
 		return
 	}
 
+	if !mux {
+		if err := sess.RequireStream(); err != nil {
+			h.logger.WithField("client_addr", conn.RemoteAddr().String()).Errorln("error getting a stream:", err)
+			ln.Close()
+			return
+		}
+	}
+
 	sess.HandleRequests(ln)
 }
 
@@ -0,0 +1,135 @@
+package remote
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+	wnet "github.com/superfly/wormhole/net"
+	"github.com/superfly/wormhole/session"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler type represents the handler that accepts wormhole connections
+// upgraded from HTTP/1.1 to websocket. Each websocket carries a multiplexed TCP session.
+type WebSocketHandler struct {
+	tcp    *TCPHandler
+	ln     *connListener
+	server *http.Server
+	logger *logrus.Entry
+}
+
+// NewWebSocketHandler returns a WebSocketHandler struct
+func NewWebSocketHandler(cfg *config.ServerConfig, registry *session.Registry, store session.Store, factory wnet.ListenerFactory) (*WebSocketHandler, error) {
+	tcp, err := NewTCPHandler(cfg, registry, store, factory)
+	if err != nil {
+		return nil, err
+	}
+	// TLS is terminated before the HTTP upgrade
+	tcp.tlsConfig = nil
+
+	h := &WebSocketHandler{
+		tcp:    tcp,
+		ln:     newConnListener(),
+		logger: cfg.Logger.WithFields(logrus.Fields{"prefix": "WebSocketHandler"}),
+	}
+	tcp.logger = h.logger
+
+	h.server = &http.Server{
+		Handler:           websocket.Server{Handler: h.serveWebSocket},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go h.server.Serve(h.ln)
+
+	return h, nil
+}
+
+// Serve passes the HTTP/1.1 upgrade request coming over conn to the websocket server
+func (h *WebSocketHandler) Serve(conn net.Conn) {
+	select {
+	case h.ln.conns <- conn:
+	case <-h.ln.closed:
+		conn.Close()
+	}
+}
+
+// Close closes all sessions handled by WebSocketHandler
+func (h *WebSocketHandler) Close() {
+	h.server.Close()
+	h.tcp.Close()
+}
+
+func (h *WebSocketHandler) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{Conn: ws}
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		conn.remoteAddr = addr
+	}
+
+	r := messages.NewReader(conn)
+	msg, err := readAuthMessage(conn, r)
+	if err != nil {
+		h.logger.Errorf("error reading message from websocket: %s", err.Error())
+		return
+	}
+
+	auth, ok := msg.(*messages.AuthControl)
+	if !ok {
+		h.logger.Error("unparsable response")
+		return
+	}
+	// the websocket is closed once this returns
+	// websocket tunnels are always multiplexed
+	auth.Mux = true
+	h.tcp.tcpSessionHandler(wnet.NewBufferedConn(conn, r), auth, nil, "ws")
+}
+
+// wsConn reports the address of the peer instead of the websocket origin
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// connListener is a net.Listener accepting conns handed over by the handler
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
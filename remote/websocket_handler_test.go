@@ -0,0 +1,54 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/config"
+	"github.com/superfly/wormhole/messages"
+	wnet "github.com/superfly/wormhole/net"
+	"github.com/superfly/wormhole/session"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketHandlerOpensControlStream(t *testing.T) {
+	cfg := &config.ServerConfig{
+		Config: config.Config{
+			Logger:    log.New(),
+			Localhost: "localhost",
+		},
+		NodeID:     "1",
+		ClusterURL: "localhost",
+	}
+
+	h, err := NewWebSocketHandler(cfg, registry, session.NewRedisStore(redisPool), listenerFactory)
+	assert.NoError(t, err, "Should be no error creating websocket handler")
+	defer h.server.Close()
+
+	sConn, cConn, err := newServerClientTCPConns()
+	assert.NoError(t, err, "Should be no error creating server/client TCP conns")
+
+	go h.Serve(sConn)
+
+	wsConfig, err := websocket.NewConfig("ws://127.0.0.1/", "http://127.0.0.1/")
+	assert.NoError(t, err, "Should be no error creating websocket config")
+
+	ws, err := websocket.NewClient(wsConfig, cConn)
+	assert.NoError(t, err, "Should be no error upgrading to websocket")
+	ws.PayloadType = websocket.BinaryFrame
+
+	authData, err := messages.Pack(&messages.AuthControl{Token: "test", Mux: true})
+	assert.NoError(t, err, "Should be no error packing message")
+
+	_, err = ws.Write(authData)
+	assert.NoError(t, err, "Should be no error writing auth message")
+
+	client, err := yamux.Client(ws, wnet.MuxConfig())
+	assert.NoError(t, err, "Should be no error creating mux client")
+	defer client.Close()
+
+	_, err = client.Accept()
+	assert.NoError(t, err, "Should be no error accepting control stream")
+}
@@ -0,0 +1,188 @@
+package wormhole
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/soheilhy/cmux"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/tlstest"
+	"github.com/superfly/wormhole/config"
+	handler "github.com/superfly/wormhole/remote"
+)
+
+// connHandler hands the conns it serves over to the test
+type connHandler struct {
+	conns chan net.Conn
+}
+
+func newConnHandler() *connHandler {
+	return &connHandler{conns: make(chan net.Conn, 1)}
+}
+
+func (h *connHandler) Serve(conn net.Conn) {
+	h.conns <- conn
+}
+
+func (h *connHandler) Close() {}
+
+func (h *connHandler) accept(t *testing.T) net.Conn {
+	select {
+	case conn := <-h.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler got no conn")
+		return nil
+	}
+}
+
+func testSharedPortConfig(t *testing.T) *config.ServerConfig {
+	_, crtPEM, keyPEM, err := tlstest.CreateServerCertKeyPEMPairWithRootCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config.ServerConfig{
+		Config: config.Config{
+			Logger: logrus.New(),
+		},
+		LegacyTLSProtocol:       config.UNSUPPORTED,
+		SharedPortTLSCert:       crtPEM,
+		SharedPortTLSPrivateKey: keyPEM,
+	}
+}
+
+// serveSharedPort serves the handlers on a local port and returns its address and the API listener
+func serveSharedPort(t *testing.T, cfg *config.ServerConfig, handlers map[config.TunnelProto]handler.Handler) (string, net.Listener, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cmux.New(l)
+	apiL, err := muxSharedPort(m, &handler.Server{Logger: cfg.Logger}, handlers, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Serve()
+	return l.Addr().String(), apiL, func() { l.Close() }
+}
+
+func writeWebSocketUpgrade(t *testing.T, conn net.Conn) {
+	req, err := http.NewRequest("GET", "http://"+conn.RemoteAddr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedPortRefusesPlaintextWebSocket(t *testing.T) {
+	cfg := testSharedPortConfig(t)
+	ws := newConnHandler()
+	addr, _, closeL := serveSharedPort(t, cfg, map[config.TunnelProto]handler.Handler{config.WS: ws})
+	defer closeL()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err, "Should be no error dialing the shared port")
+	defer conn.Close()
+	writeWebSocketUpgrade(t, conn)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.Error(t, err, "Plaintext upgrade should be refused by secure servers")
+	if ne, ok := err.(net.Error); ok {
+		assert.False(t, ne.Timeout(), "Conn should be closed by the server")
+	}
+
+	select {
+	case <-ws.conns:
+		t.Fatal("Plaintext upgrade shouldn't reach the websocket handler")
+	default:
+	}
+}
+
+func TestSharedPortAcceptsPlaintextWebSocketWhenInsecure(t *testing.T) {
+	cfg := testSharedPortConfig(t)
+	cfg.Insecure = true
+	ws := newConnHandler()
+	addr, _, closeL := serveSharedPort(t, cfg, map[config.TunnelProto]handler.Handler{config.WS: ws})
+	defer closeL()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err, "Should be no error dialing the shared port")
+	defer conn.Close()
+	writeWebSocketUpgrade(t, conn)
+
+	ws.accept(t).Close()
+}
+
+// getAPI sends a request to the API through the shared port, advertising protos with ALPN
+func getAPI(addr string, protos ...string) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: protos},
+		},
+		Timeout: 5 * time.Second,
+	}
+	return client.Get("https://" + addr + "/")
+}
+
+func serveAPI(l net.Listener) {
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+}
+
+func TestSharedPortAPIWithoutALPN(t *testing.T) {
+	cfg := testSharedPortConfig(t)
+	tcp := newConnHandler()
+	addr, apiL, closeL := serveSharedPort(t, cfg, map[config.TunnelProto]handler.Handler{config.TCP: tcp})
+	defer closeL()
+	go serveAPI(apiL)
+
+	resp, err := getAPI(addr)
+	assert.NoError(t, err, "API clients without ALPN should reach the API without a legacy transport")
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "api", string(body))
+	}
+}
+
+func TestSharedPortAPIWithLegacyTLSProtocol(t *testing.T) {
+	cfg := testSharedPortConfig(t)
+	cfg.LegacyTLSProtocol = config.TCP
+	tcp := newConnHandler()
+	addr, apiL, closeL := serveSharedPort(t, cfg, map[config.TunnelProto]handler.Handler{config.TCP: tcp})
+	defer closeL()
+	go serveAPI(apiL)
+
+	t.Run("Test_without_ALPN", func(t *testing.T) {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := getAPI(addr)
+			errc <- err
+		}()
+		// API clients have to advertise ALPN once TLS conns without it go to the legacy transport
+		tcp.accept(t).Close()
+		assert.Error(t, <-errc, "API clients without ALPN should be served by the legacy transport")
+	})
+
+	t.Run("Test_with_ALPN", func(t *testing.T) {
+		resp, err := getAPI(addr, "http/1.1")
+		assert.NoError(t, err, "API clients advertising http/1.1 should reach the API")
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "api", string(body))
+		}
+	})
+}
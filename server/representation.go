@@ -7,4 +7,7 @@ type Representation struct {
 	Address string `msg:"url" json:"address"`
 	Port    string `msg:"port" json:"port"`
 	Region  string `msg:"region" json:"region"`
+	// HostKeyFingerprints lists the SHA256 fingerprints of the SSH host keys
+	// so that clients can pin them
+	HostKeyFingerprints []string `msg:"host_key_fingerprints" json:"host_key_fingerprints,omitempty"`
 }
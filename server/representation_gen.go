@@ -39,6 +39,23 @@ func (z *Representation) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "host_key_fingerprints":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				return
+			}
+			if cap(z.HostKeyFingerprints) >= int(zb0002) {
+				z.HostKeyFingerprints = (z.HostKeyFingerprints)[:zb0002]
+			} else {
+				z.HostKeyFingerprints = make([]string, zb0002)
+			}
+			for za0001 := range z.HostKeyFingerprints {
+				z.HostKeyFingerprints[za0001], err = dc.ReadString()
+				if err != nil {
+					return
+				}
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -50,10 +67,10 @@ func (z *Representation) DecodeMsg(dc *msgp.Reader) (err error) {
 }
 
 // EncodeMsg implements msgp.Encodable
-func (z Representation) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 3
+func (z *Representation) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 4
 	// write "url"
-	err = en.Append(0x83, 0xa3, 0x75, 0x72, 0x6c)
+	err = en.Append(0x84, 0xa3, 0x75, 0x72, 0x6c)
 	if err != nil {
 		return
 	}
@@ -79,15 +96,30 @@ func (z Representation) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "host_key_fingerprints"
+	err = en.Append(0xb5, 0x68, 0x6f, 0x73, 0x74, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x66, 0x69, 0x6e, 0x67, 0x65, 0x72, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.HostKeyFingerprints)))
+	if err != nil {
+		return
+	}
+	for za0001 := range z.HostKeyFingerprints {
+		err = en.WriteString(z.HostKeyFingerprints[za0001])
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
-func (z Representation) MarshalMsg(b []byte) (o []byte, err error) {
+func (z *Representation) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 3
+	// map header, size 4
 	// string "url"
-	o = append(o, 0x83, 0xa3, 0x75, 0x72, 0x6c)
+	o = append(o, 0x84, 0xa3, 0x75, 0x72, 0x6c)
 	o = msgp.AppendString(o, z.Address)
 	// string "port"
 	o = append(o, 0xa4, 0x70, 0x6f, 0x72, 0x74)
@@ -95,6 +127,12 @@ func (z Representation) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "region"
 	o = append(o, 0xa6, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e)
 	o = msgp.AppendString(o, z.Region)
+	// string "host_key_fingerprints"
+	o = append(o, 0xb5, 0x68, 0x6f, 0x73, 0x74, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x66, 0x69, 0x6e, 0x67, 0x65, 0x72, 0x70, 0x72, 0x69, 0x6e, 0x74, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.HostKeyFingerprints)))
+	for za0001 := range z.HostKeyFingerprints {
+		o = msgp.AppendString(o, z.HostKeyFingerprints[za0001])
+	}
 	return
 }
 
@@ -129,6 +167,23 @@ func (z *Representation) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			if err != nil {
 				return
 			}
+		case "host_key_fingerprints":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				return
+			}
+			if cap(z.HostKeyFingerprints) >= int(zb0002) {
+				z.HostKeyFingerprints = (z.HostKeyFingerprints)[:zb0002]
+			} else {
+				z.HostKeyFingerprints = make([]string, zb0002)
+			}
+			for za0001 := range z.HostKeyFingerprints {
+				z.HostKeyFingerprints[za0001], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					return
+				}
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -141,7 +196,10 @@ func (z *Representation) UnmarshalMsg(bts []byte) (o []byte, err error) {
 }
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
-func (z Representation) Msgsize() (s int) {
-	s = 1 + 4 + msgp.StringPrefixSize + len(z.Address) + 5 + msgp.StringPrefixSize + len(z.Port) + 7 + msgp.StringPrefixSize + len(z.Region)
+func (z *Representation) Msgsize() (s int) {
+	s = 1 + 4 + msgp.StringPrefixSize + len(z.Address) + 5 + msgp.StringPrefixSize + len(z.Port) + 7 + msgp.StringPrefixSize + len(z.Region) + 22 + msgp.ArrayHeaderSize
+	for za0001 := range z.HostKeyFingerprints {
+		s += msgp.StringPrefixSize + len(z.HostKeyFingerprints[za0001])
+	}
 	return
 }
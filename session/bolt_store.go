@@ -0,0 +1,81 @@
+package session
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// NewBoltStore returns a KVStore persisted in a bolt database at path
+// The database is locked by a single process, so the store can't be shared by several servers
+func NewBoltStore(path string) (*KVStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return newKVStore(&boltDB{db: db}), nil
+}
+
+// boltDB is a kvDB with a bolt bucket per kvTx bucket
+type boltDB struct {
+	db *bolt.DB
+}
+
+func (b *boltDB) view(fn func(tx kvTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltDB) update(fn func(tx kvTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltDB) close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) get(bucket, key string) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	// values are only valid for the life of the transaction
+	value := b.Get([]byte(key))
+	if value == nil {
+		return nil
+	}
+	return append([]byte(nil), value...)
+}
+
+func (t *boltTx) put(bucket, key string, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func (t *boltTx) delete(bucket, key string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func (t *boltTx) forEach(bucket string, fn func(key string, value []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
@@ -1,113 +1,308 @@
 package session
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // HTTP2Session extends information about connected client stored in Session.
 // It also includes:
-// - control connection for exchanging communication with the client
-// - channel with available tunnel connections
+// - control connection for exchanging communication with the client, or a stream on a tunnel
+// - pool of tunnel connections, grown with the streams in use and kept within its tunnel limits
 // - timestamp with the last known ping from the client
 type HTTP2Session struct {
 	baseSession
 
-	control   net.Conn
-	conns     wnet.ConnPool
-	server    *http.Server
-	transport *http2.Transport
+	token      string
+	resumeWith string
+	clientCert *x509.Certificate
+	registry   *Registry
+	control    io.ReadWriteCloser
+	reader     *messages.Reader
+	writer     *messages.Writer
+	conns      wnet.ConnPool
+	connsSize  int
+	tunnels    *tunnelPool
+	server     *http.Server
+	transport  *http2.Transport
+
+	// gatewayErrorBody is sent with the responses to requests which couldn't be proxied
+	gatewayErrorBody string
+	// flushInterval is how long response bodies may be buffered, see wnet.CopyResponse
+	flushInterval time.Duration
+
+	// tunnelConns are the tunnels in conns, for maintainTunnels to go through
+	tunnelConns []*http2Tunnel
+	tunnelsMu   sync.Mutex
+	// controlTunnel carries the control stream, if the session has one
+	controlTunnel *http2Tunnel
 
 	lastPingAt int64
+	closed     chan struct{}
+	closeOnce  sync.Once
 }
 
+const (
+	// maxTunnelStreams is the number of requests proxied at once over a tunnel
+	maxTunnelStreams = 10
+	// tunnelRetryInterval is how often a request waits for a stream while every tunnel is full
+	tunnelRetryInterval = 100 * time.Millisecond
+	// maxRequestAttempts is the number of tunnels a replayable request is tried over
+	maxRequestAttempts = 3
+	// controlPingInterval is how often the tunnel carrying the control stream is pinged
+	controlPingInterval = 2 * time.Second
+	// controlCloseTimeout bounds the wait for the last control messages to reach the client
+	controlCloseTimeout = 2 * time.Second
+)
+
 // HTTP2SessionArgs defines the arguments to be passed to NewHTTP2Session
 type HTTP2SessionArgs struct {
 	Logger    *logrus.Logger
 	NodeID    string
+	Region    string
 	TLSConfig *tls.Config
-	RedisPool *redis.Pool
+	Store     Store
 	Conn      net.Conn
+	// ControlStream tells Conn negotiated h2, the control messages are then exchanged over
+	// a stream the session opens on it, and it becomes the first tunnel of the session
+	ControlStream bool
+	// Token and ResumeToken are the ones sent by the client in AuthControl
+	Token       string
+	ResumeToken string
+	// ClientCert is the TLS certificate presented by the client, if any
+	ClientCert *x509.Certificate
+	// TokenVerifier verifies signed tokens, if configured
+	TokenVerifier *auth.Verifier
+	// Registry holds the sessions which may be taken over when resuming
+	Registry *Registry
+	// TunnelLimits bound the tunnel connections of the session, unless the backend sets its own
+	// Unset limits default to DefaultTunnelLimits
+	TunnelLimits TunnelLimits
+	// GatewayErrorBody replaces the status text of the responses to requests which couldn't be proxied
+	GatewayErrorBody string
+	// FlushInterval is how long response bodies of known length may be buffered before
+	// they're flushed, see wnet.CopyResponse
+	FlushInterval time.Duration
 }
 
 // NewHTTP2Session creates new TCPSession struct
 func NewHTTP2Session(args *HTTP2SessionArgs) (*HTTP2Session, error) {
 	base := baseSession{
-		id:     xid.New().String(),
-		nodeID: args.NodeID,
-		store:  NewRedisStore(args.RedisPool),
-		logger: args.Logger.WithFields(logrus.Fields{"prefix": "HTTP2Session"}),
+		id:         xid.New().String(),
+		nodeID:     args.NodeID,
+		clientAddr: args.Conn.RemoteAddr().String(),
+		store:      args.Store,
+		RegionID:   args.Region,
+		protocol:   "http2",
+		tokens:     args.TokenVerifier,
+		logger:     args.Logger.WithFields(logrus.Fields{"prefix": "HTTP2Session"}),
 	}
 	s := &HTTP2Session{
-		control:     args.Conn,
+		token:       args.Token,
+		resumeWith:  args.ResumeToken,
+		clientCert:  args.ClientCert,
+		registry:    args.Registry,
 		baseSession: base,
 		transport:   &http2.Transport{},
 		lastPingAt:  time.Now().UnixNano(),
+		closed:      make(chan struct{}),
+
+		gatewayErrorBody: args.GatewayErrorBody,
+		flushInterval:    args.FlushInterval,
 	}
+	limits := args.TunnelLimits.withDefaults(DefaultTunnelLimits)
+	s.tunnels = newTunnelPool(limits, s.openTunnel)
 
+	h2s := &http2.Server{}
 	server := &http.Server{
-		Handler:   s,
+		// ingress HTTP/2 comes without TLS (h2c), e.g. from gRPC clients
+		Handler:   h2c.NewHandler(s, h2s),
 		TLSConfig: args.TLSConfig.Clone(), // Currently doesn't do anything since we listen with tcp
 	}
 
-	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+	if err := http2.ConfigureServer(server, h2s); err != nil {
 		return nil, err
 	}
 
 	s.server = server
 
+	if err := s.newConnPool(limits.MaxTotal); err != nil {
+		return nil, err
+	}
+
+	control := io.ReadWriteCloser(args.Conn)
+	if args.ControlStream {
+		stream, err := s.openControlStream(args.Conn)
+		if err != nil {
+			return nil, err
+		}
+		control = stream
+	}
+	s.control = control
+	s.reader = messages.NewReader(control)
+	s.writer = messages.NewWriter(control)
+
+	return s, nil
+}
+
+// openControlStream opens the stream carrying the control messages on conn, which
+// becomes the control tunnel of the session. The stream closes the tunnel once closed.
+func (s *HTTP2Session) openControlStream(conn net.Conn) (io.ReadWriteCloser, error) {
+	cc, err := s.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the request body carries the messages sent to the client
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+conn.RemoteAddr().String(), pr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.ContentLength = -1
+	req.Header.Set(wnet.ControlStreamHeader, "1")
+
+	// the stream lasts as long as the session so the request has no deadline, the client
+	// must still answer within tunnelTimeoutInterval
+	timer := time.AfterFunc(tunnelTimeoutInterval, func() { conn.Close() })
+	resp, err := cc.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		pw.Close()
+		conn.Close()
+		return nil, fmt.Errorf("Couldn't open control stream: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		conn.Close()
+		return nil, fmt.Errorf("Couldn't open control stream: client answered %s", resp.Status)
+	}
+
+	s.controlTunnel = newHTTP2Tunnel(conn, cc)
+	s.controlTunnel.control = true
+	return wnet.NewStreamConn(resp.Body, pw, func() error {
+		pw.Close()
+		// let the last messages, e.g. a failed auth result, reach the client
+		ctx, cancel := context.WithTimeout(context.Background(), controlCloseTimeout)
+		defer cancel()
+		cc.Shutdown(ctx)
+		resp.Body.Close()
+		return conn.Close()
+	}), nil
+}
+
+func (s *HTTP2Session) newConnPool(size int) error {
+	if s.conns != nil {
+		s.conns.Close()
+	}
 	pool, err := wnet.NewConnPool(
-		args.Logger.WithFields(logrus.Fields{"prefix": "HTTP2ConnPool"}),
-		10,
+		s.logger.Logger.WithFields(logrus.Fields{"prefix": "HTTP2ConnPool"}),
+		int64(size),
 		[]wnet.ConnPoolObject{})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	s.conns = pool
-
-	return s, nil
+	s.connsSize = size
+	return nil
 }
 
+// retiredStreams is the stream count of a tunnel closed for being idle, no stream can be acquired on it
+const retiredStreams = ^uint32(0)
+
 type http2Tunnel struct {
-	conn        *tls.Conn
+	// lastUsedAt is accessed atomically, it's kept first for 64-bit alignment
+	lastUsedAt int64
+
+	conn        net.Conn
 	cc          *http2.ClientConn
 	cStreams    uint32
 	maxCStreams uint32
+	// control tunnels carry the control stream of their session, they're never retired
+	control bool
 
 	valC chan int
 }
 
+func newHTTP2Tunnel(conn net.Conn, cc *http2.ClientConn) *http2Tunnel {
+	t := &http2Tunnel{
+		lastUsedAt:  time.Now().UnixNano(),
+		conn:        conn,
+		cc:          cc,
+		cStreams:    0,
+		maxCStreams: maxTunnelStreams,
+		valC:        make(chan int, 1),
+	}
+	// set initial value to 0
+	t.valC <- 0
+	return t
+}
+
 func (c *http2Tunnel) Close() error {
 	return c.conn.Close()
 }
 
 func (c *http2Tunnel) ShouldDelete() bool {
-	return !c.cc.CanTakeNewRequest()
+	return atomic.LoadUint32(&c.cStreams) == retiredStreams || !c.cc.CanTakeNewRequest()
 }
 
 func (c *http2Tunnel) Value() <-chan int {
 	return c.valC
 }
 
-func (c *http2Tunnel) incrementStreamCount() {
-	atomic.AddUint32(&c.cStreams, 1)
+// acquireStream counts a new stream on the tunnel, unless it carries maxCStreams already
+func (c *http2Tunnel) acquireStream() bool {
+	for {
+		n := atomic.LoadUint32(&c.cStreams)
+		if n >= c.maxCStreams {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&c.cStreams, n, n+1) {
+			c.updateValue()
+			return true
+		}
+	}
+}
+
+// releaseStream uncounts a stream acquired on the tunnel, once its response is copied
+func (c *http2Tunnel) releaseStream() {
+	if atomic.AddUint32(&c.cStreams, ^uint32(0)) == 0 {
+		atomic.StoreInt64(&c.lastUsedAt, time.Now().UnixNano())
+	}
+	c.updateValue()
+}
+
+// streams returns the number of streams acquired on the tunnel
+func (c *http2Tunnel) streams() uint32 {
+	return atomic.LoadUint32(&c.cStreams)
 }
 
-func (c *http2Tunnel) decrementStreamCount() {
-	atomic.AddUint32(&c.cStreams, ^uint32(0))
+// retireIdle stops the tunnel from taking streams if it had none for timeout
+func (c *http2Tunnel) retireIdle(timeout time.Duration) bool {
+	if c.control {
+		return false
+	}
+	lastUsed := time.Unix(0, atomic.LoadInt64(&c.lastUsedAt))
+	return time.Since(lastUsed) >= timeout && atomic.CompareAndSwapUint32(&c.cStreams, 0, retiredStreams)
 }
 
 func (c *http2Tunnel) rewriteRequest(r *http.Request) {
@@ -117,53 +312,190 @@ func (c *http2Tunnel) rewriteRequest(r *http.Request) {
 	r.RequestURI = ""
 }
 
+// updateValue replaces the stream count the pool hasn't read yet, if any
 func (c *http2Tunnel) updateValue() {
-	c.valC <- int(atomic.LoadUint32(&c.cStreams))
+	select {
+	case <-c.valC:
+	default:
+	}
+	select {
+	case c.valC <- int(atomic.LoadUint32(&c.cStreams)):
+	default:
+	}
 }
 
+// RoundTrip sends the request over a stream acquired with acquireStream
 func (c *http2Tunnel) RoundTrip(r *http.Request) (*http.Response, error) {
 	c.rewriteRequest(r)
-
-	c.incrementStreamCount()
-	defer c.decrementStreamCount()
-
-	go c.updateValue()
-
 	return c.cc.RoundTrip(r)
 }
 
-// AddTunnel adds a connection to the pool of tunnel connections
-func (s *HTTP2Session) AddTunnel(conn *tls.Conn) error {
+// AddTunnel adds a connection to the pool of tunnel connections, it must have negotiated h2
+// It's discarded if the session has as many tunnels as its limits allow
+func (s *HTTP2Session) AddTunnel(conn net.Conn) error {
+	if !s.tunnels.add() {
+		s.logger.Warnf("Session has %d tunnels already, discarding.", s.tunnels.limits().MaxTotal)
+		return conn.Close()
+	}
+
 	cc, err := s.transport.NewClientConn(conn)
 	if err != nil {
+		s.tunnels.remove()
 		return err
 	}
+	return s.insertTunnel(newHTTP2Tunnel(conn, cc))
+}
 
-	poolObj := &http2Tunnel{
-		conn:        conn,
-		cc:          cc,
-		cStreams:    0,
-		maxCStreams: 10,
-		valC:        make(chan int, 1),
-	}
-
-	// set initial value to 0
-	poolObj.valC <- 0
-	ok, err := s.conns.Insert(poolObj)
+// insertTunnel adds a tunnel counted by s.tunnels to the pool
+func (s *HTTP2Session) insertTunnel(t *http2Tunnel) error {
+	ok, err := s.conns.Insert(t)
 	if err != nil {
+		s.tunnels.remove()
 		return err
 	}
 	if !ok {
 		s.logger.Warn("Connection pool is full while trying to add ClientConn")
+		s.tunnels.remove()
+		return t.Close()
 	}
 
+	s.tunnelsMu.Lock()
+	s.tunnelConns = append(s.tunnelConns, t)
+	s.tunnelsMu.Unlock()
 	return nil
 }
 
-// RequireStream sends a request to the client to open a new tunnel Connection
-// for this Session.
+// RequireStream sends requests to the client to open the MinIdle tunnel connections
+// of this Session. The control tunnel, if any, serves requests as well and counts as one.
 func (s *HTTP2Session) RequireStream() error {
-	return s.openTunnel()
+	idle := 0
+	if s.controlTunnel != nil && s.tunnels.add() {
+		if err := s.insertTunnel(s.controlTunnel); err != nil {
+			return err
+		}
+		idle = 1
+	}
+	return s.tunnels.fill(idle)
+}
+
+// getTunnel gets a tunnel from the pool and acquires a stream on it
+// If every tunnel carries maxTunnelStreams, another tunnel is requested and it retries
+// until tunnelTimeoutInterval. It requests another tunnel as well when the streams in
+// use cross tunnelGrowthThreshold of the capacity of the tunnels.
+func (s *HTTP2Session) getTunnel(ctx context.Context) (wnet.ConnPoolContext, *http2Tunnel, error) {
+	ctx, cancel := context.WithTimeout(ctx, tunnelTimeoutInterval)
+	defer cancel()
+	for {
+		obj, err := s.conns.GetContext(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Couldn't get a tunnel: %s", err.Error())
+		}
+		tunnel, ok := obj.ConnPoolObject().(*http2Tunnel)
+		if !ok {
+			obj.Done()
+			return nil, nil, fmt.Errorf("Got wrong object type from connection pool")
+		}
+		if tunnel.ShouldDelete() {
+			obj.Done()
+			continue
+		}
+		if tunnel.acquireStream() {
+			if s.streamUtilization() >= tunnelGrowthThreshold {
+				if err := s.tunnels.grow(); err != nil {
+					s.logger.Error(err)
+				}
+			}
+			return obj, tunnel, nil
+		}
+		obj.Done()
+
+		// the least busy tunnel is full
+		if err := s.tunnels.grow(); err != nil {
+			return nil, nil, err
+		}
+		select {
+		case <-time.After(tunnelRetryInterval):
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("Couldn't get a tunnel stream: %s", ctx.Err().Error())
+		}
+	}
+}
+
+// streamUtilization returns the share of the stream capacity of its tunnels the session uses
+func (s *HTTP2Session) streamUtilization() float64 {
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+
+	var streams, capacity uint32
+	for _, t := range s.tunnelConns {
+		if t.ShouldDelete() {
+			continue
+		}
+		streams += t.streams()
+		capacity += t.maxCStreams
+	}
+	if capacity == 0 {
+		return 1
+	}
+	return float64(streams) / float64(capacity)
+}
+
+// maintainTunnels drops the tunnels closed by the client, closes those beyond MinIdle unused
+// for IdleTimeout and requests new ones to keep MinIdle idle tunnels
+func (s *HTTP2Session) maintainTunnels() {
+	check := time.NewTicker(connCheckInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-check.C:
+		}
+
+		limits := s.tunnels.limits()
+		s.tunnelsMu.Lock()
+		live := s.tunnelConns[:0]
+		for _, t := range s.tunnelConns {
+			// closed by the client, or out of streams once its requests are done
+			if t.ShouldDelete() && t.streams() == 0 {
+				s.removeTunnel(t)
+				continue
+			}
+			live = append(live, t)
+		}
+
+		idle, closed := 0, 0
+		s.tunnelConns = live[:0]
+		for _, t := range live {
+			if len(live)-closed > limits.MinIdle && t.retireIdle(limits.IdleTimeout) {
+				s.removeTunnel(t)
+				closed++
+				continue
+			}
+			if t.streams() == 0 {
+				idle++
+			}
+			s.tunnelConns = append(s.tunnelConns, t)
+		}
+		s.tunnelsMu.Unlock()
+
+		if closed > 0 {
+			s.logger.Debugf("Closed %d idle tunnels", closed)
+		}
+		if err := s.tunnels.fill(idle); err != nil {
+			s.logger.Error(err)
+		}
+	}
+}
+
+// removeTunnel removes a tunnel from the pool and closes it
+func (s *HTTP2Session) removeTunnel(t *http2Tunnel) {
+	if ok, _ := s.conns.Remove(t); !ok {
+		// the pool drops tunnels which can't take new requests by itself
+		t.Close()
+	}
+	s.tunnels.remove()
 }
 
 // HandleRequests handles all requests coming over the control connection from the client.
@@ -172,18 +504,50 @@ func (s *HTTP2Session) RequireStream() error {
 // It also handles out-of-band communication, like the maintaining the Session heartbeat or
 // request the client to open new tunnel connections.
 func (s *HTTP2Session) HandleRequests(ln net.Listener) {
+	s.reportOpened()
 	go s.controlLoop()
 	go s.heartbeat()
+	if s.controlTunnel != nil {
+		go s.pingControlTunnel()
+	}
+	go s.maintainTunnels()
 	s.handleRemoteForward(ln)
 }
 
-// RequireAuthentication registers the connection
-// TODO: add authentication here
+// RequireAuthentication resolves the backend from the client certificate or the token sent by the client,
+// resumes the previous session if the client presented a valid resume token
+// and registers the connection
 func (s *HTTP2Session) RequireAuthentication() error {
+	if err := s.authFromCredentials(s.token, s.clientCert); err != nil {
+		return err
+	}
+	s.resume(s.resumeWith, s.registry)
+	if err := s.issueResumeToken(); err != nil {
+		s.logger.Errorf("Couldn't issue resume token: %s", err.Error())
+	}
+	if err := s.setTunnelLimits(s.backendTunnelLimits(s.tunnels.limits())); err != nil {
+		return err
+	}
 	s.store.RegisterConnection(s)
 	return nil
 }
 
+// setTunnelLimits replaces the tunnel limits of the session
+// Tunnels are only requested once the client is authenticated, so the pool can still be
+// replaced by a larger one
+func (s *HTTP2Session) setTunnelLimits(limits TunnelLimits) error {
+	s.tunnels.setLimits(limits)
+	if limits.MaxTotal > s.connsSize {
+		return s.newConnPool(limits.MaxTotal)
+	}
+	return nil
+}
+
+// SendAuthResult tells the client whether it was authenticated over the control connection
+func (s *HTTP2Session) SendAuthResult(result *messages.AuthResult) error {
+	return s.writer.WriteMessage(result)
+}
+
 // RegisterEndpoint registers the endpoint and adds it to the current session record
 // The endpoint is a particular instance of a running wormhole client
 func (s *HTTP2Session) RegisterEndpoint() error {
@@ -192,10 +556,16 @@ func (s *HTTP2Session) RegisterEndpoint() error {
 
 // Close closes SSHSession and registers disconnection
 func (s *HTTP2Session) Close() {
-	s.store.RegisterDisconnection(s)
-	s.logger.Infof("Closed session %s for %s %s (%s).", s.ID(), s.NodeID(), s.Agent(), s.Client())
-	s.server.Close()
-	s.control.Close()
+	s.closeOnce.Do(func() {
+		s.store.RegisterDisconnection(s)
+		s.reportClosed()
+		s.expireResumeToken()
+		close(s.closed)
+		s.logger.Infof("Closed session %s for %s %s (%s).", s.ID(), s.NodeID(), s.Agent(), s.Client())
+		s.server.Close()
+		s.conns.Close()
+		s.control.Close()
+	})
 }
 
 // handleRemoteForward listens for TLS connection and connects it to a session
@@ -220,65 +590,152 @@ func (s *HTTP2Session) handleRemoteForward(ln net.Listener) {
 	}
 }
 
-// ServeHTTP...
+// ServeHTTP forwards ingress requests to the client over a tunnel connection
 func (s *HTTP2Session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var resp *http.Response
-	var err error
-	for {
-		obj := s.conns.Get()
-		defer obj.Done()
+	rec := newStatusRecorder(w)
+	start := time.Now()
+	s.serveHTTP(rec, r)
+	s.reportHTTPRequest(rec.status, time.Since(start))
+}
 
-		conn, ok := obj.ConnPoolObject().(*http2Tunnel)
-		if !ok {
-			s.logger.Error("Got wrong object type from connection pool")
-			return
-		}
+func (s *HTTP2Session) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// these are only ever set by the server, ingress requests can't ask for them
+	r.Header.Del(wnet.ControlStreamHeader)
+	r.Header.Del(wnet.UpgradeHeader)
+	if wnet.IsUpgradeRequest(r) {
+		s.serveUpgrade(w, r)
+		return
+	}
 
-		// HTTP2 doesn't support these header types, so delete them
-		// This is if the end client doesn't support HTTP2
-		// Taken from go core at net/http2/transport.go
-		if v := r.Header.Get("Upgrade"); v != "" {
-			r.Header.Del("Upgrade")
-		}
-		if v := r.Header.Get("Transfer-Encoding"); (v != "" && v != "chunked") || len(r.Header["Transfer-Encoding"]) > 1 {
-			r.Header.Del("Transfer-Encoding")
-		}
-		if v := r.Header.Get("Connection"); (v != "" && v != "close" && v != "keep-alive") || len(r.Header["Connection"]) > 1 {
-			r.Header.Del("Connection")
+	// HTTP2 doesn't support these header types, so delete them
+	// This is if the end client doesn't support HTTP2
+	// Taken from go core at net/http2/transport.go
+	if v := r.Header.Get("Upgrade"); v != "" {
+		r.Header.Del("Upgrade")
+	}
+	if v := r.Header.Get("Transfer-Encoding"); (v != "" && v != "chunked") || len(r.Header["Transfer-Encoding"]) > 1 {
+		r.Header.Del("Transfer-Encoding")
+	}
+	if v := r.Header.Get("Connection"); (v != "" && v != "close" && v != "keep-alive") || len(r.Header["Connection"]) > 1 {
+		r.Header.Del("Connection")
+	}
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		obj, conn, err := s.getTunnel(r.Context())
+		if err != nil {
+			s.gatewayError(w, wnet.NoTunnel, err)
+			return
 		}
 
 		resp, err = conn.RoundTrip(r)
-		// TODO: Handle this error
-		if err != nil {
-			if conn.ShouldDelete() {
-				continue
-			}
-			s.logger.Warnf("Error with requiest: %+v", err)
-			if netErr, ok := err.(net.Error); !ok {
-				// do something not network error related
-				// maybe retry?
-				_ = netErr
-			}
+		if err == nil {
+			defer obj.Done()
+			defer conn.releaseStream()
 			break
 		}
-		break
+		conn.releaseStream()
+		obj.Done()
+
+		if attempt >= maxRequestAttempts || !isReplayable(r) || r.Context().Err() != nil {
+			s.gatewayError(w, wnet.TunnelBroken, err)
+			return
+		}
+		s.logger.WithField("error_class", wnet.TunnelBroken).Debugf("Retrying request over another tunnel: %s", err.Error())
 	}
+	defer resp.Body.Close()
+	s.copyResponse(w, resp)
+}
 
-	// Delete this so we don't copy it over
-	// Will be handled by http.ResponseWriter
-	resp.Header.Del("Content-Length")
+// serveUpgrade carries an HTTP/1.1 upgrade request, e.g. to a websocket, to the client over
+// a tunnel stream. Once the local endpoint switched protocols, the ingress connection is
+// hijacked and spliced with the stream, which holds on to its tunnel until either side closes.
+func (s *HTTP2Session) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	obj, conn, err := s.getTunnel(r.Context())
+	if err != nil {
+		s.gatewayError(w, wnet.NoTunnel, err)
+		return
+	}
+	defer obj.Done()
+	defer conn.releaseStream()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	upgrade := r.Header.Get("Upgrade")
+	r.Header.Del("Upgrade")
+	r.Header.Del("Connection")
+	r.Header.Set(wnet.UpgradeHeader, upgrade)
+
+	// the request body carries what the ingress connection sends once upgraded
+	pr, pw := io.Pipe()
+	r.Body = pr
+	r.ContentLength = -1
+
+	resp, err := conn.RoundTrip(r)
+	if err != nil {
+		pw.Close()
+		s.gatewayError(w, wnet.TunnelBroken, err)
+		return
+	}
+	stream := wnet.NewStreamConn(resp.Body, pw, func() error {
+		pw.Close()
+		return resp.Body.Close()
+	})
+	defer stream.Close()
+
+	upgraded := resp.Header.Get(wnet.UpgradeHeader)
+	if resp.StatusCode != http.StatusOK || upgraded == "" {
+		// the local endpoint didn't switch protocols, its response is passed through
+		s.copyResponse(w, resp)
+		return
 	}
 
-	w.WriteHeader(resp.StatusCode)
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		s.logger.Error("Ingress connection can't be hijacked")
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+	ingress, buf, err := hj.Hijack()
+	if err != nil {
+		s.logger.Errorf("Couldn't hijack ingress connection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	resp.Header.Del(wnet.UpgradeHeader)
+	resp.Header.Del(wnet.TunnelErrorHeader)
+	resp.Header.Del(wnet.GatewayErrorHeader)
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n", upgraded)
+	resp.Header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		s.logger.Errorf("Couldn't switch protocols of ingress connection: %s", err.Error())
+		ingress.Close()
+		return
+	}
 
-	defer resp.Body.Close()
+	done := s.reportIngressConn()
+	sent, rcvd, err := wnet.CopyCloseIO(wnet.NewBufferedConn(ingress, buf.Reader), stream)
+	done(rcvd, sent)
+	if err != nil {
+		s.logger.Debugf("Upgraded connection closed: %s", err.Error())
+	}
+}
+
+// copyResponse writes a response received from the client to w
+func (s *HTTP2Session) copyResponse(w http.ResponseWriter, resp *http.Response) {
+	// only the client sets the tunnel error header, the class header of a response
+	// without it comes from the local endpoint and isn't trusted
+	class := resp.Header.Get(wnet.TunnelErrorHeader)
+	resp.Header.Del(wnet.TunnelErrorHeader)
+	resp.Header.Del(wnet.GatewayErrorHeader)
+	if class != "" {
+		// the client couldn't reach the local endpoint
+		s.reportGatewayError(wnet.GatewayErrorClass(class))
+		resp.Header.Set(wnet.GatewayErrorHeader, class)
+	}
+	// only meaningful to serveUpgrade, it isn't passed on to ingress
+	resp.Header.Del(wnet.UpgradeHeader)
 
-	nr, err := io.Copy(w, resp.Body)
+	nr, err := wnet.CopyResponse(w, resp, s.flushInterval)
 	if err != nil {
 		s.logger.Errorf("Could not copy response body")
 		return
@@ -286,14 +743,30 @@ func (s *HTTP2Session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.logger.Infof("Copied %d bytes between connection bodies", nr)
 }
 
+// gatewayError answers a request which couldn't be proxied to the client, and reports it
+func (s *HTTP2Session) gatewayError(w http.ResponseWriter, class wnet.GatewayErrorClass, err error) {
+	s.logger.WithField("error_class", class).Warnf("Couldn't proxy request: %s", err.Error())
+	s.reportGatewayError(class)
+	wnet.WriteGatewayError(w, class, s.gatewayErrorBody)
+}
+
+// isReplayable tells whether a request may be sent again after a tunnel failed, possibly
+// once the client got it: it's idempotent and has no body to send again
+// These are the rules of net/http for retrying requests
+func isReplayable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
 func (s *HTTP2Session) openTunnel() error {
 	msg := &messages.OpenTunnel{ClientID: s.id}
-	b, err := messages.Pack(msg)
-	if err != nil {
-		return fmt.Errorf("Couldn't create a request to open new tunnel: %s", err.Error())
-	}
-	_, err = s.control.Write(b)
-	if err != nil {
+	if err := s.writer.WriteMessage(msg); err != nil {
 		return fmt.Errorf("Failed to send request to open new tunnel: %s", err.Error())
 	}
 	return nil
@@ -316,22 +789,39 @@ func (s *HTTP2Session) heartbeat() {
 	}
 }
 
-func (s *HTTP2Session) controlLoop() {
-	b := make([]byte, 1024)
+// pingControlTunnel sends an HTTP/2 PING over the control tunnel every controlPingInterval,
+// instead of the client sending Ping messages. Acknowledged PINGs keep the session alive and
+// their round trip time is recorded, the session is closed once one isn't.
+func (s *HTTP2Session) pingControlTunnel() {
+	ping := time.NewTicker(controlPingInterval)
+	defer ping.Stop()
 
 	for {
-		nr, err := s.control.Read(b)
-		if err == io.EOF {
-			continue
+		select {
+		case <-s.closed:
+			return
+		case <-ping.C:
 		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeoutInterval)
+		start := time.Now()
+		err := s.controlTunnel.cc.Ping(ctx)
+		cancel()
 		if err != nil {
-			s.logger.Errorf("error reading from control: " + err.Error())
+			s.logger.Errorf("Control tunnel didn't answer PING: %s", err.Error())
 			s.Close()
 			return
 		}
-		msg, err := messages.Unpack(b[:nr])
+		atomic.StoreInt64(&s.lastPingAt, time.Now().UnixNano())
+		s.registerHeartbeat(time.Since(start))
+	}
+}
+
+func (s *HTTP2Session) controlLoop() {
+	for {
+		msg, err := s.reader.ReadMessage()
 		if err != nil {
-			s.logger.Errorf("error parsing message from stream: " + err.Error())
+			s.logger.Errorf("error reading message from control: " + err.Error())
 			s.Close()
 			return
 		}
@@ -343,14 +833,13 @@ func (s *HTTP2Session) controlLoop() {
 		case *messages.Ping:
 			s.logger.Debug("Received Ping message.")
 			atomic.StoreInt64(&s.lastPingAt, time.Now().UnixNano())
-			bw, err := messages.Pack(&messages.Pong{})
-			if err != nil {
-				s.logger.Errorf("Couldn't create a Pong message: %s", err.Error())
-			}
-			_, err = s.control.Write(bw)
-			if err != nil {
+			if err := s.writer.WriteMessage(&messages.Pong{}); err != nil {
 				s.logger.Errorf("Failed to send Pong message: %s", err.Error())
 			}
+			s.registerHeartbeat(time.Duration(m.RTT))
+		case *messages.Release:
+			s.logger.Debugf("Received Release message: %s", m.ID)
+			s.updateRelease(m)
 		default:
 			s.logger.Warn("Unrecognized command. Ignoring.")
 		}
@@ -1,12 +1,19 @@
 package session
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -15,6 +22,14 @@ import (
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 )
 
 func newServerClientTLSConns(alpn bool) (serverTLSConn *tls.Conn, clientTLSConn *tls.Conn, err error) {
@@ -93,7 +108,7 @@ func TestHTTP2Session(t *testing.T) {
 		Logger:    log.New(),
 		NodeID:    "test_id",
 		TLSConfig: serverTLSConfig,
-		RedisPool: redisPool,
+		Store:     NewRedisStore(redisPool),
 		Conn:      sConn,
 	}
 
@@ -153,3 +168,368 @@ func TestHTTP2Session(t *testing.T) {
 
 	})
 }
+
+func TestHTTP2SessionTunnelGrowth(t *testing.T) {
+	sConn, cConn, err := newServerClientTLSConns(false)
+	assert.NoError(t, err, "Should be no error creating conns")
+
+	s, err := NewHTTP2Session(&HTTP2SessionArgs{
+		Logger:       log.New(),
+		NodeID:       "test_id",
+		TLSConfig:    serverTLSConfig,
+		Store:        NewRedisStore(redisPool),
+		Conn:         sConn,
+		TunnelLimits: TunnelLimits{MinIdle: 1, MaxTotal: 2},
+	})
+	assert.NoError(t, err, "Should be no error creating http2 session")
+
+	sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+	assert.NoError(t, err, "Should be no error getting new conns")
+	go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+	assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+	var tunnel *http2Tunnel
+	for i := 0; i < maxTunnelStreams-3; i++ {
+		obj, acquired, err := s.getTunnel(context.Background())
+		assert.NoError(t, err, "Should be no error getting a tunnel stream")
+		obj.Done()
+		tunnel = acquired
+	}
+	assert.Equal(t, uint32(maxTunnelStreams-3), tunnel.streams())
+
+	_, _, err = s.getTunnel(context.Background())
+	assert.NoError(t, err, "Should be no error getting a tunnel stream")
+
+	msg, err := messages.NewReader(cConn).ReadMessage()
+	assert.NoError(t, err, "Should be no error reading message")
+	assert.IsType(t, &messages.OpenTunnel{}, msg, "Should request a tunnel once streams cross the threshold")
+}
+
+func TestHTTP2SessionGatewayErrors(t *testing.T) {
+	sConn, _, err := newServerClientTLSConns(false)
+	assert.NoError(t, err, "Should be no error creating conns")
+
+	s, err := NewHTTP2Session(&HTTP2SessionArgs{
+		Logger:           log.New(),
+		NodeID:           "test_id",
+		TLSConfig:        serverTLSConfig,
+		Store:            NewRedisStore(redisPool),
+		Conn:             sConn,
+		GatewayErrorBody: "Try again later",
+	})
+	assert.NoError(t, err, "Should be no error creating http2 session")
+	s.backendID = "gateway_errors_backend"
+
+	gatewayErrors := func(class wnet.GatewayErrorClass) float64 {
+		labels := s.metricLabels()
+		labels["class"] = string(class)
+		return metricValue(t, sessionHTTPGatewayErrorsMetric.With(labels))
+	}
+
+	t.Run("Test_no_tunnel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "Try again later\n", w.Body.String(), "Should send the configured body")
+		assert.Equal(t, "no_tunnel", w.Header().Get(wnet.GatewayErrorHeader))
+		assert.Equal(t, 1.0, gatewayErrors(wnet.NoTunnel))
+	})
+
+	t.Run("Test_tunnel_broken", func(t *testing.T) {
+		sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+		assert.NoError(t, err, "Should be no error getting new conns")
+
+		var attempts int32
+		go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				// resets the stream, the tunnel stays usable
+				panic(http.ErrAbortHandler)
+			}),
+		})
+		assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, "tunnel_broken", w.Header().Get(wnet.GatewayErrorHeader))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&attempts), "Shouldn't replay a request with a body")
+
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, int32(1+maxRequestAttempts), atomic.LoadInt32(&attempts), "Should replay an idempotent request")
+		assert.Equal(t, 2.0, gatewayErrors(wnet.TunnelBroken))
+	})
+
+	t.Run("Test_local_error", func(t *testing.T) {
+		sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+		assert.NoError(t, err, "Should be no error getting new conns")
+
+		go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(wnet.TunnelErrorHeader, string(wnet.LocalTimeout))
+				wnet.WriteGatewayError(w, wnet.LocalTimeout, "")
+			}),
+		})
+		// the tunnel resetting streams stays in the pool otherwise
+		assert.NoError(t, s.newConnPool(1), "Should be no error replacing the connection pool")
+		assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code, "Should pass the response of the client through")
+		assert.Equal(t, "local_timeout", w.Header().Get(wnet.GatewayErrorHeader))
+		assert.Empty(t, w.Header().Get(wnet.TunnelErrorHeader), "Shouldn't pass the tunnel error header on")
+		assert.Equal(t, 1.0, gatewayErrors(wnet.LocalTimeout), "Should report the error of the client")
+	})
+
+	t.Run("Test_local_endpoint_class", func(t *testing.T) {
+		sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+		assert.NoError(t, err, "Should be no error getting new conns")
+
+		go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// a response of the local endpoint, which the client passed through
+				w.Header().Set(wnet.GatewayErrorHeader, "made_up")
+				w.WriteHeader(http.StatusBadGateway)
+			}),
+		})
+		assert.NoError(t, s.newConnPool(1), "Should be no error replacing the connection pool")
+		assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusBadGateway, w.Code, "Should pass the response of the local endpoint through")
+		assert.Empty(t, w.Header().Get(wnet.GatewayErrorHeader), "Shouldn't pass a class set by the local endpoint on")
+		assert.Equal(t, 0.0, gatewayErrors("made_up"), "Shouldn't report a class set by the local endpoint")
+	})
+}
+
+func TestHTTP2SessionUpgrade(t *testing.T) {
+	sConn, _, err := newServerClientTLSConns(false)
+	assert.NoError(t, err, "Should be no error creating conns")
+
+	s, err := NewHTTP2Session(&HTTP2SessionArgs{
+		Logger:    log.New(),
+		NodeID:    "test_id",
+		TLSConfig: serverTLSConfig,
+		Store:     NewRedisStore(redisPool),
+		Conn:      sConn,
+	})
+	assert.NoError(t, err, "Should be no error creating http2 session")
+
+	sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+	assert.NoError(t, err, "Should be no error getting new conns")
+
+	// the client side of the tunnel, switching to an echo protocol
+	go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/plain" {
+				w.Header().Set("Smuggled", r.Header.Get(wnet.UpgradeHeader))
+				w.Header().Set(wnet.UpgradeHeader, "echo")
+				return
+			}
+			if r.Header.Get(wnet.UpgradeHeader) != "echo" || r.Header.Get("Upgrade") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set(wnet.UpgradeHeader, "echo")
+			w.Header().Set("Echo-Accept", r.Header.Get("Echo-Key"))
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			stream := wnet.NewStreamConn(r.Body, w, r.Body.Close)
+			io.Copy(stream, stream)
+		}),
+	})
+	assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err, "Should have no error listening")
+	go s.handleRemoteForward(ln)
+	defer s.server.Close()
+
+	ingress, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err, "Should have no error dialing ingress")
+	defer ingress.Close()
+
+	fmt.Fprint(ingress, "GET /echo HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\nEcho-Key: key\r\n\r\n")
+	buf := bufio.NewReader(ingress)
+	resp, err := http.ReadResponse(buf, nil)
+	assert.NoError(t, err, "Should have no error reading the response")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "key", resp.Header.Get("Echo-Accept"), "Should pass the headers of the client through")
+
+	fmt.Fprint(ingress, "ping")
+	b := make([]byte, 4)
+	_, err = io.ReadFull(buf, b)
+	assert.NoError(t, err, "Should have no error reading from the upgraded connection")
+	assert.Equal(t, "ping", string(b))
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/plain", nil)
+	req.Header.Set(wnet.UpgradeHeader, "echo")
+	plain, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err, "Should have no error sending a plain request")
+	plain.Body.Close()
+	assert.Equal(t, http.StatusOK, plain.StatusCode)
+	assert.Equal(t, "", plain.Header.Get("Smuggled"), "Should strip the upgrade header from ingress requests")
+	assert.Equal(t, "", plain.Header.Get(wnet.UpgradeHeader), "Should strip the upgrade header from responses")
+}
+
+func TestHTTP2SessionGRPC(t *testing.T) {
+	sConn, _, err := newServerClientTLSConns(false)
+	assert.NoError(t, err, "Should be no error creating conns")
+
+	s, err := NewHTTP2Session(&HTTP2SessionArgs{
+		Logger:    log.New(),
+		NodeID:    "test_id",
+		TLSConfig: serverTLSConfig,
+		Store:     NewRedisStore(redisPool),
+		Conn:      sConn,
+	})
+	assert.NoError(t, err, "Should be no error creating http2 session")
+
+	// the client side of the tunnel serves gRPC in process
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("wormhole", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	reflection.Register(grpcServer)
+
+	sHTTPConn, cHTTPConn, err := newServerClientTLSConns(true)
+	assert.NoError(t, err, "Should be no error getting new conns")
+	go (&http2.Server{}).ServeConn(cHTTPConn, &http2.ServeConnOpts{Handler: grpcServer})
+	assert.NoError(t, s.AddTunnel(sHTTPConn), "Should be no error adding tunnel")
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err, "Should have no error listening")
+	go s.handleRemoteForward(ln)
+	defer s.server.Close()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err, "Should have no error dialing ingress")
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("Test_unary", func(t *testing.T) {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "wormhole"})
+		assert.NoError(t, err, "Should have no error calling the service")
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+	})
+
+	t.Run("Test_trailers", func(t *testing.T) {
+		_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err), "Should get the status from the trailers")
+	})
+
+	t.Run("Test_bidirectional_stream", func(t *testing.T) {
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		assert.NoError(t, err, "Should have no error opening a stream")
+		req := &reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		}
+		// each response is received before the next request is sent
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, stream.Send(req), "Should have no error sending on the stream")
+			resp, err := stream.Recv()
+			assert.NoError(t, err, "Should have no error receiving from the stream")
+			assert.NotEmpty(t, resp.GetListServicesResponse().GetService())
+		}
+		assert.NoError(t, stream.CloseSend())
+	})
+}
+
+func TestHTTP2SessionControlStream(t *testing.T) {
+	sConn, cConn, err := newServerClientTLSConns(true)
+	assert.NoError(t, err, "Should be no error creating conns")
+
+	// the client side of the control tunnel
+	streams := make(chan io.ReadWriteCloser, 1)
+	go (&http2.Server{}).ServeConn(cConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(wnet.ControlStreamHeader) == "" {
+				fmt.Fprint(w, "test")
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			done := make(chan struct{})
+			streams <- wnet.NewStreamConn(r.Body, w, func() error {
+				close(done)
+				return nil
+			})
+			<-done
+		}),
+	})
+
+	s, err := NewHTTP2Session(&HTTP2SessionArgs{
+		Logger:        log.New(),
+		NodeID:        "test_id",
+		TLSConfig:     serverTLSConfig,
+		Store:         NewRedisStore(redisPool),
+		Conn:          sConn,
+		ControlStream: true,
+	})
+	assert.NoError(t, err, "Should be no error creating http2 session")
+	stream := <-streams
+
+	t.Run("Test_control_messages", func(t *testing.T) {
+		reader, writer := messages.NewReader(stream), messages.NewWriter(stream)
+		assert.NoError(t, s.SendAuthResult(&messages.AuthResult{SessionID: s.ID()}))
+		msg, err := reader.ReadMessage()
+		assert.NoError(t, err, "Should be no error reading the auth result")
+		assert.Equal(t, &messages.AuthResult{SessionID: s.ID()}, msg)
+
+		go s.controlLoop()
+		assert.NoError(t, writer.WriteMessage(&messages.Release{ID: "v1"}))
+		// the session answers the Ping once the release is handled
+		assert.NoError(t, writer.WriteMessage(&messages.Ping{}))
+		msg, err = reader.ReadMessage()
+		assert.NoError(t, err, "Should be no error reading Pong")
+		assert.IsType(t, &messages.Pong{}, msg)
+		assert.Equal(t, "v1", s.Release().ID, "Should get the release over the control stream")
+	})
+
+	t.Run("Test_round_trip", func(t *testing.T) {
+		assert.NoError(t, s.RequireStream(), "Should be no error requiring streams")
+		open, pending := s.tunnels.counts()
+		assert.Equal(t, 1, open, "The control tunnel should count as a tunnel")
+		assert.Equal(t, 0, pending, "Should request no other tunnel")
+
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err, "Should have no error listening")
+		go s.handleRemoteForward(ln)
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s", ln.Addr().String()), nil)
+		assert.NoError(t, err, "Should have no error making request")
+		req.Header.Set(wnet.ControlStreamHeader, "1")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "Should not have error requesting")
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err, "Should have no error reading body")
+		assert.Equal(t, "test", string(body), "Ingress requests shouldn't open a control stream")
+	})
+
+	t.Run("Test_ping", func(t *testing.T) {
+		go s.pingControlTunnel()
+		for deadline := time.Now().Add(2 * controlPingInterval); s.RTT() == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.NotZero(t, s.RTT(), "Should measure the RTT of PINGs")
+	})
+
+	t.Run("Test_closed_by_client", func(t *testing.T) {
+		cConn.Close()
+		select {
+		case <-s.closed:
+		case <-time.After(time.Second):
+			t.Error("Session should close with its control tunnel")
+		}
+	})
+}
@@ -0,0 +1,486 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/superfly/wormhole/auth"
+	wnet "github.com/superfly/wormhole/net"
+)
+
+const (
+	sessionsBucket     = "sessions"
+	resumeTokensBucket = "resume_tokens"
+)
+
+// kvTx is a transaction over buckets of keys, as provided by embedded databases
+// Reading a missing bucket or key returns nothing, writing to a missing bucket creates it
+type kvTx interface {
+	get(bucket, key string) []byte
+	put(bucket, key string, value []byte) error
+	delete(bucket, key string) error
+	forEach(bucket string, fn func(key string, value []byte) error) error
+}
+
+// kvDB is a database running transactions
+type kvDB interface {
+	view(fn func(tx kvTx) error) error
+	update(fn func(tx kvTx) error) error
+	close() error
+}
+
+// KVStore is session persistence in an embedded key/value database, for single node deployments.
+// It mirrors the layout of RedisStore with buckets in place of Redis keys, but only keeps
+// what wormhole reads back: session and endpoint attributes are removed on disconnection.
+// Backends are provisioned with the Add and Set methods.
+type KVStore struct {
+	db  kvDB
+	now func() time.Time
+}
+
+func newKVStore(db kvDB) *KVStore {
+	return &KVStore{db: db, now: time.Now}
+}
+
+// Close closes the underlying database
+func (r *KVStore) Close() error {
+	return r.db.close()
+}
+
+// RegisterConnection stores Session connection info
+func (r *KVStore) RegisterConnection(s Session) error {
+	t := r.now().Format(time.RFC3339)
+	return r.db.update(func(tx kvTx) error {
+		return putHash(tx, sessionsBucket, s.ID(), map[string]string{
+			"id":           s.ID(),
+			"node_id":      s.NodeID(),
+			"backend_id":   s.BackendID(),
+			"cluster":      s.Cluster(),
+			"region":       s.Region(),
+			"client_addr":  s.Client(),
+			"agent":        s.Agent(),
+			"connected_at": t,
+			"last_seen_at": t,
+		})
+	})
+}
+
+// RegisterDisconnection removes Session connection info and its endpoints
+func (r *KVStore) RegisterDisconnection(s Session) error {
+	return r.db.update(func(tx kvTx) error {
+		for _, endpointAddr := range s.Endpoints() {
+			if err := tx.delete(endpointsBucket(s.BackendID()), redisEndpointString(endpointAddr)); err != nil {
+				return err
+			}
+		}
+		return tx.delete(sessionsBucket, s.ID())
+	})
+}
+
+// RegisterEndpoint updates the cluster of the stored session and stores its endpoints
+func (r *KVStore) RegisterEndpoint(s Session) error {
+	t := r.now().Format(time.RFC3339)
+	return r.db.update(func(tx kvTx) error {
+		if err := putHash(tx, sessionsBucket, s.ID(), map[string]string{"cluster": s.Cluster()}); err != nil {
+			return err
+		}
+		for _, endpointAddr := range s.Endpoints() {
+			endpoint := map[string]string{
+				"session_id":   s.ID(),
+				"backend_id":   s.BackendID(),
+				"cluster":      s.Cluster(),
+				"region":       s.Region(),
+				"connected_at": t,
+				"last_seen_at": t,
+			}
+			if extended, ok := endpointAddr.(wnet.ExtendedAddr); ok {
+				if data, ok := extended.Data().(wnet.SharedTLSAddrExtendedData); ok {
+					endpoint["ca_cert"] = string(data.CACert)
+				}
+			}
+			if err := putHash(tx, endpointsBucket(s.BackendID()), redisEndpointString(endpointAddr), endpoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RegisterRelease stores VCS (e.g git) info collected by the client
+func (r *KVStore) RegisterRelease(s Session) error {
+	release, err := json.Marshal(s.Release())
+	if err != nil {
+		return err
+	}
+	return r.db.update(func(tx kvTx) error {
+		releases := "backend:" + s.BackendID() + ":releases"
+		if s.Release().ID != "" && tx.get(releases, s.Release().ID) == nil {
+			if err := tx.put(releases, s.Release().ID, release); err != nil {
+				return err
+			}
+		}
+		return r.updateEndpoints(tx, s, map[string]string{"branch": s.Release().Branch})
+	})
+}
+
+// RegisterHeartbeat updates timestamps and the round trip time (if measured) for session and endpoints
+func (r *KVStore) RegisterHeartbeat(s Session) error {
+	heartbeat := heartbeatFields(s, r.now())
+	return r.db.update(func(tx kvTx) error {
+		if err := putHash(tx, sessionsBucket, s.ID(), heartbeat); err != nil {
+			return err
+		}
+		return r.updateEndpoints(tx, s, heartbeat)
+	})
+}
+
+func (r *KVStore) updateEndpoints(tx kvTx, s Session, fields map[string]string) error {
+	for _, endpointAddr := range s.Endpoints() {
+		if err := putHash(tx, endpointsBucket(s.BackendID()), redisEndpointString(endpointAddr), fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateAttribute updates a single Session attribute
+func (r *KVStore) UpdateAttribute(s Session, name string, value interface{}) error {
+	return r.db.update(func(tx kvTx) error {
+		return putHash(tx, sessionsBucket, s.ID(), map[string]string{name: fmt.Sprint(value)})
+	})
+}
+
+// BackendIDFromToken returns a backendID for the token, or an empty ID if none found
+func (r *KVStore) BackendIDFromToken(token string) (string, error) {
+	return r.get(tokenHashesKey, auth.HashToken(token))
+}
+
+// MigrateTokens does nothing, tokens are only ever stored hashed
+func (r *KVStore) MigrateTokens() (int, error) {
+	return 0, nil
+}
+
+// BackendIDFromCertificate returns a backendID for the SHA256 fingerprint of a client TLS certificate,
+// or an empty ID if none found
+func (r *KVStore) BackendIDFromCertificate(fingerprint string) (string, error) {
+	return r.get("backend_client_certs", fingerprint)
+}
+
+// BackendIDFromSSHKey returns a backendID for the SHA256 fingerprint of an authorized SSH key,
+// or an empty ID if none found
+func (r *KVStore) BackendIDFromSSHKey(fingerprint string) (string, error) {
+	return r.get("backend_ssh_keys", fingerprint)
+}
+
+// BackendIDFromSSHCA returns a backendID for the SHA256 fingerprint of an SSH CA key
+// signing its clients certificates, or an empty ID if none found
+func (r *KVStore) BackendIDFromSSHCA(fingerprint string) (string, error) {
+	return r.get("backend_ssh_cas", fingerprint)
+}
+
+// BackendRequiresClientAuth returns whether ingress traffic of the backend requires a client certificate
+// Client auth is required unless explicitly disabled
+func (r *KVStore) BackendRequiresClientAuth(backendID string) (bool, error) {
+	disabled, err := r.get(backendBucket(backendID), "client_auth_disabled")
+	if err != nil {
+		return true, err
+	}
+	return disabled != "true", nil
+}
+
+// GetClientCAs returns full unparsed certificate chain for the client auth for the backend
+func (r *KVStore) GetClientCAs(backendID string) ([]byte, error) {
+	chain, err := r.get(backendBucket(backendID), "client_auth_chain")
+	if err != nil {
+		return nil, err
+	}
+	if chain == "" {
+		return nil, fmt.Errorf("no client auth chain for backend %s", backendID)
+	}
+	return []byte(chain), nil
+}
+
+// BackendTunnelLimits returns the tunnel limits set for the backend with SetTunnelLimits
+// Unset limits are zero
+func (r *KVStore) BackendTunnelLimits(backendID string) (TunnelLimits, error) {
+	var limits TunnelLimits
+	for key, limit := range map[string]*int{"tunnel_min_idle": &limits.MinIdle, "tunnel_max_total": &limits.MaxTotal} {
+		value, err := r.get(backendBucket(backendID), key)
+		if err != nil {
+			return TunnelLimits{}, err
+		}
+		if value == "" {
+			continue
+		}
+		if *limit, err = strconv.Atoi(value); err != nil {
+			return TunnelLimits{}, err
+		}
+	}
+	return limits, nil
+}
+
+// ValidCertificate returns true if a fingerprint is a in the list of
+// valid certificates for the backend.
+func (r *KVStore) ValidCertificate(backendID, fingerprint string) (bool, error) {
+	valid, err := r.get(validCertificatesBucket(backendID), fingerprint)
+	return valid != "", err
+}
+
+type resumeToken struct {
+	SessionID string `json:"session_id"`
+	BackendID string `json:"backend_id"`
+	// ExpiresAt is a unix timestamp, the token doesn't expire while it's 0
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// RegisterResumeToken stores the token a client presents to resume the session
+// The token is valid for resumeTokenTTL, until it's used or expired with ExpireResumeToken
+// Tokens are stored by hash, like backend tokens
+func (r *KVStore) RegisterResumeToken(s Session, token string) error {
+	t := &resumeToken{
+		SessionID: s.ID(),
+		BackendID: s.BackendID(),
+		ExpiresAt: r.now().Add(resumeTokenTTL).Unix(),
+	}
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return r.db.update(func(tx kvTx) error {
+		// there's no TTL, expired tokens which were never used are cleared up here
+		var expired []string
+		err := tx.forEach(resumeTokensBucket, func(key string, value []byte) error {
+			if t, err := decodeResumeToken(value); err != nil || r.resumeTokenExpired(t) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := tx.delete(resumeTokensBucket, key); err != nil {
+				return err
+			}
+		}
+		return tx.put(resumeTokensBucket, auth.HashToken(token), value)
+	})
+}
+
+// ExpireResumeToken sets the time left to the client to resume the session
+func (r *KVStore) ExpireResumeToken(token string, ttl time.Duration) error {
+	key := auth.HashToken(token)
+	return r.db.update(func(tx kvTx) error {
+		value := tx.get(resumeTokensBucket, key)
+		if value == nil {
+			return nil
+		}
+		t, err := decodeResumeToken(value)
+		if err != nil {
+			return err
+		}
+		t.ExpiresAt = r.now().Add(ttl).Unix()
+		if value, err = json.Marshal(t); err != nil {
+			return err
+		}
+		return tx.put(resumeTokensBucket, key, value)
+	})
+}
+
+// ResumeSession returns the ID of the session a resume token was issued for and invalidates the token
+// It returns an empty ID if the token is unknown, expired or was issued for another backend
+func (r *KVStore) ResumeSession(backendID, token string) (string, error) {
+	var sessionID string
+	key := auth.HashToken(token)
+	err := r.db.update(func(tx kvTx) error {
+		value := tx.get(resumeTokensBucket, key)
+		if value == nil {
+			return nil
+		}
+		t, err := decodeResumeToken(value)
+		if err != nil {
+			return err
+		}
+		if t.BackendID != backendID {
+			return nil
+		}
+		if !r.resumeTokenExpired(t) {
+			sessionID = t.SessionID
+		}
+		// the token can only be used once
+		return tx.delete(resumeTokensBucket, key)
+	})
+	return sessionID, err
+}
+
+func (r *KVStore) resumeTokenExpired(t *resumeToken) bool {
+	return t.ExpiresAt != 0 && r.now().Unix() >= t.ExpiresAt
+}
+
+func decodeResumeToken(value []byte) (*resumeToken, error) {
+	t := &resumeToken{}
+	if err := json.Unmarshal(value, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Announce announces the server
+// rep is a serialized representation of the current server
+func (r *KVStore) Announce(rep []byte) {
+	r.announce(rep)
+	ticker := time.NewTicker(10 * time.Second)
+	for range ticker.C {
+		r.announce(rep)
+	}
+}
+
+func (r *KVStore) announce(rep []byte) {
+	r.db.update(func(tx kvTx) error {
+		return tx.put(announceKey, string(rep), []byte(strconv.FormatInt(r.now().Unix(), 10)))
+	})
+}
+
+// Servers returns the representations of the servers announced since, most recent first
+func (r *KVStore) Servers(since time.Time) ([][]byte, error) {
+	type server struct {
+		rep []byte
+		at  int64
+	}
+	var servers []server
+	err := r.db.view(func(tx kvTx) error {
+		return tx.forEach(announceKey, func(key string, value []byte) error {
+			at, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return err
+			}
+			if at >= since.Unix() {
+				servers = append(servers, server{rep: []byte(key), at: at})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].at > servers[j].at })
+	reps := make([][]byte, 0, len(servers))
+	for _, s := range servers {
+		reps = append(reps, s.rep)
+	}
+	return reps, nil
+}
+
+// Endpoints returns the attributes of the endpoints of a backend, indexed by endpoint
+// Endpoints served over TLS are prefixed with "tls:"
+func (r *KVStore) Endpoints(backendID string) (map[string]map[string]string, error) {
+	endpoints := make(map[string]map[string]string)
+	err := r.db.view(func(tx kvTx) error {
+		return tx.forEach(endpointsBucket(backendID), func(key string, value []byte) error {
+			endpoint := make(map[string]string)
+			if err := json.Unmarshal(value, &endpoint); err != nil {
+				return err
+			}
+			endpoints[key] = endpoint
+			return nil
+		})
+	})
+	return endpoints, err
+}
+
+// AddToken registers a token for the backend, only its hash is stored
+func (r *KVStore) AddToken(token, backendID string) error {
+	return r.set(tokenHashesKey, auth.HashToken(token), backendID)
+}
+
+// AddClientCertificate registers the SHA256 fingerprint of a client TLS certificate for the backend
+func (r *KVStore) AddClientCertificate(fingerprint, backendID string) error {
+	return r.set("backend_client_certs", fingerprint, backendID)
+}
+
+// AddSSHKey registers the SHA256 fingerprint of an SSH key for the backend
+func (r *KVStore) AddSSHKey(fingerprint, backendID string) error {
+	return r.set("backend_ssh_keys", fingerprint, backendID)
+}
+
+// AddSSHCA registers the SHA256 fingerprint of an SSH CA key signing certificates for the backend
+func (r *KVStore) AddSSHCA(fingerprint, backendID string) error {
+	return r.set("backend_ssh_cas", fingerprint, backendID)
+}
+
+// SetClientAuthDisabled sets whether ingress traffic of the backend goes without client certificates
+func (r *KVStore) SetClientAuthDisabled(backendID string, disabled bool) error {
+	return r.set(backendBucket(backendID), "client_auth_disabled", strconv.FormatBool(disabled))
+}
+
+// SetClientCAs sets the certificate chain verifying client certificates of the backend ingress traffic
+func (r *KVStore) SetClientCAs(backendID string, chain []byte) error {
+	return r.set(backendBucket(backendID), "client_auth_chain", string(chain))
+}
+
+// SetTunnelLimits sets the minimum idle and maximum total tunnels of the backend sessions,
+// zero limits are left to the server defaults
+func (r *KVStore) SetTunnelLimits(backendID string, minIdle, maxTotal int) error {
+	if err := r.set(backendBucket(backendID), "tunnel_min_idle", strconv.Itoa(minIdle)); err != nil {
+		return err
+	}
+	return r.set(backendBucket(backendID), "tunnel_max_total", strconv.Itoa(maxTotal))
+}
+
+// AddValidCertificate adds a fingerprint to the list of valid client certificates for the backend
+func (r *KVStore) AddValidCertificate(backendID, fingerprint string) error {
+	return r.set(validCertificatesBucket(backendID), fingerprint, "1")
+}
+
+func (r *KVStore) get(bucket, key string) (string, error) {
+	var value string
+	err := r.db.view(func(tx kvTx) error {
+		value = string(tx.get(bucket, key))
+		return nil
+	})
+	return value, err
+}
+
+func (r *KVStore) set(bucket, key, value string) error {
+	if key == "" {
+		return errors.New("key can't be empty")
+	}
+	return r.db.update(func(tx kvTx) error {
+		return tx.put(bucket, key, []byte(value))
+	})
+}
+
+// putHash merges fields into the JSON object stored at key, like HMSET
+func putHash(tx kvTx, bucket, key string, fields map[string]string) error {
+	hash := make(map[string]string)
+	if value := tx.get(bucket, key); value != nil {
+		if err := json.Unmarshal(value, &hash); err != nil {
+			return err
+		}
+	}
+	for k, v := range fields {
+		hash[k] = v
+	}
+	value, err := json.Marshal(hash)
+	if err != nil {
+		return err
+	}
+	return tx.put(bucket, key, value)
+}
+
+func backendBucket(backendID string) string {
+	return "backend:" + backendID
+}
+
+func endpointsBucket(backendID string) string {
+	return "backend:" + backendID + ":endpoints"
+}
+
+func validCertificatesBucket(backendID string) string {
+	return "backend:" + backendID + ":valid_certificates"
+}
@@ -0,0 +1,166 @@
+package session
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bolt, err := NewBoltStore(filepath.Join(dir, "wormhole.db"))
+	if err != nil {
+		t.Fatal("Couldn't initialize BoltStore: ", err)
+	}
+	defer bolt.Close()
+
+	stores := map[string]*KVStore{"memory": NewMemoryStore(), "bolt": bolt}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testKVStore(t, store)
+		})
+	}
+}
+
+func testKVStore(t *testing.T, store *KVStore) {
+	now := time.Unix(1500000000, 0)
+	store.now = func() time.Time { return now }
+
+	sess := &baseSession{
+		id:        "session_1",
+		nodeID:    "test_id",
+		backendID: "backend_1",
+		endpoints: []net.Addr{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}},
+	}
+
+	t.Run("Test_credentials", func(t *testing.T) {
+		assert.NoError(t, store.AddToken("good_token", "backend_1"))
+		assert.NoError(t, store.AddSSHKey("SHA256:key", "backend_1"))
+		assert.NoError(t, store.AddClientCertificate("cert_fingerprint", "backend_2"))
+
+		backendID, err := store.BackendIDFromToken("good_token")
+		assert.NoError(t, err)
+		assert.Equal(t, "backend_1", backendID)
+
+		backendID, err = store.BackendIDFromToken("bad_token")
+		assert.NoError(t, err)
+		assert.Equal(t, "", backendID, "Should not find unknown token")
+
+		backendID, err = store.BackendIDFromSSHKey("SHA256:key")
+		assert.NoError(t, err)
+		assert.Equal(t, "backend_1", backendID)
+
+		backendID, err = store.BackendIDFromCertificate("cert_fingerprint")
+		assert.NoError(t, err)
+		assert.Equal(t, "backend_2", backendID)
+	})
+
+	t.Run("Test_client_auth", func(t *testing.T) {
+		assert.NoError(t, store.SetClientAuthDisabled("backend_1", true))
+		assert.NoError(t, store.SetClientCAs("backend_2", []byte("fullchain_2")))
+		assert.NoError(t, store.AddValidCertificate("backend_2", "fingerprint_1"))
+
+		required, err := store.BackendRequiresClientAuth("backend_1")
+		assert.NoError(t, err)
+		assert.False(t, required)
+
+		required, err = store.BackendRequiresClientAuth("backend_2")
+		assert.NoError(t, err)
+		assert.True(t, required, "Should require client auth unless disabled")
+
+		chain, err := store.GetClientCAs("backend_2")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("fullchain_2"), chain)
+
+		_, err = store.GetClientCAs("backend_1")
+		assert.Error(t, err, "Should fail without a chain")
+
+		valid, err := store.ValidCertificate("backend_2", "fingerprint_1")
+		assert.NoError(t, err)
+		assert.True(t, valid)
+
+		valid, err = store.ValidCertificate("backend_2", "fingerprint_2")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	})
+
+	t.Run("Test_tunnel_limits", func(t *testing.T) {
+		assert.NoError(t, store.SetTunnelLimits("backend_1", 2, 20))
+
+		limits, err := store.BackendTunnelLimits("backend_1")
+		assert.NoError(t, err)
+		assert.Equal(t, TunnelLimits{MinIdle: 2, MaxTotal: 20}, limits)
+
+		limits, err = store.BackendTunnelLimits("backend_2")
+		assert.NoError(t, err)
+		assert.Equal(t, TunnelLimits{}, limits, "Should leave unset limits to defaults")
+	})
+
+	t.Run("Test_endpoints", func(t *testing.T) {
+		assert.NoError(t, store.RegisterConnection(sess))
+		assert.NoError(t, store.RegisterEndpoint(sess))
+
+		endpoints, err := store.Endpoints("backend_1")
+		assert.NoError(t, err)
+		assert.Equal(t, "session_1", endpoints["127.0.0.1:10000"]["session_id"])
+
+		assert.NoError(t, store.RegisterDisconnection(sess))
+		endpoints, err = store.Endpoints("backend_1")
+		assert.NoError(t, err)
+		assert.Empty(t, endpoints, "Should remove endpoints on disconnection")
+	})
+
+	t.Run("Test_resume_token", func(t *testing.T) {
+		assert.NoError(t, store.RegisterResumeToken(sess, "resume_1"))
+		assert.NoError(t, store.RegisterResumeToken(sess, "resume_2"))
+
+		sessionID, err := store.ResumeSession("backend_2", "resume_1")
+		assert.NoError(t, err)
+		assert.Equal(t, "", sessionID, "Should not resume session of another backend")
+
+		sessionID, err = store.ResumeSession("backend_1", "resume_2")
+		assert.NoError(t, err)
+		assert.Equal(t, "session_1", sessionID)
+
+		sessionID, err = store.ResumeSession("backend_1", "resume_2")
+		assert.NoError(t, err)
+		assert.Equal(t, "", sessionID, "Should not resume twice with the same token")
+
+		assert.NoError(t, store.RegisterResumeToken(sess, "resume_3"))
+		assert.NoError(t, store.ExpireResumeToken("resume_3", time.Minute))
+		now = now.Add(2 * time.Minute)
+		sessionID, err = store.ResumeSession("backend_1", "resume_3")
+		assert.NoError(t, err)
+		assert.Equal(t, "", sessionID, "Should not resume with expired token")
+
+		assert.NoError(t, store.RegisterResumeToken(sess, "resume_4"))
+		now = now.Add(resumeTokenTTL)
+		sessionID, err = store.ResumeSession("backend_1", "resume_4")
+		assert.NoError(t, err)
+		assert.Equal(t, "", sessionID, "Should not resume with token left without heartbeats")
+	})
+
+	t.Run("Test_servers", func(t *testing.T) {
+		store.announce([]byte("server_1"))
+		now = now.Add(time.Minute)
+		store.announce([]byte("server_2"))
+
+		servers, err := store.Servers(now.Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("server_2"), []byte("server_1")}, servers)
+
+		servers, err = store.Servers(now)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("server_2")}, servers)
+	})
+}
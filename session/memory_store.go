@@ -0,0 +1,67 @@
+package session
+
+import "sync"
+
+// NewMemoryStore returns a KVStore keeping everything in memory
+// It's meant for tests and trying wormhole out, everything is lost on restart
+func NewMemoryStore() *KVStore {
+	return newKVStore(&memoryDB{buckets: make(map[string]map[string][]byte)})
+}
+
+// memoryDB is a kvDB of maps
+// Transactions are serialized but not rolled back, changes made before an error are kept
+type memoryDB struct {
+	buckets map[string]map[string][]byte
+	lock    sync.RWMutex
+}
+
+func (m *memoryDB) view(fn func(tx kvTx) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return fn(m)
+}
+
+func (m *memoryDB) update(fn func(tx kvTx) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return fn(m)
+}
+
+func (m *memoryDB) close() error {
+	return nil
+}
+
+func (m *memoryDB) get(bucket, key string) []byte {
+	return m.buckets[bucket][key]
+}
+
+func (m *memoryDB) put(bucket, key string, value []byte) error {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryDB) delete(bucket, key string) error {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	delete(b, key)
+	if len(b) == 0 {
+		delete(m.buckets, bucket)
+	}
+	return nil
+}
+
+func (m *memoryDB) forEach(bucket string, fn func(key string, value []byte) error) error {
+	for k, v := range m.buckets[bucket] {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	wnet "github.com/superfly/wormhole/net"
+)
+
+// sessionMetricLabels partition the metrics of every session type
+var sessionMetricLabels = []string{
+	// Which tunnel type (e.g. "tcp") the session uses?
+	"protocol",
+	// Which backend this session belongs to?
+	"backend",
+	// What wormhole instance this session is running on?
+	"node",
+	// What region this session belongs to?
+	"cluster",
+}
+
+var (
+	sessionOpenSessionsMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "open_sessions_total",
+			Help:      "Number of active sessions, partitioned by protocol, backend, node and cluster.",
+		},
+		sessionMetricLabels,
+	)
+
+	sessionOpenIngressConnsMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "open_ingress_conns_total",
+			Help:      "Number of active ingress connections, partitioned by protocol, backend, node and cluster.",
+		},
+		sessionMetricLabels,
+	)
+
+	sessionIngressConnDurationMetric = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  "wormhole",
+			Subsystem:  "session",
+			Name:       "ingress_conn_duration_seconds",
+			Help:       "Duration in seconds of ingress connections, partitioned by protocol, backend, node and cluster.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		sessionMetricLabels,
+	)
+
+	sessionIngressConnRcvdBytesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "ingress_conn_rcvd_bytes",
+			Help:      "Number of bytes received from ingress connections, partitioned by protocol, backend, node and cluster.",
+		},
+		sessionMetricLabels,
+	)
+
+	sessionIngressConnSentBytesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "ingress_conn_sent_bytes",
+			Help:      "Number of bytes sent to ingress connections, partitioned by protocol, backend, node and cluster.",
+		},
+		sessionMetricLabels,
+	)
+
+	sessionHTTPRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "http_requests_total",
+			Help:      "Number of ingress HTTP requests, partitioned by protocol, backend, node, cluster and status code.",
+		},
+		append([]string{"code"}, sessionMetricLabels...),
+	)
+
+	sessionHTTPRequestDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration in seconds of ingress HTTP requests, partitioned by protocol, backend, node and cluster.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		sessionMetricLabels,
+	)
+
+	sessionHTTPGatewayErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "wormhole",
+			Subsystem: "session",
+			Name:      "http_gateway_errors_total",
+			Help:      "Number of ingress HTTP requests which couldn't be proxied, partitioned by protocol, backend, node, cluster and error class.",
+		},
+		append([]string{"class"}, sessionMetricLabels...),
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessionOpenSessionsMetric)
+	prometheus.MustRegister(sessionOpenIngressConnsMetric)
+	prometheus.MustRegister(sessionIngressConnDurationMetric)
+	prometheus.MustRegister(sessionIngressConnRcvdBytesMetric)
+	prometheus.MustRegister(sessionIngressConnSentBytesMetric)
+	prometheus.MustRegister(sessionHTTPRequestsMetric)
+	prometheus.MustRegister(sessionHTTPRequestDurationMetric)
+	prometheus.MustRegister(sessionHTTPGatewayErrorsMetric)
+}
+
+func (s *baseSession) metricLabels() prometheus.Labels {
+	return prometheus.Labels{
+		"protocol": s.protocol,
+		"backend":  s.backendID,
+		"node":     s.nodeID,
+		"cluster":  s.ClusterURL,
+	}
+}
+
+// reportOpened counts the session as open, once it serves ingress traffic
+func (s *baseSession) reportOpened() {
+	if atomic.CompareAndSwapInt32(&s.reported, 0, 1) {
+		sessionOpenSessionsMetric.With(s.metricLabels()).Inc()
+	}
+}
+
+// reportClosed stops counting the session as open, if it was
+func (s *baseSession) reportClosed() {
+	if atomic.CompareAndSwapInt32(&s.reported, 1, 2) {
+		sessionOpenSessionsMetric.With(s.metricLabels()).Dec()
+	}
+}
+
+// reportIngressConn counts an ingress connection as open until the returned func
+// is called with the number of bytes received from and sent to it
+func (s *baseSession) reportIngressConn() func(rcvd, sent int64) {
+	labels := s.metricLabels()
+	start := time.Now()
+	sessionOpenIngressConnsMetric.With(labels).Inc()
+	return func(rcvd, sent int64) {
+		sessionOpenIngressConnsMetric.With(labels).Dec()
+		sessionIngressConnDurationMetric.With(labels).Observe(time.Since(start).Seconds())
+		sessionIngressConnRcvdBytesMetric.With(labels).Add(float64(rcvd))
+		sessionIngressConnSentBytesMetric.With(labels).Add(float64(sent))
+	}
+}
+
+// reportHTTPRequest records an ingress HTTP request answered with status after d
+func (s *baseSession) reportHTTPRequest(status int, d time.Duration) {
+	labels := s.metricLabels()
+	sessionHTTPRequestDurationMetric.With(labels).Observe(d.Seconds())
+	labels["code"] = strconv.Itoa(status)
+	sessionHTTPRequestsMetric.With(labels).Inc()
+}
+
+// reportGatewayError counts an ingress HTTP request which couldn't be proxied
+func (s *baseSession) reportGatewayError(class wnet.GatewayErrorClass) {
+	labels := s.metricLabels()
+	labels["class"] = string(class)
+	sessionHTTPGatewayErrorsMetric.With(labels).Inc()
+}
+
+// statusRecorder keeps the status code of the response written to an http.ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher if the underlying ResponseWriter does
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, it fails if the underlying ResponseWriter doesn't
+// A hijacked connection is recorded as switching protocols
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseWriter doesn't support hijacking")
+	}
+	conn, buf, err := hj.Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
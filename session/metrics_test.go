@@ -0,0 +1,61 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionMetrics(t *testing.T) {
+	s := &baseSession{protocol: "tcp", backendID: "metrics_backend", nodeID: "test_id", ClusterURL: "test_cluster"}
+
+	t.Run("Test_open_sessions", func(t *testing.T) {
+		open := sessionOpenSessionsMetric.With(s.metricLabels())
+
+		s.reportOpened()
+		s.reportOpened()
+		assert.Equal(t, 1.0, metricValue(t, open), "Should count the session once")
+
+		s.reportClosed()
+		s.reportClosed()
+		assert.Equal(t, 0.0, metricValue(t, open), "Should uncount the session once")
+	})
+
+	t.Run("Test_ingress_conns", func(t *testing.T) {
+		open := sessionOpenIngressConnsMetric.With(s.metricLabels())
+
+		done := s.reportIngressConn()
+		assert.Equal(t, 1.0, metricValue(t, open))
+		done(10, 20)
+		assert.Equal(t, 0.0, metricValue(t, open))
+
+		assert.Equal(t, 10.0, metricValue(t, sessionIngressConnRcvdBytesMetric.With(s.metricLabels())))
+		assert.Equal(t, 20.0, metricValue(t, sessionIngressConnSentBytesMetric.With(s.metricLabels())))
+	})
+
+	t.Run("Test_http_requests", func(t *testing.T) {
+		rec := newStatusRecorder(httptest.NewRecorder())
+		rec.WriteHeader(http.StatusBadGateway)
+		s.reportHTTPRequest(rec.status, 10*time.Millisecond)
+
+		labels := s.metricLabels()
+		labels["code"] = "502"
+		assert.Equal(t, 1.0, metricValue(t, sessionHTTPRequestsMetric.With(labels)))
+	})
+}
+
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	metric := &dto.Metric{}
+	if err := m.Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	if metric.Gauge != nil {
+		return metric.Gauge.GetValue()
+	}
+	return metric.Counter.GetValue()
+}
@@ -37,9 +37,12 @@ func (r *Registry) GetSession(id string) Session {
 }
 
 // RemoveSession removes session if currently stored in the registry
+// A resumed session which took over the same ID is kept
 func (r *Registry) RemoveSession(s Session) {
 	r.lock.Lock()
-	delete(r.registry, s.ID())
+	if r.registry[s.ID()] == s {
+		delete(r.registry, s.ID())
+	}
 	r.lock.Unlock()
 	r.logger.Debug("Removed session: ", s.ID())
 }
@@ -23,3 +23,20 @@ func TestRegistry_CRUD(t *testing.T) {
 
 	assert.Nil(t, r.GetSession(sess.ID()), "should be removed")
 }
+
+func TestRegistry_RemoveReplacedSession(t *testing.T) {
+	prev := &baseSession{
+		id: "sess-1",
+	}
+	sess := &baseSession{
+		id: "sess-1",
+	}
+	r := NewRegistry(log.New())
+
+	r.AddSession(prev)
+	r.AddSession(sess)
+
+	r.RemoveSession(prev)
+
+	assert.Equal(t, sess, r.GetSession(sess.ID()), "should keep the session which took over the ID")
+}
@@ -0,0 +1,83 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// resumeGracePeriod is how long after a session is closed its client can still resume it
+	resumeGracePeriod = 2 * time.Minute
+	// resumeTokenTTL is how long a token is kept without a heartbeat from its session,
+	// so that tokens of sessions which were never closed cleanly don't pile up
+	resumeTokenTTL = sessionTTL * time.Second
+)
+
+// ResumeToken returns the token the client presents to resume this session after reconnecting
+func (s *baseSession) ResumeToken() string {
+	return s.resumeToken
+}
+
+// resume reattaches the session to the ID of the session resumeToken was issued for,
+// so that the client keeps the same endpoints. If that session is still held by
+// registry (e.g. its control connection hasn't timed out yet), it is closed first.
+// The session keeps its new ID if the token is unknown, expired or belongs to another backend.
+func (s *baseSession) resume(resumeToken string, registry *Registry) {
+	if resumeToken == "" {
+		return
+	}
+
+	id, err := s.store.ResumeSession(s.backendID, resumeToken)
+	if err != nil {
+		s.logger.Errorf("Couldn't resume session: %s", err.Error())
+		return
+	}
+	if id == "" {
+		s.logger.Info("Resume token unknown or expired, starting a new session")
+		return
+	}
+
+	if registry != nil {
+		if prev := registry.GetSession(id); prev != nil {
+			prev.Close()
+			registry.RemoveSession(prev)
+		}
+	}
+	s.logger.Infof("Resuming session %s", id)
+	s.id = id
+}
+
+// issueResumeToken generates and stores a new token for the client to resume this session
+func (s *baseSession) issueResumeToken() error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	if err := s.store.RegisterResumeToken(s, token); err != nil {
+		return err
+	}
+	s.resumeToken = token
+	return nil
+}
+
+// refreshResumeToken keeps the token of a live session from expiring
+func (s *baseSession) refreshResumeToken() {
+	if s.resumeToken == "" {
+		return
+	}
+	if err := s.store.ExpireResumeToken(s.resumeToken, resumeTokenTTL); err != nil {
+		s.logger.Warnf("Couldn't refresh resume token: %s", err.Error())
+	}
+}
+
+// expireResumeToken leaves the client resumeGracePeriod to resume the session once it's closed
+func (s *baseSession) expireResumeToken() {
+	if s.resumeToken == "" {
+		return
+	}
+	if err := s.store.ExpireResumeToken(s.resumeToken, resumeGracePeriod); err != nil {
+		s.logger.Errorf("Couldn't expire resume token: %s", err.Error())
+	}
+}
@@ -6,11 +6,31 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/messages"
 )
 
+// ErrInvalidToken is returned when a token doesn't belong to any backend
+var ErrInvalidToken = errors.New("token rejected")
+
+// ErrTokenNotAllowed is returned when a signed token isn't scoped for the protocol or region of the session
+var ErrTokenNotAllowed = errors.New("token not allowed for this protocol or region")
+
+// ErrInvalidClientCertificate is returned when a client TLS certificate isn't registered for any backend
+var ErrInvalidClientCertificate = errors.New("client certificate rejected")
+
+// ErrInvalidSSHKey is returned when an SSH key isn't authorized for, or signed by a CA of, any backend
+var ErrInvalidSSHKey = errors.New("ssh key rejected")
+
+// heartbeatInterval is the minimum time between two heartbeats of a session registered in the store
+const heartbeatInterval = 10 * time.Second
+
 // Session hold information about connected client
 type Session interface {
 	ID() string
@@ -25,6 +45,7 @@ type Session interface {
 	AddEndpoint(endpoint net.Addr)
 	Key() string
 	Release() *messages.Release
+	RTT() time.Duration
 	RequireStream() error
 	RequireAuthentication() error
 	RequiresClientAuth() bool
@@ -36,6 +57,12 @@ type Session interface {
 // baseSession struct implements the Session interface and provides
 // common methods for concrete Session types (e.g. HTTP2 or SSH)
 type baseSession struct {
+	// rtt and lastHeartbeatAt are accessed atomically, they're kept first for 64-bit alignment
+	rtt             int64
+	lastHeartbeatAt int64
+	// reported is the state of the session in the open sessions metric: not yet, open or closed
+	reported int32
+
 	id                 string
 	agent              string
 	nodeID             string
@@ -45,6 +72,14 @@ type baseSession struct {
 	ClusterURL         string
 	RegionID           string
 	requiresClientAuth bool
+	resumeToken        string
+
+	// protocol is the name of the tunnel type (e.g. "tcp") signed tokens are scoped with
+	protocol string
+	// tokens verifies signed tokens, opaque tokens are looked up in the store when nil
+	tokens *auth.Verifier
+	// signedToken is the signed token the session was authenticated with, if any
+	signedToken string
 
 	release *messages.Release
 	store   Store
@@ -113,6 +148,40 @@ func (s *baseSession) Release() *messages.Release {
 	return s.release
 }
 
+// updateRelease stores the release of the program served by the client
+// Clients send it once authenticated, and again when the program is restarted
+func (s *baseSession) updateRelease(release *messages.Release) {
+	s.release = release
+	if err := s.store.RegisterRelease(s); err != nil {
+		s.logger.Warnf("Failed to register release: %s", err.Error())
+	}
+}
+
+// RTT returns the round trip time of the link to the client, as last reported by the client
+// or measured with HTTP/2 PINGs
+// It's 0 if it hasn't been measured
+func (s *baseSession) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// registerHeartbeat records a Ping from the client, with the round trip time of its previous Ping
+// The store is updated at most once per heartbeatInterval
+func (s *baseSession) registerHeartbeat(rtt time.Duration) {
+	if rtt > 0 {
+		atomic.StoreInt64(&s.rtt, int64(rtt))
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastHeartbeatAt)
+	if now-last < int64(heartbeatInterval) || !atomic.CompareAndSwapInt64(&s.lastHeartbeatAt, last, now) {
+		return
+	}
+	if err := s.store.RegisterHeartbeat(s); err != nil {
+		s.logger.Warnf("Failed to register session heartbeat: %s", err.Error())
+	}
+	s.refreshResumeToken()
+}
+
 // RequiresClientAuth returns true if the session requires a client certificate
 // authentication.
 func (s *baseSession) RequiresClientAuth() bool {
@@ -125,6 +194,110 @@ func (s *baseSession) RequireAuthentication() error {
 	return errors.New("not implemented")
 }
 
+// AuthenticateTunnel checks that the credentials of a new tunnel connection belong to
+// the backend of this session. cert is the client TLS certificate, if any
+func (s *baseSession) AuthenticateTunnel(token string, cert *x509.Certificate) error {
+	if token = strings.TrimSpace(token); cert == nil && token != "" && token == s.signedToken {
+		// the session already checked the scope of its own token, and an
+		// established session keeps adding tunnels once it expires
+		return nil
+	}
+	backendID, err := s.backendIDFromCredentials(token, cert)
+	if err != nil {
+		return err
+	}
+	if backendID != s.backendID {
+		if cert != nil {
+			return ErrInvalidClientCertificate
+		}
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// authFromToken resolves the backend the token belongs to and whether it requires
+// client authentication
+func (s *baseSession) authFromToken(token string) error {
+	return s.authFromCredentials(token, nil)
+}
+
+// authFromCredentials resolves the backend from the client TLS certificate when one was
+// presented, from the token otherwise
+func (s *baseSession) authFromCredentials(token string, cert *x509.Certificate) error {
+	backendID, err := s.backendIDFromCredentials(token, cert)
+	if err != nil {
+		return err
+	}
+	if token = strings.TrimSpace(token); cert == nil && s.isSignedToken(token) {
+		s.signedToken = token
+	}
+	return s.authFromBackendID(backendID)
+}
+
+// authFromBackendID sets the backend the client authenticated for and whether it requires
+// client authentication
+func (s *baseSession) authFromBackendID(backendID string) error {
+	// assume false if not set
+	requiresClientAuth, err := s.store.BackendRequiresClientAuth(backendID)
+	if err != nil {
+		return err
+	}
+
+	s.backendID = backendID
+	s.requiresClientAuth = requiresClientAuth
+	return nil
+}
+
+func (s *baseSession) backendIDFromCredentials(token string, cert *x509.Certificate) (string, error) {
+	if cert == nil {
+		return s.backendIDFromToken(token)
+	}
+
+	backendID, err := s.store.BackendIDFromCertificate(certificateFingerprint(cert))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if backendID == "" {
+		return "", ErrInvalidClientCertificate
+	}
+	return backendID, nil
+}
+
+func (s *baseSession) backendIDFromToken(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if s.isSignedToken(token) {
+		return s.backendIDFromSignedToken(token)
+	}
+
+	backendID, err := s.store.BackendIDFromToken(token)
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if backendID == "" {
+		return "", ErrInvalidToken
+	}
+	return backendID, nil
+}
+
+// backendIDFromSignedToken verifies a signed token offline and checks it's scoped for this session
+func (s *baseSession) backendIDFromSignedToken(token string) (string, error) {
+	claims, err := s.tokens.Verify(token)
+	if err == auth.ErrTokenExpired {
+		return "", err
+	} else if err != nil {
+		s.logger.Infof("Signed token rejected: %s", err.Error())
+		return "", ErrInvalidToken
+	}
+	if !claims.AllowsProtocol(s.protocol) || !claims.AllowsRegion(s.RegionID) {
+		return "", ErrTokenNotAllowed
+	}
+	return claims.BackendID, nil
+}
+
+func (s *baseSession) isSignedToken(token string) bool {
+	return s.tokens != nil && auth.IsSigned(token)
+}
+
 // RequireStream is an API for concrete session types to implement session
 // etasblishment
 func (s *baseSession) RequireStream() error {
@@ -149,8 +322,12 @@ func (s *baseSession) ClientCAs() (*x509.CertPool, error) {
 // ValidCertificate returns true if a certificate is in the list of
 // valid certificates.
 func (s *baseSession) ValidCertificate(c *x509.Certificate) (bool, error) {
-	fingerprint := fmt.Sprintf("%x", sha256.Sum256(c.Raw))
-	return s.store.ValidCertificate(s.BackendID(), fingerprint)
+	return s.store.ValidCertificate(s.BackendID(), certificateFingerprint(c))
+}
+
+// certificateFingerprint returns the hex encoded SHA256 of the certificate
+func certificateFingerprint(c *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha256.Sum256(c.Raw))
 }
 
 // Close closes the session
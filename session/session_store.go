@@ -2,9 +2,11 @@ package session
 
 import (
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/superfly/wormhole/auth"
 	wnet "github.com/superfly/wormhole/net"
 )
 
@@ -12,9 +14,14 @@ const (
 	sessionTTL              = 60 * 60 * 1 // 1h
 	connectedSessionsKey    = "sessions:connected"
 	disconnectedSessionsKey = "sessions:disconnected"
+	// tokenHashesKey maps the hashes of backend tokens to backend IDs
+	tokenHashesKey = "backend_token_hashes"
+	// plaintextTokensKey maps backend tokens to backend IDs, left from before tokens were hashed
+	plaintextTokensKey = "backend_tokens"
 )
 
 // Store is an interface to session persistence layer, e.g. Redis
+// Lookups of backend IDs return an empty ID or redis.ErrNil when nothing matches
 type Store interface {
 	RegisterConnection(s Session) error
 	RegisterDisconnection(s Session) error
@@ -23,10 +30,20 @@ type Store interface {
 	RegisterHeartbeat(s Session) error
 	UpdateAttribute(s Session, name string, value interface{}) error
 	BackendIDFromToken(token string) (string, error)
+	MigrateTokens() (int, error)
+	BackendIDFromCertificate(fingerprint string) (string, error)
+	BackendIDFromSSHKey(fingerprint string) (string, error)
+	BackendIDFromSSHCA(fingerprint string) (string, error)
 	BackendRequiresClientAuth(backendID string) (bool, error)
 	ValidCertificate(backendID, fingerprint string) (bool, error)
 	GetClientCAs(backendID string) ([]byte, error)
+	BackendTunnelLimits(backendID string) (TunnelLimits, error)
+	RegisterResumeToken(s Session, token string) error
+	ExpireResumeToken(token string, ttl time.Duration) error
+	ResumeSession(backendID, token string) (string, error)
 	Announce(rep []byte)
+	Servers(since time.Time) ([][]byte, error)
+	Endpoints(backendID string) (map[string]map[string]string, error)
 }
 
 // RedisStore is session persistence using Redis
@@ -58,6 +75,9 @@ func (r *RedisStore) RegisterConnection(s Session) error {
 	defer redisConn.Close()
 
 	redisConn.Send("HMSET", redis.Args{}.Add(s.Key()).AddFlat(session)...)
+	// a resumed session may have been set to expire on disconnection
+	redisConn.Send("PERSIST", s.Key())
+	redisConn.Send("ZREM", disconnectedSessionsKey, s.ID())
 	redisConn.Send("ZADD", connectedSessionsKey, timeToScore(t), s.ID())
 	redisConn.Send("SADD", "node:"+s.NodeID()+":sessions", s.ID())
 	redisConn.Send("SADD", "backend:"+s.BackendID()+":sessions", s.ID())
@@ -138,27 +158,97 @@ func (r *RedisStore) RegisterRelease(s Session) error {
 	return err
 }
 
-// RegisterHeartbeat updates timestamps for session and endpoint keys
+// RegisterHeartbeat updates timestamps and the round trip time (if measured) for session and endpoint keys
 func (r *RedisStore) RegisterHeartbeat(s Session) error {
-	t := time.Now()
+	heartbeat := heartbeatFields(s, time.Now())
 	redisConn := r.pool.Get()
 	defer redisConn.Close()
 
 	redisConn.Send("MULTI")
-	redisConn.Send("HSET", s.Key(), "last_seen_at", t.Format(time.RFC3339))
+	redisConn.Send("HMSET", redis.Args{s.Key()}.AddFlat(heartbeat)...)
 	for _, endpointAddr := range s.Endpoints() {
-		redisConn.Send("HSET", endpointKey(s, endpointAddr), "last_seen_at", t.Format(time.RFC3339))
+		redisConn.Send("HMSET", redis.Args{endpointKey(s, endpointAddr)}.AddFlat(heartbeat)...)
 	}
 	_, err := redisConn.Do("EXEC")
 	return err
 }
 
 // BackendIDFromToken returns a backendID for the token or errors out if none found
+// Tokens are looked up by hash, plaintext tokens left from before are hashed once used.
+// Their plaintext entry is kept for servers which don't look tokens up by hash, until
+// MigrateTokens is run
 func (r *RedisStore) BackendIDFromToken(token string) (string, error) {
 	redisConn := r.pool.Get()
 	defer redisConn.Close()
 
-	return redis.String(redisConn.Do("HGET", "backend_tokens", token))
+	hash := auth.HashToken(token)
+	backendID, err := redis.String(redisConn.Do("HGET", tokenHashesKey, hash))
+	if err != redis.ErrNil {
+		return backendID, err
+	}
+
+	backendID, err = redis.String(redisConn.Do("HGET", plaintextTokensKey, token))
+	if err != nil {
+		return "", err
+	}
+	_, err = redisConn.Do("HSET", tokenHashesKey, hash, backendID)
+	return backendID, err
+}
+
+// MigrateTokens replaces the plaintext tokens in backend_tokens by their hash
+// It returns the number of tokens migrated. Servers which only look tokens up in
+// plaintext reject the migrated ones, so it's run once all servers are upgraded
+func (r *RedisStore) MigrateTokens() (int, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	tokens, err := redis.StringMap(redisConn.Do("HGETALL", plaintextTokensKey))
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for token, backendID := range tokens {
+		if err := migrateToken(redisConn, token, auth.HashToken(token), backendID); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+func migrateToken(redisConn redis.Conn, token, hash, backendID string) error {
+	redisConn.Send("MULTI")
+	redisConn.Send("HSET", tokenHashesKey, hash, backendID)
+	redisConn.Send("HDEL", plaintextTokensKey, token)
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+// BackendIDFromCertificate returns a backendID for the SHA256 fingerprint of a client TLS certificate
+// or errors out if none found
+func (r *RedisStore) BackendIDFromCertificate(fingerprint string) (string, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	return redis.String(redisConn.Do("HGET", "backend_client_certs", fingerprint))
+}
+
+// BackendIDFromSSHKey returns a backendID for the SHA256 fingerprint of an authorized SSH key
+// or errors out if none found
+func (r *RedisStore) BackendIDFromSSHKey(fingerprint string) (string, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	return redis.String(redisConn.Do("HGET", "backend_ssh_keys", fingerprint))
+}
+
+// BackendIDFromSSHCA returns a backendID for the SHA256 fingerprint of an SSH CA key
+// signing its clients certificates or errors out if none found
+func (r *RedisStore) BackendIDFromSSHCA(fingerprint string) (string, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	return redis.String(redisConn.Do("HGET", "backend_ssh_cas", fingerprint))
 }
 
 // BackendRequiresClientAuth returns a backendID for the token or errors out if none found
@@ -200,6 +290,19 @@ func (r *RedisStore) GetClientCAs(backendID string) ([]byte, error) {
 	return redis.Bytes(redisConn.Do("HGET", "backend:"+backendID, "client_auth_chain"))
 }
 
+// BackendTunnelLimits returns the tunnel limits set for the backend in tunnel_min_idle and tunnel_max_total
+// Unset limits are zero
+func (r *RedisStore) BackendTunnelLimits(backendID string) (TunnelLimits, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	values, err := redis.Ints(redisConn.Do("HMGET", "backend:"+backendID, "tunnel_min_idle", "tunnel_max_total"))
+	if err != nil {
+		return TunnelLimits{}, err
+	}
+	return TunnelLimits{MinIdle: values[0], MaxTotal: values[1]}, nil
+}
+
 // ValidCertificate returns true if a fingerprint is a in the list of
 // valid certificates for the backend.
 func (r *RedisStore) ValidCertificate(backendID, fingerprint string) (bool, error) {
@@ -209,6 +312,50 @@ func (r *RedisStore) ValidCertificate(backendID, fingerprint string) (bool, erro
 	return redis.Bool(redisConn.Do("SISMEMBER", "backend:"+backendID+":valid_certificates", fingerprint))
 }
 
+// RegisterResumeToken stores the token a client presents to resume the session
+// The token is valid for resumeTokenTTL, until it's used or expired with ExpireResumeToken
+func (r *RedisStore) RegisterResumeToken(s Session, token string) error {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	redisConn.Send("MULTI")
+	redisConn.Send("HMSET", resumeTokenKey(token), "session_id", s.ID(), "backend_id", s.BackendID())
+	redisConn.Send("EXPIRE", resumeTokenKey(token), int64(resumeTokenTTL/time.Second))
+	_, err := redisConn.Do("EXEC")
+	return err
+}
+
+// ExpireResumeToken sets the time left to the client to resume the session
+func (r *RedisStore) ExpireResumeToken(token string, ttl time.Duration) error {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	_, err := redisConn.Do("EXPIRE", resumeTokenKey(token), int64(ttl/time.Second))
+	return err
+}
+
+// ResumeSession returns the ID of the session a resume token was issued for and invalidates the token
+// It returns an empty ID if the token is unknown, expired or was issued for another backend
+func (r *RedisStore) ResumeSession(backendID, token string) (string, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	values, err := redis.Strings(redisConn.Do("HMGET", resumeTokenKey(token), "session_id", "backend_id"))
+	if err != nil {
+		return "", err
+	}
+	if values[0] == "" || values[1] != backendID {
+		return "", nil
+	}
+
+	// the token can only be used once
+	deleted, err := redis.Int(redisConn.Do("DEL", resumeTokenKey(token)))
+	if err != nil || deleted == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
 // Announce announces the server on redis
 // rep is a serialized representation of the current server
 func (r *RedisStore) Announce(rep []byte) {
@@ -219,6 +366,35 @@ func (r *RedisStore) Announce(rep []byte) {
 	}
 }
 
+// Servers returns the representations of the servers announced since, most recent first
+func (r *RedisStore) Servers(since time.Time) ([][]byte, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	return redis.ByteSlices(redisConn.Do("ZREVRANGEBYSCORE", announceKey, "+inf", since.Unix()))
+}
+
+// Endpoints returns the attributes of the endpoints of a backend, indexed by endpoint
+// Endpoints served over TLS are prefixed with "tls:"
+func (r *RedisStore) Endpoints(backendID string) (map[string]map[string]string, error) {
+	redisConn := r.pool.Get()
+	defer redisConn.Close()
+
+	members, err := redis.Strings(redisConn.Do("SMEMBERS", "backend:"+backendID+":endpoints"))
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make(map[string]map[string]string)
+	for _, ep := range members {
+		endpoint, err := redis.StringMap(redisConn.Do("HGETALL", "backend:"+backendID+":endpoint:"+ep))
+		if err != nil {
+			return nil, err
+		}
+		endpoints[ep] = endpoint
+	}
+	return endpoints, nil
+}
+
 const announceKey = "servers"
 
 func announce(pool *redis.Pool, rep []byte) {
@@ -228,6 +404,15 @@ func announce(pool *redis.Pool, rep []byte) {
 	redisConn.Do("ZADD", announceKey, time.Now().Unix(), rep)
 }
 
+// heartbeatFields returns the session and endpoint attributes updated by a heartbeat at t
+func heartbeatFields(s Session, t time.Time) map[string]string {
+	fields := map[string]string{"last_seen_at": t.Format(time.RFC3339)}
+	if rtt := s.RTT(); rtt > 0 {
+		fields["rtt_ms"] = strconv.FormatFloat(rtt.Seconds()*1000, 'f', 3, 64)
+	}
+	return fields
+}
+
 func timeToScore(t time.Time) int64 {
 	return t.UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 }
@@ -240,6 +425,11 @@ func dailyClientIpsKey(s Session, date string) string {
 	return "node:" + s.NodeID() + ":clients:" + date
 }
 
+// resumeTokenKey holds the hash of the token, which is only known to the session and its client
+func resumeTokenKey(token string) string {
+	return "resume_token:" + auth.HashToken(token)
+}
+
 func endpointKey(s Session, endpoint net.Addr) string {
 	return "backend:" + s.BackendID() + ":endpoint:" + redisEndpointString(endpoint)
 }
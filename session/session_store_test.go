@@ -3,7 +3,9 @@ package session
 import (
 	"testing"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
+	"github.com/superfly/wormhole/auth"
 )
 
 func TestSessionStore_RequiresClientAuth(t *testing.T) {
@@ -55,6 +57,29 @@ func TestSessionStore_ClientCAs(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSessionStore_BackendTunnelLimits(t *testing.T) {
+	store, err := testRedisStore()
+	if err != nil {
+		t.Fatal("Couldn't initialize SessionStore: ", err)
+	}
+
+	testRedis.HSet("backend:1", "tunnel_min_idle", "2")
+	testRedis.HSet("backend:1", "tunnel_max_total", "20")
+	testRedis.HSet("backend:5", "tunnel_max_total", "5")
+
+	limits, err := store.BackendTunnelLimits("1")
+	assert.Equal(t, TunnelLimits{MinIdle: 2, MaxTotal: 20}, limits)
+	assert.NoError(t, err)
+
+	limits, err = store.BackendTunnelLimits("5")
+	assert.Equal(t, TunnelLimits{MaxTotal: 5}, limits)
+	assert.NoError(t, err)
+
+	limits, err = store.BackendTunnelLimits("badid")
+	assert.Equal(t, TunnelLimits{}, limits)
+	assert.NoError(t, err)
+}
+
 func TestSessionStore_ValidCertificate(t *testing.T) {
 	store, err := testRedisStore()
 	if err != nil {
@@ -80,6 +105,51 @@ func TestSessionStore_ValidCertificate(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSessionStore_ResumeSession(t *testing.T) {
+	store, err := testRedisStore()
+	if err != nil {
+		t.Fatal("Couldn't initialize SessionStore: ", err)
+	}
+
+	sess := &baseSession{
+		id:        "sess-1",
+		backendID: "1",
+	}
+	assert.NoError(t, store.RegisterResumeToken(sess, "token_1"))
+	assert.False(t, testRedis.Exists("resume_token:token_1"), "token should be stored by hash")
+
+	id, err := store.ResumeSession("5", "token_1")
+	assert.Equal(t, "", id)
+	assert.NoError(t, err)
+
+	id, err = store.ResumeSession("1", "token_1")
+	assert.Equal(t, "sess-1", id)
+	assert.NoError(t, err)
+
+	id, err = store.ResumeSession("1", "token_1")
+	assert.Equal(t, "", id, "token should only be usable once")
+	assert.NoError(t, err)
+
+	id, err = store.ResumeSession("1", "badtoken")
+	assert.Equal(t, "", id)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.RegisterResumeToken(sess, "token_2"))
+	assert.NoError(t, store.ExpireResumeToken("token_2", resumeGracePeriod))
+	testRedis.FastForward(resumeGracePeriod)
+
+	id, err = store.ResumeSession("1", "token_2")
+	assert.Equal(t, "", id, "token should expire after the grace period")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.RegisterResumeToken(sess, "token_3"))
+	testRedis.FastForward(resumeTokenTTL)
+
+	id, err = store.ResumeSession("1", "token_3")
+	assert.Equal(t, "", id, "token should expire without heartbeats")
+	assert.NoError(t, err)
+}
+
 func testRedisStore() (*RedisStore, error) {
 	conn := redisPool.Get()
 	defer conn.Close()
@@ -90,3 +160,44 @@ func testRedisStore() (*RedisStore, error) {
 
 	return NewRedisStore(redisPool), nil
 }
+
+func TestSessionStore_BackendIDFromToken(t *testing.T) {
+	store, err := testRedisStore()
+	if err != nil {
+		t.Fatal("Couldn't initialize SessionStore: ", err)
+	}
+
+	testRedis.HSet("backend_token_hashes", auth.HashToken("hashed_token"), "1")
+	testRedis.HSet("backend_tokens", "plaintext_token", "2")
+
+	backendID, err := store.BackendIDFromToken("hashed_token")
+	assert.Equal(t, "1", backendID)
+	assert.NoError(t, err)
+
+	backendID, err = store.BackendIDFromToken("plaintext_token")
+	assert.Equal(t, "2", backendID)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", testRedis.HGet("backend_tokens", "plaintext_token"), "Should keep plaintext token for servers not looking up hashes")
+	assert.Equal(t, "2", testRedis.HGet("backend_token_hashes", auth.HashToken("plaintext_token")))
+
+	_, err = store.BackendIDFromToken("bad_token")
+	assert.Equal(t, redis.ErrNil, err)
+}
+
+func TestSessionStore_MigrateTokens(t *testing.T) {
+	store, err := testRedisStore()
+	if err != nil {
+		t.Fatal("Couldn't initialize SessionStore: ", err)
+	}
+
+	testRedis.Del("backend_tokens")
+	testRedis.HSet("backend_tokens", "token_1", "1")
+	testRedis.HSet("backend_tokens", "token_2", "2")
+
+	n, err := store.MigrateTokens()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, testRedis.Exists("backend_tokens"), "Should remove plaintext tokens")
+	assert.Equal(t, "1", testRedis.HGet("backend_token_hashes", auth.HashToken("token_1")))
+	assert.Equal(t, "2", testRedis.HGet("backend_token_hashes", auth.HashToken("token_2")))
+}
@@ -3,16 +3,15 @@ package session
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"io"
 	"net"
 	"strconv"
-	"strings"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/messages"
 	"golang.org/x/crypto/ssh"
 
@@ -22,6 +21,9 @@ import (
 const (
 	sshRemoteForwardRequest      = "tcpip-forward"
 	sshForwardedTCPReturnRequest = "forwarded-tcpip"
+
+	// sshBackendIDExtension carries the backend a public key was authorized for through the handshake
+	sshBackendIDExtension = "wormhole-backend-id@fly.io"
 )
 
 var (
@@ -164,21 +166,26 @@ func (io instrumentedIO) Write(p []byte) (int, error) {
 }
 
 // NewSSHSession creates new SshSession struct
-func NewSSHSession(logger *logrus.Logger, clusterURL, nodeID string, region string, redisPool *redis.Pool, tcpConn net.Conn, config *ssh.ServerConfig) *SSHSession {
+func NewSSHSession(logger *logrus.Logger, clusterURL, nodeID string, region string, store Store, tcpConn net.Conn, config *ssh.ServerConfig, tokens *auth.Verifier) *SSHSession {
 	base := baseSession{
 		id:         xid.New().String(),
 		nodeID:     nodeID,
-		store:      NewRedisStore(redisPool),
+		store:      store,
 		ClusterURL: clusterURL,
 		RegionID:   region,
+		protocol:   "ssh",
+		tokens:     tokens,
 		logger:     logger.WithFields(logrus.Fields{"prefix": "SSHSession"}),
 	}
 	s := &SSHSession{
 		tcpConn:     tcpConn,
 		baseSession: base,
 	}
-	config.PasswordCallback = s.authFromToken
-	s.config = config
+	// config is shared by all sessions, the callbacks are bound to this one
+	sessionConfig := *config
+	sessionConfig.PasswordCallback = s.authFromToken
+	sessionConfig.PublicKeyCallback = s.authFromPublicKey
+	s.config = &sessionConfig
 	return s
 }
 
@@ -190,11 +197,23 @@ func (s *SSHSession) RequireStream() error {
 	if err != nil {
 		return err
 	}
+	// a public key may be queried without being used, so the backend is only
+	// known once the handshake succeeded
+	if sshConn.Permissions != nil {
+		if backendID, ok := sshConn.Permissions.Extensions[sshBackendIDExtension]; ok {
+			if err := s.authFromBackendID(backendID); err != nil {
+				sshConn.Close()
+				return err
+			}
+			s.setConnMetadata(sshConn)
+		}
+	}
 	s.conn = sshConn
 	s.chans = chans
 	s.reqs = reqs
 	go handleChannels(chans)
 	go openSessionsMetric.With(labels(s)).Add(1)
+	s.reportOpened()
 	return nil
 }
 
@@ -238,31 +257,62 @@ func (s *SSHSession) Close() {
 	go func() {
 		openSessionsMetric.With(labels(s)).Sub(1)
 	}()
+	s.reportClosed()
 	s.conn.Close()
 }
 
 func (s *SSHSession) authFromToken(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-	backendID, err := s.store.BackendIDFromToken(strings.TrimSpace(string(pass)))
-	if err != nil && err != redis.ErrNil {
+	// the token is never part of the error, it ends up in logs
+	if err := s.baseSession.authFromToken(string(pass)); err != nil {
 		return nil, err
 	}
-	if backendID == "" {
-		return nil, errors.New("token '" + string(pass) + "' rejected")
-	}
+	s.setConnMetadata(c)
 
-	// assume false if not set
-	requiresClientAuth, err := s.store.BackendRequiresClientAuth(backendID)
-	if err != nil {
+	return nil, nil
+}
+
+// authFromPublicKey authorizes keys registered for a backend and certificates signed by a backend CA
+func (s *SSHSession) authFromPublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var backendID string
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			id, err := s.backendIDFromSSHKey(s.store.BackendIDFromSSHCA, auth)
+			if err != nil && err != ErrInvalidSSHKey {
+				s.logger.Errorf("Couldn't look up SSH CA: %s", err.Error())
+			}
+			backendID = id
+			return err == nil
+		},
+		UserKeyFallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			id, err := s.backendIDFromSSHKey(s.store.BackendIDFromSSHKey, key)
+			backendID = id
+			return nil, err
+		},
+	}
+	if _, err := checker.Authenticate(c, key); err != nil {
 		return nil, err
 	}
 
-	s.backendID = backendID
+	return &ssh.Permissions{
+		Extensions: map[string]string{sshBackendIDExtension: backendID},
+	}, nil
+}
+
+func (s *SSHSession) backendIDFromSSHKey(lookup func(fingerprint string) (string, error), key ssh.PublicKey) (string, error) {
+	backendID, err := lookup(ssh.FingerprintSHA256(key))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if backendID == "" {
+		return "", ErrInvalidSSHKey
+	}
+	return backendID, nil
+}
+
+func (s *SSHSession) setConnMetadata(c ssh.ConnMetadata) {
 	s.agent = string(c.ClientVersion())
 	s.sshSessionID = hex.EncodeToString(c.SessionID())
-	s.requiresClientAuth = requiresClientAuth
 	s.clientAddr = c.RemoteAddr().String()
-
-	return nil, nil
 }
 
 func (s *SSHSession) setSSHPort(req *ssh.Request, ln net.Listener) tcpipForward {
@@ -340,9 +390,11 @@ func (s *SSHSession) handleRemoteForward(req *ssh.Request, ln net.Listener) {
 				}
 				go ssh.DiscardRequests(reqs)
 				go openChannelsMetric.With(labels(s)).Add(1)
+				done := s.reportIngressConn()
 				go func() {
 					chWritten, ingressConnWritten, err := wnet.CopyCloseIO(ch, ingressConn)
 					openChannelsMetric.With(labels(s)).Sub(1)
+					done(chWritten, ingressConnWritten)
 					if connWithMetrics, ok := ingressConn.(*wnet.ServerConnTracker); ok {
 						connWithMetrics.ReportDataMetrics(ingressConnWritten, chWritten)
 					}
@@ -388,8 +440,7 @@ func (s *SSHSession) registerRelease(req *ssh.Request) {
 	}
 
 	if release, ok := msg.(*messages.Release); ok {
-		s.release = release
-		s.store.RegisterRelease(s)
+		s.updateRelease(release)
 	} else {
 		s.logger.Warnf("Couldn't process release info: Unexpected message type")
 	}
@@ -0,0 +1,105 @@
+package session
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHSessionPublicKeyAuth(t *testing.T) {
+	testRedis.HSet("backend:backend_1", "client_auth_disabled", "true")
+	testRedis.HSet("backend:backend_2", "client_auth_disabled", "true")
+
+	config := &ssh.ServerConfig{}
+	config.AddHostKey(newTestSSHSigner(t))
+
+	key := newTestSSHSigner(t)
+	testRedis.HSet("backend_ssh_keys", ssh.FingerprintSHA256(key.PublicKey()), "backend_1")
+
+	ca := newTestSSHSigner(t)
+	testRedis.HSet("backend_ssh_cas", ssh.FingerprintSHA256(ca.PublicKey()), "backend_2")
+
+	certKey := newTestSSHSigner(t)
+	cert := &ssh.Certificate{
+		Key:         certKey.PublicKey(),
+		CertType:    ssh.UserCert,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Test_authorized_key", func(t *testing.T) {
+		s, err := newTestSSHSessionHandshake(config, key)
+		assert.NoError(t, err, "Should accept authorized key")
+		assert.Equal(t, "backend_1", s.BackendID())
+		assert.False(t, s.RequiresClientAuth())
+	})
+
+	t.Run("Test_ca_signed_certificate", func(t *testing.T) {
+		s, err := newTestSSHSessionHandshake(config, certSigner)
+		assert.NoError(t, err, "Should accept certificate signed by a backend CA")
+		assert.Equal(t, "backend_2", s.BackendID())
+	})
+
+	t.Run("Test_unknown_key", func(t *testing.T) {
+		_, err := newTestSSHSessionHandshake(config, certKey)
+		assert.Error(t, err, "Should reject unknown key")
+	})
+}
+
+func newTestSSHSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestSSHSessionHandshake performs the SSH handshake of a client authenticating with signer
+func newTestSSHSessionHandshake(config *ssh.ServerConfig, signer ssh.Signer) (*SSHSession, error) {
+	// both sides send their version first, which would block on a net.Pipe
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	cConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer cConn.Close()
+
+	sConn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		clientConfig := &ssh.ClientConfig{
+			User:            "test",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		}
+		if _, _, _, err := ssh.NewClientConn(cConn, "pipe", clientConfig); err != nil {
+			cConn.Close()
+		}
+	}()
+
+	s := NewSSHSession(log.New(), "test_cluster", "test_id", "test_region", NewRedisStore(redisPool), sConn, config, nil)
+	return s, s.RequireStream()
+}
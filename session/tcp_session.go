@@ -1,15 +1,18 @@
 package session
 
 import (
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/hashicorp/yamux"
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
+	"github.com/superfly/wormhole/auth"
 	"github.com/superfly/wormhole/messages"
 	wnet "github.com/superfly/wormhole/net"
 )
@@ -18,45 +21,140 @@ const (
 	connCheckInterval     = 1 * time.Second
 	pingTimeoutInterval   = 10 * time.Second
 	tunnelTimeoutInterval = 10 * time.Second
+
+	// defaultMaxIngressConns is the number of ingress connections proxied at once if unset
+	defaultMaxIngressConns = 100
 )
 
 // TCPSession extends information about connected client stored in Session.
 // It also includes:
 // - control connection for exchanging communication with the client
-// - channel with available tunnel connections
+// - channel with available tunnel connections, kept within its tunnel limits
+// - multiplexed session when tunnels are opened as streams over a single connection
 // - timestamp with the last known ping from the client
 type TCPSession struct {
 	baseSession
 
+	token      string
+	resumeWith string
+	clientCert *x509.Certificate
+	registry   *Registry
 	control    net.Conn
+	reader     *messages.Reader
+	writer     *messages.Writer
 	conns      chan net.Conn
+	tunnels    *tunnelPool
+	mux        *yamux.Session
 	lastPingAt int64
+	// lastTunnelAt is when a tunnel was last taken from conns
+	lastTunnelAt int64
+
+	// ingress holds a token for every ingress connection being proxied, bounding their number
+	ingress chan struct{}
+	// closed is closed with the session, to stop waiting for ingress tokens
+	closed chan struct{}
+
+	// ln is closed with the session so that its endpoints can be reused on resume
+	ln        net.Listener
+	lnLock    sync.Mutex
+	closeOnce sync.Once
+}
+
+// TCPSessionArgs defines the arguments to be passed to NewTCPSession
+type TCPSessionArgs struct {
+	Logger *logrus.Logger
+	NodeID string
+	Region string
+	Store  Store
+	Conn   net.Conn
+	// Token and ResumeToken are the ones sent by the client in AuthControl
+	Token       string
+	ResumeToken string
+	// ClientCert is the TLS certificate presented by the client, if any
+	ClientCert *x509.Certificate
+	// TokenVerifier verifies signed tokens, if configured
+	TokenVerifier *auth.Verifier
+	// Registry holds the sessions which may be taken over when resuming
+	Registry *Registry
+	// MaxIngressConns is the number of ingress connections proxied at once, further ones wait
+	// to be accepted. It defaults to defaultMaxIngressConns
+	MaxIngressConns int
+	// TunnelLimits bound the tunnel connections of the session, unless the backend sets its own
+	// Unset limits default to DefaultTunnelLimits
+	TunnelLimits TunnelLimits
+	// Protocol is the name of the tunnel type, labeling metrics and checked against the scope
+	// of signed tokens. It defaults to "tcp", or "tcpmux" for multiplexed sessions
+	Protocol string
 }
 
 // NewTCPSession creates new TCPSession struct
-func NewTCPSession(logger *logrus.Logger, nodeID string, redisPool *redis.Pool, conn net.Conn) *TCPSession {
+func NewTCPSession(args *TCPSessionArgs) *TCPSession {
 	base := baseSession{
-		id:     xid.New().String(),
-		nodeID: nodeID,
-		store:  NewRedisStore(redisPool),
-		logger: logger.WithFields(logrus.Fields{"prefix": "TCPSession"}),
+		id:         xid.New().String(),
+		nodeID:     args.NodeID,
+		clientAddr: args.Conn.RemoteAddr().String(),
+		store:      args.Store,
+		RegionID:   args.Region,
+		protocol:   args.Protocol,
+		tokens:     args.TokenVerifier,
+		logger:     args.Logger.WithFields(logrus.Fields{"prefix": "TCPSession"}),
+	}
+	maxIngressConns := args.MaxIngressConns
+	if maxIngressConns <= 0 {
+		maxIngressConns = defaultMaxIngressConns
 	}
+	if base.protocol == "" {
+		base.protocol = "tcp"
+	}
+	limits := args.TunnelLimits.withDefaults(DefaultTunnelLimits)
 	s := &TCPSession{
-		control:     conn,
+		token:       args.Token,
+		resumeWith:  args.ResumeToken,
+		clientCert:  args.ClientCert,
+		registry:    args.Registry,
+		control:     args.Conn,
+		reader:      messages.NewReader(args.Conn),
+		writer:      messages.NewWriter(args.Conn),
 		baseSession: base,
-		conns:       make(chan net.Conn, 10),
+		conns:       make(chan net.Conn, limits.MaxTotal),
 		lastPingAt:  time.Now().UnixNano(),
+		ingress:     make(chan struct{}, maxIngressConns),
+		closed:      make(chan struct{}),
 	}
+	s.lastTunnelAt = s.lastPingAt
+	s.tunnels = newTunnelPool(limits, s.openTunnel)
 	return s
 }
 
+// NewTCPMuxSession creates new TCPSession struct which multiplexes the control channel
+// and all tunnels as streams over args.Conn
+func NewTCPMuxSession(args *TCPSessionArgs) (*TCPSession, error) {
+	mux, err := yamux.Server(args.Conn, wnet.MuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	s := NewTCPSession(args)
+	s.mux = mux
+	if args.Protocol == "" {
+		s.protocol = "tcpmux"
+	}
+	return s, nil
+}
+
 // AddTunnel adds a connection to the pool of tunnel connections
+// It's discarded if the session has as many tunnels as its limits allow
 func (s *TCPSession) AddTunnel(conn net.Conn) {
+	if !s.tunnels.add() {
+		s.logger.Infof("Session has %d tunnels already, discarding.", s.tunnels.limits().MaxTotal)
+		conn.Close()
+		return
+	}
 	select {
 	case s.conns <- conn:
 		s.logger.Info("Added Tunnel")
 	default:
 		s.logger.Info("Tunnels buffer is full, discarding.")
+		s.tunnels.remove()
 		conn.Close()
 	}
 }
@@ -64,7 +162,16 @@ func (s *TCPSession) AddTunnel(conn net.Conn) {
 // GetTunnel gets a new tunnel connection from the pool of available connections.
 // If no connections are available it will request a new tunnel connection from
 // the client and it will block until tunnelTimeoutInterval.
+// Tunnels are then requested to keep the session MinIdle idle ones.
 func (s *TCPSession) GetTunnel() (conn net.Conn, err error) {
+	if s.mux != nil {
+		conn, err = s.mux.Open()
+		if err != nil {
+			err = fmt.Errorf("Couldn't open tunnel stream: %s", err.Error())
+		}
+		return
+	}
+
 	var ok bool
 
 	// get a tunnel connection from the pool
@@ -78,30 +185,107 @@ func (s *TCPSession) GetTunnel() (conn net.Conn, err error) {
 		// no tunnels available in the pool, ask for one over the control channel
 		s.logger.Debug("No tunnels in pool, requesting tunnel from control . . .")
 
-		err = s.openTunnel()
-		if err != nil {
+		done := s.tunnels.wait()
+		defer done()
+		if err = s.fillTunnels(); err != nil {
 			return
 		}
 
-		select {
-		case conn, ok = <-s.conns:
-			if !ok {
-				err = fmt.Errorf("No tunnel connections available, control is closing")
+		timeout := time.After(tunnelTimeoutInterval)
+		retry := time.NewTicker(connCheckInterval)
+		defer retry.Stop()
+
+		for conn == nil {
+			select {
+			case conn, ok = <-s.conns:
+				if !ok {
+					err = fmt.Errorf("No tunnel connections available, control is closing")
+					return
+				}
+			case <-retry.C:
+				// tunnels closed since may leave room for the one requested
+				if err = s.fillTunnels(); err != nil {
+					return
+				}
+			case <-timeout:
+				err = fmt.Errorf("Timeout trying to get tunnel connection")
 				return
 			}
+		}
+	}
+
+	atomic.StoreInt64(&s.lastTunnelAt, time.Now().UnixNano())
+	go func() {
+		if err := s.fillTunnels(); err != nil {
+			s.logger.Error(err)
+		}
+	}()
+	return
+}
+
+// fillTunnels requests tunnels until the session has MinIdle idle ones, and one more
+// for every ingress connection waiting for a tunnel
+func (s *TCPSession) fillTunnels() error {
+	return s.tunnels.fill(len(s.conns))
+}
+
+// shrinkTunnels closes the idle tunnels beyond MinIdle once none was used for IdleTimeout
+func (s *TCPSession) shrinkTunnels() {
+	check := time.NewTicker(connCheckInterval)
+	defer check.Stop()
 
-		case <-time.After(tunnelTimeoutInterval):
-			err = fmt.Errorf("Timeout trying to get tunnel connection")
+	for {
+		select {
+		case <-s.closed:
 			return
+		case <-check.C:
+		}
+
+		limits := s.tunnels.limits()
+		lastTunnel := time.Unix(0, atomic.LoadInt64(&s.lastTunnelAt))
+		if time.Since(lastTunnel) < limits.IdleTimeout {
+			continue
+		}
+
+		closed := 0
+	idle:
+		for len(s.conns) > limits.MinIdle {
+			select {
+			case conn := <-s.conns:
+				conn.Close()
+				s.tunnels.remove()
+				closed++
+			default:
+				break idle
+			}
+		}
+		if closed > 0 {
+			s.logger.Debugf("Closed %d idle tunnels", closed)
 		}
 	}
-	return
 }
 
-// RequireStream sends a request to the client to open a new tunnel Connection
-// for this Session.
+// RequireStream sends requests to the client to open the MinIdle tunnel connections
+// of this Session.
+// In multiplexed mode it opens the control stream instead, tunnel streams are
+// opened on demand by GetTunnel.
 func (s *TCPSession) RequireStream() error {
-	return s.openTunnel()
+	if s.mux != nil {
+		control, err := s.mux.Open()
+		if err != nil {
+			return fmt.Errorf("Couldn't open control stream: %s", err.Error())
+		}
+		s.control = control
+		s.reader = messages.NewReader(control)
+		s.writer = messages.NewWriter(control)
+		return nil
+	}
+	return s.fillTunnels()
+}
+
+// SendAuthResult tells the client whether it was authenticated over the control connection
+func (s *TCPSession) SendAuthResult(result *messages.AuthResult) error {
+	return s.writer.WriteMessage(result)
 }
 
 // HandleRequests handles all requests coming over the control connection from the client.
@@ -110,23 +294,63 @@ func (s *TCPSession) RequireStream() error {
 // It also handles out-of-band communication, like the maintaining the Session heartbeat or
 // request the client to open new tunnel connections.
 func (s *TCPSession) HandleRequests(ln net.Listener) {
+	s.lnLock.Lock()
+	s.ln = ln
+	s.lnLock.Unlock()
+	s.reportOpened()
 	go s.controlLoop()
 	go s.heartbeat()
+	if s.mux == nil {
+		go s.shrinkTunnels()
+	}
 	s.handleRemoteForward(ln)
 }
 
-// RequireAuthentication registers the connection
-// TODO: add authentication here
+// RequireAuthentication resolves the backend from the client certificate or the token sent by the client,
+// resumes the previous session if the client presented a valid resume token
+// and registers the connection
 func (s *TCPSession) RequireAuthentication() error {
+	if err := s.authFromCredentials(s.token, s.clientCert); err != nil {
+		return err
+	}
+	s.resume(s.resumeWith, s.registry)
+	if err := s.issueResumeToken(); err != nil {
+		s.logger.Errorf("Couldn't issue resume token: %s", err.Error())
+	}
+	if s.mux == nil {
+		s.setTunnelLimits(s.backendTunnelLimits(s.tunnels.limits()))
+	}
 	go s.store.RegisterConnection(s)
 	return nil
 }
 
+// setTunnelLimits replaces the tunnel limits of the session
+// Tunnels are only requested once the client is authenticated, so conns is still empty
+func (s *TCPSession) setTunnelLimits(limits TunnelLimits) {
+	s.tunnels.setLimits(limits)
+	if cap(s.conns) != limits.MaxTotal {
+		s.conns = make(chan net.Conn, limits.MaxTotal)
+	}
+}
+
 // Close closes SSHSession and registers disconnection
 func (s *TCPSession) Close() {
-	s.store.RegisterDisconnection(s)
-	s.logger.Infof("Closed session %s for %s %s (%s).", s.ID(), s.NodeID(), s.Agent(), s.Client())
-	s.control.Close()
+	s.closeOnce.Do(func() {
+		s.store.RegisterDisconnection(s)
+		s.reportClosed()
+		s.expireResumeToken()
+		close(s.closed)
+		s.logger.Infof("Closed session %s for %s %s (%s).", s.ID(), s.NodeID(), s.Agent(), s.Client())
+		s.control.Close()
+		if s.mux != nil {
+			s.mux.Close()
+		}
+		s.lnLock.Lock()
+		if s.ln != nil {
+			s.ln.Close()
+		}
+		s.lnLock.Unlock()
+	})
 }
 
 func (s *TCPSession) handleRemoteForward(ln net.Listener) {
@@ -155,34 +379,48 @@ func (s *TCPSession) handleRemoteForward(ln net.Listener) {
 		}
 		s.logger.Debugln("Accepted Ingress TCP conn from:", tcpConn.RemoteAddr())
 
-		tunnel, err := s.GetTunnel()
-		if err != nil {
-			s.logger.Errorf("Could not get a tunnel conn: %s", err.Error())
-			return
+		select {
+		case s.ingress <- struct{}{}:
+		default:
+			s.logger.Warnf("Proxying %d ingress conns, waiting for one to close", cap(s.ingress))
+			select {
+			case s.ingress <- struct{}{}:
+			case <-s.closed:
+				tcpConn.Close()
+				return
+			}
 		}
-
-		// request a new tunnel
 		go func() {
-			if err = s.openTunnel(); err != nil {
-				s.logger.Error(err)
-			}
+			defer func() { <-s.ingress }()
+			s.handleIngressConn(tcpConn)
 		}()
+	}
+}
 
-		_, _, err = wnet.CopyCloseIO(tunnel, tcpConn)
-		if err != nil && err != io.EOF {
-			s.logger.Error(err)
-		}
+// handleIngressConn proxies an ingress connection through a tunnel
+// The connection is dropped if no tunnel can be had, the session keeps serving others
+func (s *TCPSession) handleIngressConn(tcpConn net.Conn) {
+	tunnel, err := s.GetTunnel()
+	if err != nil {
+		s.logger.Errorf("Could not get a tunnel conn, dropping ingress conn from %s: %s", tcpConn.RemoteAddr(), err.Error())
+		tcpConn.Close()
+		return
+	}
+
+	done := s.reportIngressConn()
+	rcvd, sent, err := wnet.CopyCloseIO(tunnel, tcpConn)
+	done(rcvd, sent)
+	if s.mux == nil {
+		s.tunnels.remove()
+	}
+	if err != nil && err != io.EOF {
+		s.logger.Error(err)
 	}
 }
 
 func (s *TCPSession) openTunnel() error {
 	msg := &messages.OpenTunnel{ClientID: s.id}
-	b, err := messages.Pack(msg)
-	if err != nil {
-		return fmt.Errorf("Couldn't create a request to open new tunnel: %s", err.Error())
-	}
-	_, err = s.control.Write(b)
-	if err != nil {
+	if err := s.writer.WriteMessage(msg); err != nil {
 		return fmt.Errorf("Failed to send request to open new tunnel: %s", err.Error())
 	}
 	return nil
@@ -207,21 +445,10 @@ func (s *TCPSession) heartbeat() {
 }
 
 func (s *TCPSession) controlLoop() {
-	b := make([]byte, 1024)
-
 	for {
-		nr, err := s.control.Read(b)
-		if err == io.EOF {
-			continue
-		}
+		msg, err := s.reader.ReadMessage()
 		if err != nil {
-			s.logger.Errorf("error reading from control: " + err.Error())
-			s.Close()
-			return
-		}
-		msg, err := messages.Unpack(b[:nr])
-		if err != nil {
-			s.logger.Errorf("error parsing message from stream: " + err.Error())
+			s.logger.Errorf("error reading message from control: " + err.Error())
 			s.Close()
 			return
 		}
@@ -233,14 +460,13 @@ func (s *TCPSession) controlLoop() {
 		case *messages.Ping:
 			s.logger.Debug("Received Ping message.")
 			atomic.StoreInt64(&s.lastPingAt, time.Now().UnixNano())
-			bw, err := messages.Pack(&messages.Pong{})
-			if err != nil {
-				s.logger.Errorf("Couldn't create a Pong message: %s", err.Error())
-			}
-			_, err = s.control.Write(bw)
-			if err != nil {
+			if err := s.writer.WriteMessage(&messages.Pong{}); err != nil {
 				s.logger.Errorf("Failed to send Pong message: %s", err.Error())
 			}
+			s.registerHeartbeat(time.Duration(m.RTT))
+		case *messages.Release:
+			s.logger.Debugf("Received Release message: %s", m.ID)
+			s.updateRelease(m)
 		default:
 			s.logger.Warn("Unrecognized command. Ignoring.")
 		}
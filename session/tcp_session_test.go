@@ -0,0 +1,413 @@
+package session
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/superfly/tlstest"
+	"github.com/superfly/wormhole/auth"
+	"github.com/superfly/wormhole/messages"
+	wnet "github.com/superfly/wormhole/net"
+)
+
+func TestTCPMuxSession(t *testing.T) {
+	sConn, cConn := net.Pipe()
+
+	s, err := NewTCPMuxSession(&TCPSessionArgs{
+		Logger: log.New(),
+		NodeID: "test_id",
+		Store:  NewRedisStore(redisPool),
+		Conn:   sConn,
+		Token:  "test_token",
+	})
+	assert.NoError(t, err, "Should be no error creating tcp mux session")
+	defer s.Close()
+	assert.Equal(t, "tcpmux", s.protocol)
+
+	wsConn, _ := net.Pipe()
+	ws, err := NewTCPMuxSession(&TCPSessionArgs{
+		Logger:   log.New(),
+		NodeID:   "test_id",
+		Store:    NewRedisStore(redisPool),
+		Conn:     wsConn,
+		Protocol: "ws",
+	})
+	assert.NoError(t, err, "Should be no error creating websocket session")
+	assert.Equal(t, "ws", ws.protocol, "Should keep the protocol passed in args")
+	wsConn.Close()
+
+	client, err := yamux.Client(cConn, wnet.MuxConfig())
+	assert.NoError(t, err, "Should be no error creating mux client")
+	defer client.Close()
+
+	t.Run("Test_control_stream", func(t *testing.T) {
+		err := s.RequireStream()
+		assert.NoError(t, err, "Should be no error opening control stream")
+
+		control, err := client.Accept()
+		assert.NoError(t, err, "Should be no error accepting control stream")
+
+		go s.control.Write([]byte("ping"))
+
+		b := make([]byte, 4)
+		_, err = io.ReadFull(control, b)
+		assert.NoError(t, err, "Should be no error reading from control stream")
+		assert.Equal(t, "ping", string(b))
+	})
+
+	t.Run("Test_get_tunnel", func(t *testing.T) {
+		tunnel, err := s.GetTunnel()
+		assert.NoError(t, err, "Should be no error getting a tunnel stream")
+
+		stream, err := client.Accept()
+		assert.NoError(t, err, "Should be no error accepting tunnel stream")
+
+		go tunnel.Write([]byte("test"))
+
+		b := make([]byte, 4)
+		_, err = io.ReadFull(stream, b)
+		assert.NoError(t, err, "Should be no error reading from tunnel stream")
+		assert.Equal(t, "test", string(b))
+	})
+}
+
+func TestTCPSessionConcurrentIngress(t *testing.T) {
+	sConn, cConn := net.Pipe()
+
+	s, err := NewTCPMuxSession(&TCPSessionArgs{
+		Logger:          log.New(),
+		NodeID:          "test_id",
+		Store:           NewRedisStore(redisPool),
+		Conn:            sConn,
+		MaxIngressConns: 2,
+	})
+	assert.NoError(t, err, "Should be no error creating tcp mux session")
+	defer s.Close()
+
+	client, err := yamux.Client(cConn, wnet.MuxConfig())
+	assert.NoError(t, err, "Should be no error creating mux client")
+	defer client.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.handleRemoteForward(ln)
+
+	streams := make(chan net.Conn)
+	go func() {
+		for {
+			stream, err := client.Accept()
+			if err != nil {
+				return
+			}
+			streams <- stream
+		}
+	}()
+	nextStream := func() net.Conn {
+		select {
+		case stream := <-streams:
+			return stream
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	first, second := dial(), dial()
+	defer second.Close()
+	// streams aren't necessarily opened in the order conns were dialed, they're told apart by payload
+	first.Write([]byte("first"))
+	second.Write([]byte("secnd"))
+	proxied := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		stream := nextStream()
+		if stream == nil {
+			t.Fatal("Should proxy both ingress conns while under the limit")
+		}
+		stream.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 5)
+		_, err := io.ReadFull(stream, b)
+		assert.NoError(t, err, "Should be no error reading from tunnel stream")
+		proxied[string(b)] = true
+	}
+	assert.Equal(t, map[string]bool{"first": true, "secnd": true}, proxied, "Should proxy each ingress conn to its own stream")
+
+	third := dial()
+	defer third.Close()
+	assert.Nil(t, nextStream(), "Should not proxy more ingress conns than the limit")
+
+	first.Close()
+	assert.NotNil(t, nextStream(), "Should proxy the waiting ingress conn once another is closed")
+}
+
+func TestTCPSessionRequireAuthentication(t *testing.T) {
+	testRedis.HSet("backend_tokens", "good_token", "backend_1")
+	testRedis.HSet("backend_tokens", "other_token", "backend_2")
+	testRedis.HSet("backend:backend_1", "client_auth_disabled", "true")
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := newTestTCPSession(sConn, "bad_token", "")
+	assert.Equal(t, ErrInvalidToken, s.RequireAuthentication(), "Should reject unknown token")
+
+	s = newTestTCPSession(sConn, "good_token", "")
+	assert.NoError(t, s.RequireAuthentication(), "Should accept known token")
+	assert.Equal(t, "backend_1", s.BackendID())
+	assert.False(t, s.RequiresClientAuth())
+
+	assert.NoError(t, s.AuthenticateTunnel("good_token", nil), "Should accept tunnels with the session token")
+	assert.Equal(t, ErrInvalidToken, s.AuthenticateTunnel("other_token", nil), "Should reject tunnels of other backends")
+	assert.Equal(t, ErrInvalidToken, s.AuthenticateTunnel("bad_token", nil), "Should reject tunnels with unknown token")
+}
+
+func TestTCPSessionClientCertificate(t *testing.T) {
+	testRedis.HSet("backend:backend_1", "client_auth_disabled", "true")
+
+	cert, err := x509.ParseCertificate(serverTLSCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRedis.HSet("backend_client_certs", certificateFingerprint(cert), "backend_1")
+
+	_, otherCrtPEM, _, err := tlstest.CreateServerCertKeyPEMPairWithRootCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(otherCrtPEM)
+	other, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := newTestTCPSession(sConn, "", "")
+	s.clientCert = other
+	assert.Equal(t, ErrInvalidClientCertificate, s.RequireAuthentication(), "Should reject unregistered certificate")
+
+	s = newTestTCPSession(sConn, "", "")
+	s.clientCert = cert
+	assert.NoError(t, s.RequireAuthentication(), "Should accept registered certificate")
+	assert.Equal(t, "backend_1", s.BackendID())
+
+	assert.NoError(t, s.AuthenticateTunnel("", cert), "Should accept tunnels with the session certificate")
+	assert.Equal(t, ErrInvalidClientCertificate, s.AuthenticateTunnel("", other), "Should reject tunnels with other certificates")
+}
+
+func TestTCPSessionSignedToken(t *testing.T) {
+	testRedis.HSet("backend:backend_1", "client_auth_disabled", "true")
+
+	keys := map[string][]byte{"test_key": []byte("test_secret")}
+	sign := func(claims *auth.Claims) string {
+		token, err := auth.Sign(claims, "test_key", keys["test_key"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	newSession := func(token string) *TCPSession {
+		s := newTestTCPSession(sConn, token, "")
+		s.tokens = auth.NewVerifier(keys)
+		s.RegionID = "ord"
+		return s
+	}
+
+	s := newSession(sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: expiresAt, Protocols: []string{"ssh"}}))
+	assert.Equal(t, ErrTokenNotAllowed, s.RequireAuthentication(), "Should reject token scoped for other protocols")
+
+	s = newSession(sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: expiresAt, Regions: []string{"iad"}}))
+	assert.Equal(t, ErrTokenNotAllowed, s.RequireAuthentication(), "Should reject token scoped for other regions")
+
+	expired := sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	s = newSession(expired)
+	assert.Equal(t, auth.ErrTokenExpired, s.RequireAuthentication(), "Should reject expired token")
+
+	scoped := sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: expiresAt, Protocols: []string{"tcp"}, Regions: []string{"ord"}})
+	s = newSession(scoped)
+	assert.NoError(t, s.RequireAuthentication(), "Should accept token scoped for the session")
+	assert.Equal(t, "backend_1", s.BackendID())
+
+	assert.NoError(t, s.AuthenticateTunnel(scoped, nil), "Should accept tunnels with the session token")
+	assert.Equal(t, auth.ErrTokenExpired, s.AuthenticateTunnel(expired, nil), "Should reject tunnels with another expired token")
+	sshOnly := sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: expiresAt, Protocols: []string{"ssh"}})
+	assert.Equal(t, ErrTokenNotAllowed, s.AuthenticateTunnel(sshOnly, nil), "Should reject tunnels with token scoped for other protocols")
+	iadOnly := sign(&auth.Claims{BackendID: "backend_1", ExpiresAt: expiresAt, Regions: []string{"iad"}})
+	assert.Equal(t, ErrTokenNotAllowed, s.AuthenticateTunnel(iadOnly, nil), "Should reject tunnels with token scoped for other regions")
+	other := sign(&auth.Claims{BackendID: "backend_2", ExpiresAt: expiresAt})
+	assert.Equal(t, ErrInvalidToken, s.AuthenticateTunnel(other, nil), "Should reject tunnels of other backends")
+	assert.Equal(t, ErrInvalidToken, s.AuthenticateTunnel(other+"x", nil), "Should reject tunnels with invalid signature")
+}
+
+func TestTCPSessionResume(t *testing.T) {
+	testRedis.HSet("backend_tokens", "good_token", "backend_1")
+	testRedis.HSet("backend_tokens", "other_token", "backend_2")
+	testRedis.HSet("backend:backend_1", "client_auth_disabled", "true")
+	testRedis.HSet("backend:backend_2", "client_auth_disabled", "true")
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	registry := NewRegistry(log.New())
+
+	prev := newTestTCPSession(sConn, "good_token", "")
+	prev.registry = registry
+	assert.NoError(t, prev.RequireAuthentication())
+	assert.NotEmpty(t, prev.ResumeToken(), "Should issue a resume token")
+	registry.AddSession(prev)
+
+	s := newTestTCPSession(sConn, "other_token", prev.ResumeToken())
+	s.registry = registry
+	assert.NoError(t, s.RequireAuthentication())
+	assert.NotEqual(t, prev.ID(), s.ID(), "Should not resume a session of another backend")
+	assert.Equal(t, prev, registry.GetSession(prev.ID()), "Should keep the session of another backend")
+
+	s = newTestTCPSession(sConn, "good_token", prev.ResumeToken())
+	s.registry = registry
+	assert.NoError(t, s.RequireAuthentication())
+	assert.Equal(t, prev.ID(), s.ID(), "Should resume the previous session")
+	assert.NotEqual(t, prev.ResumeToken(), s.ResumeToken(), "Should issue a new resume token")
+	assert.Nil(t, registry.GetSession(prev.ID()), "Should remove the previous session from the registry")
+
+	s = newTestTCPSession(sConn, "good_token", prev.ResumeToken())
+	assert.NoError(t, s.RequireAuthentication())
+	assert.NotEqual(t, prev.ID(), s.ID(), "Should not resume twice with the same token")
+}
+
+func TestTCPSessionHeartbeat(t *testing.T) {
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := newTestTCPSession(sConn, "", "")
+	s.backendID = "backend_1"
+	s.AddEndpoint(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001})
+	go s.controlLoop()
+
+	reader, writer := messages.NewReader(cConn), messages.NewWriter(cConn)
+	ping := func(rtt time.Duration) {
+		assert.NoError(t, writer.WriteMessage(&messages.Ping{RTT: int64(rtt)}))
+		msg, err := reader.ReadMessage()
+		assert.NoError(t, err, "Should be no error reading Pong")
+		assert.IsType(t, &messages.Pong{}, msg)
+	}
+
+	// the session handles a Ping after answering the previous one
+	ping(5 * time.Millisecond)
+	ping(7 * time.Millisecond)
+	ping(0)
+
+	assert.Equal(t, 7*time.Millisecond, s.RTT(), "Should keep the last reported RTT")
+	for _, key := range []string{s.Key(), "backend:backend_1:endpoint:127.0.0.1:10001"} {
+		assert.NotEmpty(t, testRedis.HGet(key, "last_seen_at"))
+		assert.Equal(t, "5.000", testRedis.HGet(key, "rtt_ms"), "Should register at most one heartbeat per interval")
+	}
+}
+
+func TestTCPSessionRelease(t *testing.T) {
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := newTestTCPSession(sConn, "", "")
+	s.backendID = "backend_1"
+	s.AddEndpoint(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10002})
+	go s.controlLoop()
+
+	reader, writer := messages.NewReader(cConn), messages.NewWriter(cConn)
+	for _, release := range []*messages.Release{{ID: "v1", Branch: "master"}, {ID: "v2", Branch: "next"}} {
+		assert.NoError(t, writer.WriteMessage(release))
+	}
+	// the session answers the Ping once the releases are handled
+	assert.NoError(t, writer.WriteMessage(&messages.Ping{}))
+	_, err := reader.ReadMessage()
+	assert.NoError(t, err, "Should be no error reading Pong")
+
+	assert.Equal(t, "v2", s.Release().ID, "Should keep the last release")
+	releases, err := testRedis.ZMembers("backend:backend_1:releases")
+	assert.NoError(t, err)
+	assert.Contains(t, releases, "v1")
+	assert.Contains(t, releases, "v2")
+	assert.Equal(t, "next", testRedis.HGet("backend:backend_1:endpoint:127.0.0.1:10002", "branch"))
+}
+
+func TestTCPSessionTunnelLimits(t *testing.T) {
+	testRedis.HSet("backend_tokens", "limits_token", "backend_3")
+	testRedis.HSet("backend:backend_3", "client_auth_disabled", "true")
+	testRedis.HSet("backend:backend_3", "tunnel_min_idle", "2")
+	testRedis.HSet("backend:backend_3", "tunnel_max_total", "3")
+
+	sConn, cConn := net.Pipe()
+	defer cConn.Close()
+
+	s := newTestTCPSession(sConn, "limits_token", "")
+	defer s.Close()
+	assert.NoError(t, s.RequireAuthentication())
+	assert.Equal(t, TunnelLimits{MinIdle: 2, MaxTotal: 3, IdleTimeout: time.Minute}, s.tunnels.limits())
+
+	t.Run("Test_prewarm", func(t *testing.T) {
+		go s.RequireStream()
+
+		reader := messages.NewReader(cConn)
+		for i := 0; i < 2; i++ {
+			msg, err := reader.ReadMessage()
+			assert.NoError(t, err, "Should be no error reading OpenTunnel")
+			assert.IsType(t, &messages.OpenTunnel{}, msg)
+		}
+	})
+
+	t.Run("Test_max_total", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			tunnel, _ := net.Pipe()
+			s.AddTunnel(tunnel)
+		}
+		tunnel, discarded := net.Pipe()
+		s.AddTunnel(tunnel)
+
+		_, err := discarded.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "Should discard tunnels beyond MaxTotal")
+		assert.Equal(t, 3, len(s.conns))
+	})
+
+	t.Run("Test_shrink", func(t *testing.T) {
+		s.tunnels.setLimits(TunnelLimits{MinIdle: 2, MaxTotal: 3, IdleTimeout: time.Millisecond})
+		go s.shrinkTunnels()
+
+		for start := time.Now(); len(s.conns) > 2 && time.Since(start) < 3*connCheckInterval; {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 2, len(s.conns), "Should close idle tunnels beyond MinIdle")
+		open, _ := s.tunnels.counts()
+		assert.Equal(t, 2, open)
+	})
+}
+
+func newTestTCPSession(conn net.Conn, token, resumeToken string) *TCPSession {
+	return NewTCPSession(&TCPSessionArgs{
+		Logger:      log.New(),
+		NodeID:      "test_id",
+		Store:       NewRedisStore(redisPool),
+		Conn:        conn,
+		Token:       token,
+		ResumeToken: resumeToken,
+	})
+}
@@ -0,0 +1,184 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// tunnelGrowthThreshold is the share of the stream capacity of its tunnels an HTTP2 session
+// uses before it requests another tunnel
+const tunnelGrowthThreshold = 0.8
+
+// TunnelLimits bound the tunnel connections a TCP or HTTP2 session keeps with its client
+type TunnelLimits struct {
+	// MinIdle tunnels are requested as soon as the client is authenticated, and kept available
+	MinIdle int
+	// MaxTotal is the number of tunnels a session may have, idle or in use
+	MaxTotal int
+	// IdleTimeout is how long tunnels beyond MinIdle are kept unused before they're closed
+	IdleTimeout time.Duration
+}
+
+// DefaultTunnelLimits apply to sessions, and limits of backends, which don't set their own
+var DefaultTunnelLimits = TunnelLimits{MinIdle: 1, MaxTotal: 100, IdleTimeout: time.Minute}
+
+// withDefaults returns the limits with the unset ones taken from defaults
+func (l TunnelLimits) withDefaults(defaults TunnelLimits) TunnelLimits {
+	if l.MinIdle <= 0 {
+		l.MinIdle = defaults.MinIdle
+	}
+	if l.MaxTotal <= 0 {
+		l.MaxTotal = defaults.MaxTotal
+	}
+	if l.IdleTimeout <= 0 {
+		l.IdleTimeout = defaults.IdleTimeout
+	}
+	if l.MaxTotal < l.MinIdle {
+		l.MaxTotal = l.MinIdle
+	}
+	return l
+}
+
+// tunnelPool counts the tunnels of a session against its limits, and requests new ones
+// from the client with openTunnel. Requested tunnels are pending until the client connects
+// them, or for tunnelTimeoutInterval.
+type tunnelPool struct {
+	mu         sync.Mutex
+	lim        TunnelLimits
+	open       int
+	pending    []time.Time
+	waiting    int
+	openTunnel func() error
+}
+
+func newTunnelPool(limits TunnelLimits, openTunnel func() error) *tunnelPool {
+	return &tunnelPool{lim: limits, openTunnel: openTunnel}
+}
+
+func (p *tunnelPool) limits() TunnelLimits {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lim
+}
+
+func (p *tunnelPool) setLimits(limits TunnelLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lim = limits
+}
+
+// add counts a tunnel connected by the client
+// It returns false if the session has MaxTotal tunnels already, the tunnel should then be discarded
+func (p *tunnelPool) add() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) > 0 {
+		p.pending = p.pending[1:]
+	}
+	if p.open >= p.lim.MaxTotal {
+		return false
+	}
+	p.open++
+	return true
+}
+
+// remove stops counting a tunnel once it's closed
+func (p *tunnelPool) remove() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open > 0 {
+		p.open--
+	}
+}
+
+// wait counts a caller waiting for an idle tunnel until the returned func is called,
+// fill requests a tunnel for each of them
+func (p *tunnelPool) wait() func() {
+	p.mu.Lock()
+	p.waiting++
+	p.mu.Unlock()
+	return func() {
+		p.mu.Lock()
+		p.waiting--
+		p.mu.Unlock()
+	}
+}
+
+// fill requests enough tunnels for the session to have MinIdle idle ones, plus one for every
+// waiting caller, counting those pending. idle is the number of tunnels which aren't in use
+func (p *tunnelPool) fill(idle int) error {
+	p.mu.Lock()
+	n := p.reserve(p.lim.MinIdle + p.waiting - idle - len(p.pending))
+	p.mu.Unlock()
+	return p.request(n)
+}
+
+// grow requests one more tunnel, unless one is pending already
+func (p *tunnelPool) grow() error {
+	p.mu.Lock()
+	n := 0
+	p.expirePending()
+	if len(p.pending) == 0 {
+		n = p.reserve(1)
+	}
+	p.mu.Unlock()
+	return p.request(n)
+}
+
+// counts returns the number of open and pending tunnels
+func (p *tunnelPool) counts() (open, pending int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expirePending()
+	return p.open, len(p.pending)
+}
+
+// reserve counts up to n more tunnels as pending, without exceeding MaxTotal, and returns
+// how many were. p.mu must be held
+func (p *tunnelPool) reserve(n int) int {
+	p.expirePending()
+	if room := p.lim.MaxTotal - p.open - len(p.pending); n > room {
+		n = room
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		p.pending = append(p.pending, now)
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// expirePending drops the requests the client didn't answer in time. p.mu must be held
+func (p *tunnelPool) expirePending() {
+	for len(p.pending) > 0 && time.Since(p.pending[0]) > tunnelTimeoutInterval {
+		p.pending = p.pending[1:]
+	}
+}
+
+// request sends n reserved requests for tunnels to the client
+func (p *tunnelPool) request(n int) error {
+	for i := 0; i < n; i++ {
+		if err := p.openTunnel(); err != nil {
+			p.mu.Lock()
+			if unsent := n - i; unsent <= len(p.pending) {
+				p.pending = p.pending[:len(p.pending)-unsent]
+			}
+			p.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// backendTunnelLimits returns the tunnel limits of the session backend, falling back to defaults
+// It must be called once the session is authenticated
+func (s *baseSession) backendTunnelLimits(defaults TunnelLimits) TunnelLimits {
+	limits, err := s.store.BackendTunnelLimits(s.backendID)
+	if err != nil {
+		s.logger.Warnf("Couldn't get tunnel limits of backend %s: %s", s.backendID, err.Error())
+		return defaults
+	}
+	return limits.withDefaults(defaults)
+}
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelLimitsWithDefaults(t *testing.T) {
+	limits := TunnelLimits{MinIdle: 5}.withDefaults(DefaultTunnelLimits)
+	assert.Equal(t, TunnelLimits{MinIdle: 5, MaxTotal: 100, IdleTimeout: time.Minute}, limits)
+
+	limits = TunnelLimits{MinIdle: 5, MaxTotal: 2}.withDefaults(DefaultTunnelLimits)
+	assert.Equal(t, 5, limits.MaxTotal, "Should allow at least MinIdle tunnels")
+}
+
+func TestTunnelPool(t *testing.T) {
+	requested := 0
+	var requestErr error
+	p := newTunnelPool(TunnelLimits{MinIdle: 2, MaxTotal: 3}, func() error {
+		if requestErr != nil {
+			return requestErr
+		}
+		requested++
+		return nil
+	})
+
+	t.Run("Test_fill", func(t *testing.T) {
+		assert.NoError(t, p.fill(0))
+		assert.Equal(t, 2, requested, "Should request MinIdle tunnels")
+
+		assert.NoError(t, p.fill(0))
+		assert.Equal(t, 2, requested, "Should count pending tunnels as idle")
+
+		done := p.wait()
+		assert.NoError(t, p.fill(0))
+		done()
+		assert.Equal(t, 3, requested, "Should request a tunnel for a waiting caller")
+
+		assert.NoError(t, p.fill(0))
+		open, pending := p.counts()
+		assert.Equal(t, 0, open)
+		assert.Equal(t, 3, pending)
+	})
+
+	t.Run("Test_add", func(t *testing.T) {
+		assert.True(t, p.add())
+		assert.True(t, p.add())
+		assert.True(t, p.add())
+		assert.False(t, p.add(), "Should not add more than MaxTotal tunnels")
+
+		open, pending := p.counts()
+		assert.Equal(t, 3, open)
+		assert.Equal(t, 0, pending)
+	})
+
+	t.Run("Test_grow", func(t *testing.T) {
+		assert.NoError(t, p.grow())
+		assert.Equal(t, 3, requested, "Should not grow beyond MaxTotal tunnels")
+
+		p.remove()
+		assert.NoError(t, p.grow())
+		assert.NoError(t, p.grow())
+		assert.Equal(t, 4, requested, "Should grow by one tunnel at once")
+	})
+
+	t.Run("Test_request_error", func(t *testing.T) {
+		p.remove()
+		p.remove()
+		requestErr = errors.New("control closed")
+		assert.Error(t, p.fill(0))
+
+		_, pending := p.counts()
+		assert.Equal(t, 1, pending, "Should not count unsent requests as pending")
+	})
+}
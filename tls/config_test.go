@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"net"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -173,6 +174,10 @@ func (ts *testSession) Release() *messages.Release {
 	return nil
 }
 
+func (ts *testSession) RTT() time.Duration {
+	return 0
+}
+
 func (ts *testSession) RequireStream() error {
 	return errors.New("not implemented")
 }